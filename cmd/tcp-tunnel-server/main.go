@@ -5,23 +5,102 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/fsgo/networks/internal"
 	"github.com/fsgo/networks/tcptunnel"
 )
 
 var server = tcptunnel.NewServer()
 
+var logFlags internal.LogFlags
+
+var configFile = flag.String("c", "", "json config file with any number of servers, flags of single server are ignored when set, reload on SIGHUP")
+
+var shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "max time to wait for in-flight streams when exiting")
+
 func init() {
-	log.SetPrefix(fmt.Sprintf("[tcp-tunnel-server][pid=%d] ", os.Getpid()))
+	logFlags.Bind("TT_S_")
 	server.BindFlags()
 }
 
 func main() {
 	flag.Parse()
-	err := server.Start()
-	log.Fatalln("tcp-tunnel-server exit:", err)
+	logger, err := logFlags.NewLogger(os.Stderr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	logger = logger.With("app", "tcp-tunnel-server", "pid", os.Getpid())
+	slog.SetDefault(logger)
+	runner, err := newRunner(logger)
+	if err != nil {
+		logger.Error("invalid config", "err", err)
+		os.Exit(1)
+	}
+
+	if g, ok := runner.(*tcptunnel.ConfigGroup); ok {
+		go reloadOnSignal(logger, g)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		// 再次收到信号时直接退出
+		stop()
+		logger.Info("shutting down", "timeout", *shutdownTimeout)
+		sctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := runner.Shutdown(sctx); err != nil {
+			logger.Warn("shutdown", "err", err)
+		}
+	}()
+	if err := runner.Start(context.Background()); err != nil {
+		logger.Error("exit", "err", err)
+		os.Exit(1)
+	}
+	logger.Info("exit")
+}
+
+// newRunner 未指定配置文件时，使用命令行参数创建单个 server，否则使用配置文件中所有的 servers
+func newRunner(logger *slog.Logger) (tcptunnel.Runner, error) {
+	if *configFile == "" {
+		server.Logger = logger
+		return server, nil
+	}
+	cfg, err := tcptunnel.LoadConfig(*configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Servers) == 0 {
+		return nil, fmt.Errorf("%s: no servers", *configFile)
+	}
+	g := &tcptunnel.ConfigGroup{
+		Load: func() (*tcptunnel.Config, error) {
+			return tcptunnel.LoadConfig(*configFile)
+		},
+		Servers:      true,
+		DrainTimeout: *shutdownTimeout,
+		Logger:       logger,
+	}
+	return g, nil
+}
+
+// reloadOnSignal 收到 SIGHUP 时重新加载配置文件
+func reloadOnSignal(logger *slog.Logger, g *tcptunnel.ConfigGroup) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for range ch {
+		if _, err := g.Reload(); err != nil {
+			logger.Error("reload config failed", "err", err)
+		}
+	}
 }
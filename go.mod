@@ -3,3 +3,8 @@ module github.com/fsgo/networks
 go 1.25.1
 
 require github.com/xanygo/anygo v0.0.0-20251211131726-b7f3826a09ac
+
+require (
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0 // indirect
+)
@@ -0,0 +1,43 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package internal
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// copyBufferSize Copy 使用的缓冲区大小，和 io.Copy 默认的相同
+const copyBufferSize = 32 * 1024
+
+var bufPool = sync.Pool{
+	New: func() any {
+		bf := make([]byte, copyBufferSize)
+		return &bf
+	},
+}
+
+// Copy 从 src 复制数据到 dst，直到 EOF 或者出错
+// 两端都是 *net.TCPConn 时使用 io.Copy，以便使用 TCPConn.ReadFrom（linux 下为 splice），
+// 否则使用 sync.Pool 中的缓冲区，避免 io.Copy 每次分配 32KB 的缓冲区
+// 隧道中的 stream 都有一端是 mux stream，所以总是使用缓冲区
+func Copy(dst io.Writer, src io.Reader) (int64, error) {
+	if _, ok := dst.(*net.TCPConn); ok {
+		if _, ok = src.(*net.TCPConn); ok {
+			return io.Copy(dst, src)
+		}
+	}
+	// 隐藏连接的 ReaderFrom 和 WriterTo，避免如 TCPConn.ReadFrom 内部使用 io.Copy 再分配缓冲区
+	if _, ok := dst.(net.Conn); ok {
+		dst = struct{ io.Writer }{dst}
+	}
+	if _, ok := src.(net.Conn); ok {
+		src = struct{ io.Reader }{src}
+	}
+	bp := bufPool.Get().(*[]byte)
+	defer bufPool.Put(bp)
+	return io.CopyBuffer(dst, src, *bp)
+}
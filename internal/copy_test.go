@@ -0,0 +1,124 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package internal
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// plainConn 隐藏了 TCPConn 的 ReadFrom 和 WriteTo 的连接，和经过 tunnel 的 stream 一样只能使用缓冲区
+type plainConn struct {
+	net.Conn
+}
+
+func TestCopy(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 300*1024)
+	run := func(t *testing.T, wrap func(c net.Conn) net.Conn) {
+		client, in := tcpPair(t)
+		out, server := tcpPair(t)
+		go func() {
+			_, _ = client.Write(data)
+			_ = client.Close()
+		}()
+		done := make(chan []byte, 1)
+		go func() {
+			got, _ := io.ReadAll(server)
+			done <- got
+		}()
+		src, dst := wrap(in), wrap(out)
+		n, err := Copy(dst, src)
+		xt.NoError(t, err)
+		xt.Equal(t, int64(len(data)), n)
+		_ = out.Close()
+		xt.True(t, bytes.Equal(data, <-done))
+	}
+	t.Run("tcp", func(t *testing.T) {
+		run(t, func(c net.Conn) net.Conn {
+			return c
+		})
+	})
+	t.Run("buffer", func(t *testing.T) {
+		run(t, func(c net.Conn) net.Conn {
+			return &plainConn{Conn: c}
+		})
+	})
+	t.Run("reader", func(t *testing.T) {
+		bf := &bytes.Buffer{}
+		n, err := Copy(bf, bytes.NewReader(data))
+		xt.NoError(t, err)
+		xt.Equal(t, int64(len(data)), n)
+		xt.True(t, bytes.Equal(data, bf.Bytes()))
+	})
+}
+
+// benchmarkCopy 通过 loopback 上的两对 tcp 连接复制 b.N 块数据
+func benchmarkCopy(b *testing.B, copyFn func(dst io.Writer, src io.Reader) (int64, error), wrap func(c net.Conn) net.Conn) {
+	const size = 64 * 1024
+	client, in := tcpPair(b)
+	out, server := tcpPair(b)
+	chunk := make([]byte, size)
+	go func() {
+		for range b.N {
+			if _, err := client.Write(chunk); err != nil {
+				return
+			}
+		}
+		_ = client.Close()
+	}()
+	go func() {
+		_, _ = io.Copy(io.Discard, server)
+	}()
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	n, err := copyFn(wrap(out), wrap(in))
+	if err != nil || n != int64(b.N)*size {
+		b.Fatalf("copied %d bytes, err=%v", n, err)
+	}
+}
+
+func BenchmarkCopy(b *testing.B) {
+	plain := func(c net.Conn) net.Conn {
+		return &plainConn{Conn: c}
+	}
+	b.Run("io.Copy/plain", func(b *testing.B) {
+		benchmarkCopy(b, io.Copy, plain)
+	})
+	b.Run("Copy/plain", func(b *testing.B) {
+		benchmarkCopy(b, Copy, plain)
+	})
+	tcp := func(c net.Conn) net.Conn {
+		return c
+	}
+	b.Run("io.Copy/tcp", func(b *testing.B) {
+		benchmarkCopy(b, io.Copy, tcp)
+	})
+	b.Run("Copy/tcp", func(b *testing.B) {
+		benchmarkCopy(b, Copy, tcp)
+	})
+}
+
+// BenchmarkCopyShort 每次复制少量数据，如大量的短连接
+func BenchmarkCopyShort(b *testing.B) {
+	data := make([]byte, 4096)
+	run := func(b *testing.B, copyFn func(dst io.Writer, src io.Reader) (int64, error)) {
+		b.SetBytes(int64(len(data)))
+		b.ReportAllocs()
+		for range b.N {
+			_, _ = copyFn(struct{ io.Writer }{io.Discard}, struct{ io.Reader }{bytes.NewReader(data)})
+		}
+	}
+	b.Run("io.Copy", func(b *testing.B) {
+		run(b, io.Copy)
+	})
+	b.Run("Copy", func(b *testing.B) {
+		run(b, Copy)
+	})
+}
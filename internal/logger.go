@@ -0,0 +1,43 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/xanygo/anygo/cli/xflag"
+)
+
+// LogFlags 日志相关的命令行参数
+type LogFlags struct {
+	Level  string
+	Format string
+}
+
+// Bind 注册 -log-level 和 -log-format 参数，也可以通过环境变量 envPrefix+"log_level" 和 envPrefix+"log_format" 设置
+func (lf *LogFlags) Bind(envPrefix string) {
+	xflag.EnvStringVar(&lf.Level, "log-level", envPrefix+"log_level", "info", "log level: debug, info, warn, error")
+	xflag.EnvStringVar(&lf.Format, "log-format", envPrefix+"log_format", "text", "log format: text, json")
+}
+
+// NewLogger 按照参数创建输出到 w 的 logger
+func (lf *LogFlags) NewLogger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(lf.Level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q", lf.Level)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(lf.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q", lf.Format)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestLogFlags(t *testing.T) {
+	bf := &bytes.Buffer{}
+	lf := &LogFlags{Level: "warn", Format: "json"}
+	logger, err := lf.NewLogger(bf)
+	xt.NoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", "sid", 1)
+	xt.Equal(t, 1, strings.Count(bf.String(), "\n"))
+	xt.True(t, strings.Contains(bf.String(), `"msg":"shown","sid":1`))
+
+	_, err = (&LogFlags{Level: "verbose"}).NewLogger(bf)
+	xt.Error(t, err)
+	_, err = (&LogFlags{Level: "debug", Format: "xml"}).NewLogger(bf)
+	xt.Error(t, err)
+}
+
+func TestLogFlags_Bind(t *testing.T) {
+	t.Setenv("TT_T_log_level", "debug")
+	lf := &LogFlags{}
+	lf.Bind("TT_T_")
+	xt.Equal(t, "debug", lf.Level)
+	xt.Equal(t, "text", lf.Format)
+}
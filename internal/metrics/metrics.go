@@ -0,0 +1,316 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+// Package metrics 一个简单的指标库，以 Prometheus 文本格式输出
+//
+// 只实现了 tcptunnel 用到的部分：最多一个标签的计数器和直方图，以及在输出时取值的指标，
+// 以免引入 prometheus/client_golang 及其依赖
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets 默认的直方图分桶，单位为秒
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// ByteBuckets 字节数的直方图分桶
+var ByteBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+// Registry 指标的集合
+type Registry struct {
+	mu    sync.Mutex
+	items []metric
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.ContainsFunc(r.items, func(item metric) bool {
+		return item.name() == m.name()
+	}) {
+		panic(fmt.Sprintf("metric %q already registered", m.name()))
+	}
+	r.items = append(r.items, m)
+}
+
+// writeTo 以 Prometheus 文本格式输出所有的指标
+func (r *Registry) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	items := slices.Clone(r.items)
+	r.mu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, m := range items {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler 输出指标的 http.Handler
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = r.writeTo(w)
+	})
+}
+
+type desc struct {
+	Name  string
+	Help  string
+	Type  string
+	Label string // 标签名称，可选，只支持一个标签
+}
+
+func (d *desc) name() string {
+	return d.Name
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.Name, escapeHelp(d.Help), d.Name, d.Type)
+}
+
+func (d *desc) labels(value string, extra ...string) string {
+	var pairs []string
+	if d.Label != "" {
+		pairs = append(pairs, d.Label+`="`+escapeLabel(value)+`"`)
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+// Counter 只增不减的计数器
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Load() uint64 {
+	return c.v.Load()
+}
+
+// vec 按照标签值分组的指标
+type vec[T any] struct {
+	mu     sync.Mutex
+	keys   []string
+	values map[string]*T
+	create func() *T
+}
+
+func (v *vec[T]) with(label string) *T {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if item, ok := v.values[label]; ok {
+		return item
+	}
+	if v.values == nil {
+		v.values = make(map[string]*T)
+	}
+	item := v.create()
+	v.values[label] = item
+	v.keys = append(v.keys, label)
+	slices.Sort(v.keys)
+	return item
+}
+
+func (v *vec[T]) each(fn func(label string, item *T)) {
+	v.mu.Lock()
+	keys := slices.Clone(v.keys)
+	values := make([]*T, len(keys))
+	for i, k := range keys {
+		values[i] = v.values[k]
+	}
+	v.mu.Unlock()
+	for i, k := range keys {
+		fn(k, values[i])
+	}
+}
+
+// CounterVec 带有一个标签的计数器
+type CounterVec struct {
+	desc
+	vec[Counter]
+}
+
+// NewCounterVec 创建并注册一个带有标签的计数器，label 为空时为普通计数器
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	c := &CounterVec{
+		desc: desc{Name: name, Help: help, Type: "counter", Label: label},
+	}
+	c.create = func() *Counter {
+		return &Counter{}
+	}
+	r.add(c)
+	return c
+}
+
+// NewCounter 创建并注册一个计数器
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	return r.NewCounterVec(name, help, "").With("")
+}
+
+// With 返回标签值对应的计数器
+func (c *CounterVec) With(label string) *Counter {
+	return c.with(label)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.each(func(label string, item *Counter) {
+		fmt.Fprintf(w, "%s%s %d\n", c.Name, c.labels(label), item.Load())
+	})
+}
+
+// funcMetric 在输出时通过 fn 获取值的指标
+type funcMetric struct {
+	desc
+	fn func() float64
+}
+
+func (f *funcMetric) write(w *bufio.Writer) {
+	f.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", f.Name, formatFloat(f.fn()))
+}
+
+// NewCounterFunc 创建并注册一个计数器，值由 fn 提供
+func (r *Registry) NewCounterFunc(name string, help string, fn func() float64) {
+	r.add(&funcMetric{desc: desc{Name: name, Help: help, Type: "counter"}, fn: fn})
+}
+
+// NewGaugeFunc 创建并注册一个可增可减的指标，值由 fn 提供
+func (r *Registry) NewGaugeFunc(name string, help string, fn func() float64) {
+	r.add(&funcMetric{desc: desc{Name: name, Help: help, Type: "gauge"}, fn: fn})
+}
+
+// Histogram 直方图
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64 // 每个分桶（不累加）的数量，最后一个为 +Inf
+	count   atomic.Uint64
+	sumBits atomic.Uint64 // float64 的 bits
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)+1),
+	}
+}
+
+// Observe 记录一个值
+func (h *Histogram) Observe(v float64) {
+	idx, _ := slices.BinarySearch(h.buckets, v)
+	h.counts[idx].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		if h.sumBits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Count 返回记录的总数
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// sum 返回记录的值的总和
+func (h *Histogram) sum() float64 {
+	return math.Float64frombits(h.sumBits.Load())
+}
+
+// HistogramVec 带有一个标签的直方图
+type HistogramVec struct {
+	desc
+	vec[Histogram]
+}
+
+// NewHistogramVec 创建并注册一个带有标签的直方图，buckets 需要升序排列，label 为空时为普通直方图
+func (r *Registry) NewHistogramVec(name string, help string, label string, buckets []float64) *HistogramVec {
+	if !slices.IsSorted(buckets) {
+		panic(fmt.Sprintf("buckets of %q are not sorted", name))
+	}
+	h := &HistogramVec{
+		desc: desc{Name: name, Help: help, Type: "histogram", Label: label},
+	}
+	h.create = func() *Histogram {
+		return newHistogram(buckets)
+	}
+	r.add(h)
+	return h
+}
+
+// NewHistogram 创建并注册一个直方图
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, "", buckets).With("")
+}
+
+// With 返回标签值对应的直方图
+func (h *HistogramVec) With(label string) *Histogram {
+	return h.with(label)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.each(func(label string, item *Histogram) {
+		var cumulative uint64
+		for i, le := range item.buckets {
+			cumulative += item.counts[i].Load()
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labels(label, `le="`+formatFloat(le)+`"`), cumulative)
+		}
+		cumulative += item.counts[len(item.buckets)].Load()
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, h.labels(label, `le="+Inf"`), cumulative)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, h.labels(label), formatFloat(item.sum()))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.Name, h.labels(label), cumulative)
+	})
+}
@@ -0,0 +1,79 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "total count")
+	c.Inc()
+	c.Inc()
+	c.Inc()
+	xt.Equal(t, uint64(3), c.Load())
+
+	cv := r.NewCounterVec("test_errors_total", "errors by reason", "reason")
+	cv.With("auth").Inc()
+	cv.With(`a"b`).Inc()
+	cv.With(`a"b`).Inc()
+	cv.With("auth").Inc()
+
+	r.NewGaugeFunc("test_now", "current\nvalue", func() float64 {
+		return 1.5
+	})
+	r.NewCounterFunc("test_func_total", "func total", func() float64 {
+		return 10
+	})
+
+	h := r.NewHistogramVec("test_seconds", "duration", "direction", []float64{0.1, 1})
+	h.With("in").Observe(0.05)
+	h.With("in").Observe(0.1)
+	h.With("in").Observe(2)
+	xt.Equal(t, uint64(3), h.With("in").Count())
+	xt.Equal(t, 2.15, h.With("in").sum())
+
+	want := `# HELP test_total total count
+# TYPE test_total counter
+test_total 3
+# HELP test_errors_total errors by reason
+# TYPE test_errors_total counter
+test_errors_total{reason="a\"b"} 2
+test_errors_total{reason="auth"} 2
+# HELP test_now current\nvalue
+# TYPE test_now gauge
+test_now 1.5
+# HELP test_func_total func total
+# TYPE test_func_total counter
+test_func_total 10
+# HELP test_seconds duration
+# TYPE test_seconds histogram
+test_seconds_bucket{direction="in",le="0.1"} 2
+test_seconds_bucket{direction="in",le="1"} 2
+test_seconds_bucket{direction="in",le="+Inf"} 3
+test_seconds_sum{direction="in"} 2.15
+test_seconds_count{direction="in"} 3
+`
+	var bf bytes.Buffer
+	xt.NoError(t, r.writeTo(&bf))
+	xt.Equal(t, want, bf.String())
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	xt.Equal(t, want, rec.Body.String())
+	xt.Equal(t, "text/plain; version=0.0.4; charset=utf-8", rec.Header().Get("Content-Type"))
+
+	xt.Panic(t, func() {
+		r.NewCounter("test_total", "dup")
+	})
+	xt.Panic(t, func() {
+		r.NewHistogram("test_bad", "bad buckets", []float64{2, 1})
+	})
+}
@@ -0,0 +1,267 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+// Package proxyproto PROXY protocol v1 和 v2 的编码和解析，只支持 TCP
+// 协议见 https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/fsgo/networks/internal"
+)
+
+// 协议版本
+const (
+	V1 = 1
+	V2 = 2
+)
+
+var (
+	// ErrNoHeader 连接上的数据不是以 PROXY header 开始
+	ErrNoHeader = errors.New("proxyproto: no PROXY header")
+
+	// ErrInvalidHeader PROXY header 格式错误
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY header")
+)
+
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	maxV1Size = 107
+
+	cmdLocal = 0x20
+	cmdProxy = 0x21
+
+	famUnspec     = 0x00
+	famTCP4       = 0x11
+	famUDP4       = 0x12
+	famTCP6       = 0x21
+	famUDP6       = 0x22
+	famUnixStream = 0x31
+	famUnixDgram  = 0x32
+)
+
+// ParseVersion 解析配置中的版本，如 v1、v2，为空时返回 0
+func ParseVersion(str string) (int, error) {
+	switch str {
+	case "":
+		return 0, nil
+	case "v1", "1":
+		return V1, nil
+	case "v2", "2":
+		return V2, nil
+	default:
+		return 0, fmt.Errorf("unsupported PROXY protocol version %q", str)
+	}
+}
+
+// Header 生成 PROXY header，src 为客户端的地址，dst 为客户端连接的地址
+// src 或者 dst 无效时，v1 为 UNKNOWN，v2 为 LOCAL 命令，接收方会使用连接本身的地址
+func Header(version int, src netip.AddrPort, dst netip.AddrPort) ([]byte, error) {
+	src, dst, ok := normalize(src, dst)
+	switch version {
+	case V1:
+		if !ok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if src.Addr().Is6() {
+			proto = "TCP6"
+		}
+		line := fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, src.Addr(), dst.Addr(), src.Port(), dst.Port())
+		return []byte(line), nil
+	case V2:
+		bf := append([]byte{}, sigV2...)
+		if !ok {
+			bf = append(bf, cmdLocal, famUnspec)
+			return binary.BigEndian.AppendUint16(bf, 0), nil
+		}
+		if src.Addr().Is4() {
+			bf = append(bf, cmdProxy, famTCP4)
+			bf = binary.BigEndian.AppendUint16(bf, 12)
+			bf = append(bf, src.Addr().AsSlice()...)
+			bf = append(bf, dst.Addr().AsSlice()...)
+		} else {
+			bf = append(bf, cmdProxy, famTCP6)
+			bf = binary.BigEndian.AppendUint16(bf, 36)
+			bf = append(bf, src.Addr().AsSlice()...)
+			bf = append(bf, dst.Addr().AsSlice()...)
+		}
+		bf = binary.BigEndian.AppendUint16(bf, src.Port())
+		return binary.BigEndian.AppendUint16(bf, dst.Port()), nil
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+// normalize 使 src 和 dst 的地址族相同：都是 IPv4 时使用 IPv4，否则都使用 IPv6
+func normalize(src netip.AddrPort, dst netip.AddrPort) (netip.AddrPort, netip.AddrPort, bool) {
+	if !src.IsValid() || !dst.IsValid() {
+		return src, dst, false
+	}
+	sa, da := src.Addr().Unmap(), dst.Addr().Unmap()
+	if sa.Is4() != da.Is4() {
+		sa, da = netip.AddrFrom16(sa.As16()), netip.AddrFrom16(da.As16())
+	}
+	return netip.AddrPortFrom(sa, src.Port()), netip.AddrPortFrom(da, dst.Port()), true
+}
+
+// Read 读取 PROXY header，返回其中的 src 和 dst 地址
+// UNKNOWN 和 LOCAL 命令时返回无效的地址，调用方应使用连接本身的地址
+func Read(r *bufio.Reader) (src netip.AddrPort, dst netip.AddrPort, err error) {
+	head, err := r.Peek(5)
+	if err != nil {
+		return src, dst, err
+	}
+	if string(head) == "PROXY" {
+		return readV1(r)
+	}
+	head, err = r.Peek(len(sigV2))
+	if err != nil {
+		return src, dst, err
+	}
+	if !bytes.Equal(head, sigV2) {
+		return src, dst, ErrNoHeader
+	}
+	return readV2(r)
+}
+
+func readV1(r *bufio.Reader) (src netip.AddrPort, dst netip.AddrPort, err error) {
+	var line []byte
+	for len(line) < maxV1Size {
+		b, err := r.ReadByte()
+		if err != nil {
+			return src, dst, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	str, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return src, dst, ErrInvalidHeader
+	}
+	fields := strings.Split(str, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return src, dst, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return src, dst, ErrInvalidHeader
+	}
+	parse := func(host string, port string) (netip.AddrPort, error) {
+		addr, err := netip.ParseAddr(host)
+		if err != nil || addr.Is4() != (fields[1] == "TCP4") {
+			return netip.AddrPort{}, ErrInvalidHeader
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return netip.AddrPort{}, ErrInvalidHeader
+		}
+		return netip.AddrPortFrom(addr, uint16(p)), nil
+	}
+	if src, err = parse(fields[2], fields[4]); err != nil {
+		return src, dst, err
+	}
+	dst, err = parse(fields[3], fields[5])
+	return src, dst, err
+}
+
+func readV2(r *bufio.Reader) (src netip.AddrPort, dst netip.AddrPort, err error) {
+	head := make([]byte, len(sigV2)+4)
+	if _, err = io.ReadFull(r, head); err != nil {
+		return src, dst, err
+	}
+	cmd, fam := head[12], head[13]
+	// 高 4 位为版本号，必须为 2
+	if cmd>>4 != V2 {
+		return src, dst, ErrInvalidHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return src, dst, err
+	}
+	switch cmd {
+	case cmdLocal:
+		return src, dst, nil
+	case cmdProxy:
+	default:
+		return src, dst, ErrInvalidHeader
+	}
+	var size int
+	switch fam {
+	case famTCP4:
+		size = 4
+	case famTCP6:
+		size = 16
+	case famUnspec, famUDP4, famUDP6, famUnixStream, famUnixDgram:
+		// 不支持的地址族，忽略其中的地址
+		return src, dst, nil
+	default:
+		return src, dst, ErrInvalidHeader
+	}
+	// 地址之后可能还有 TLV，忽略
+	if len(body) < size*2+4 {
+		return src, dst, ErrInvalidHeader
+	}
+	sa, _ := netip.AddrFromSlice(body[:size])
+	da, _ := netip.AddrFromSlice(body[size : size*2])
+	ports := body[size*2:]
+	src = netip.AddrPortFrom(sa, binary.BigEndian.Uint16(ports))
+	dst = netip.AddrPortFrom(da, binary.BigEndian.Uint16(ports[2:]))
+	return src, dst, nil
+}
+
+// Conn 已经读取了 PROXY header 的连接，RemoteAddr 和 LocalAddr 返回 header 中的地址
+type Conn struct {
+	net.Conn
+	r   *bufio.Reader
+	src netip.AddrPort
+	dst netip.AddrPort
+}
+
+// NewConn 读取 conn 上的 PROXY header，调用方需要设置读超时
+func NewConn(conn net.Conn) (*Conn, error) {
+	r := bufio.NewReader(conn)
+	src, dst, err := Read(r)
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, r: r, src: src, dst: dst}, nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite 连接支持半关闭时关闭写方向
+func (c *Conn) CloseWrite() error {
+	return internal.CloseWrite(c.Conn)
+}
+
+// RemoteAddr 返回 header 中的客户端地址，header 中没有地址时返回连接本身的地址
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.src.IsValid() {
+		return net.TCPAddrFromAddrPort(c.src)
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr 返回 header 中客户端连接的地址，header 中没有地址时返回连接本身的地址
+func (c *Conn) LocalAddr() net.Addr {
+	if c.dst.IsValid() {
+		return net.TCPAddrFromAddrPort(c.dst)
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,150 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package proxyproto
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestHeader(t *testing.T) {
+	src4 := netip.MustParseAddrPort("192.168.1.10:56324")
+	dst4 := netip.MustParseAddrPort("10.0.0.1:443")
+	src6 := netip.MustParseAddrPort("[2001:db8::1]:56324")
+
+	bf, err := Header(V1, src4, dst4)
+	xt.NoError(t, err)
+	xt.Equal(t, "PROXY TCP4 192.168.1.10 10.0.0.1 56324 443\r\n", string(bf))
+
+	bf, err = Header(V1, src6, dst4)
+	xt.NoError(t, err)
+	xt.Equal(t, "PROXY TCP6 2001:db8::1 ::ffff:10.0.0.1 56324 443\r\n", string(bf))
+
+	bf, err = Header(V1, netip.AddrPort{}, dst4)
+	xt.NoError(t, err)
+	xt.Equal(t, "PROXY UNKNOWN\r\n", string(bf))
+
+	bf, err = Header(V2, src4, dst4)
+	xt.NoError(t, err)
+	xt.Len(t, bf, 16+12)
+	xt.Equal(t, []byte{0x21, 0x11, 0, 12, 192, 168, 1, 10, 10, 0, 0, 1, 0xdc, 0x04, 0x01, 0xbb}, bf[12:])
+
+	_, err = Header(3, src4, dst4)
+	xt.Error(t, err)
+}
+
+func TestRead(t *testing.T) {
+	read := func(header []byte, payload string) (src, dst netip.AddrPort, err error) {
+		r := bufio.NewReader(strings.NewReader(string(header) + payload))
+		src, dst, err = Read(r)
+		if err == nil {
+			rest, _ := io.ReadAll(r)
+			xt.Equal(t, payload, string(rest))
+		}
+		return src, dst, err
+	}
+	cases := []struct {
+		src, dst string
+	}{
+		{"192.168.1.10:56324", "10.0.0.1:443"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443"},
+	}
+	for _, version := range []int{V1, V2} {
+		for _, tt := range cases {
+			src, dst := netip.MustParseAddrPort(tt.src), netip.MustParseAddrPort(tt.dst)
+			bf, err := Header(version, src, dst)
+			xt.NoError(t, err)
+			gotSrc, gotDst, err := read(bf, "GET / HTTP/1.1\r\n")
+			xt.NoError(t, err)
+			xt.Equal(t, src, gotSrc)
+			xt.Equal(t, dst, gotDst)
+		}
+		bf, err := Header(version, netip.AddrPort{}, netip.AddrPort{})
+		xt.NoError(t, err)
+		src, _, err := read(bf, "hello")
+		xt.NoError(t, err)
+		xt.False(t, src.IsValid())
+	}
+
+	t.Run("v2 tlv", func(t *testing.T) {
+		bf, _ := Header(V2, netip.MustParseAddrPort("1.2.3.4:1"), netip.MustParseAddrPort("5.6.7.8:2"))
+		bf[15] += 4
+		bf = append(bf, 0x04, 0, 1, 'x')
+		src, _, err := read(bf, "hello")
+		xt.NoError(t, err)
+		xt.Equal(t, "1.2.3.4:1", src.String())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := read([]byte("GET / HTTP/1.1\r\n"), "")
+		xt.ErrorIs(t, err, ErrNoHeader)
+		for _, line := range []string{
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1\r\n",
+			"PROXY TCP4 ::1 5.6.7.8 1 2\r\n",
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1 70000\r\n",
+			"PROXY UDP4 1.2.3.4 5.6.7.8 1 2\r\n",
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1 2\n",
+			"PROXY " + strings.Repeat("x", 200),
+		} {
+			_, _, err = read([]byte(line), "")
+			xt.ErrorIs(t, err, ErrInvalidHeader)
+		}
+		bf, _ := Header(V2, netip.MustParseAddrPort("1.2.3.4:1"), netip.MustParseAddrPort("5.6.7.8:2"))
+		bf[15] = 4
+		_, _, err = read(bf[:20], "")
+		xt.ErrorIs(t, err, ErrInvalidHeader)
+
+		// v2 的版本号和地址族
+		for _, b := range []struct {
+			idx int
+			val byte
+		}{
+			{12, 0x11}, // 版本 1
+			{12, 0x31}, // 版本 3
+			{12, 0x22}, // 未知命令
+			{13, 0x13}, // 未知的传输协议
+			{13, 0x41}, // 未知的地址族
+		} {
+			bf, _ = Header(V2, netip.MustParseAddrPort("1.2.3.4:1"), netip.MustParseAddrPort("5.6.7.8:2"))
+			bf[b.idx] = b.val
+			_, _, err = read(bf, "")
+			xt.ErrorIs(t, err, ErrInvalidHeader)
+		}
+	})
+
+	t.Run("v2 ignored family", func(t *testing.T) {
+		for _, fam := range []byte{famUnspec, famUDP4, famUDP6, famUnixStream, famUnixDgram} {
+			bf, _ := Header(V2, netip.MustParseAddrPort("1.2.3.4:1"), netip.MustParseAddrPort("5.6.7.8:2"))
+			bf[13] = fam
+			src, _, err := read(bf, "hello")
+			xt.NoError(t, err)
+			xt.False(t, src.IsValid())
+		}
+	})
+}
+
+func TestNewConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		bf, _ := Header(V1, netip.MustParseAddrPort("1.2.3.4:1000"), netip.MustParseAddrPort("5.6.7.8:80"))
+		_, _ = c1.Write(append(bf, "hello"...))
+	}()
+	conn, err := NewConn(c2)
+	xt.NoError(t, err)
+	xt.Equal(t, "1.2.3.4:1000", conn.RemoteAddr().String())
+	xt.Equal(t, "5.6.7.8:80", conn.LocalAddr().String())
+	bf := make([]byte, 5)
+	_, err = io.ReadFull(conn, bf)
+	xt.NoError(t, err)
+	xt.Equal(t, "hello", string(bf))
+}
@@ -0,0 +1,92 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+// Package ratelimit 令牌桶限流
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶，每秒生成 rate 个令牌，最多积攒 burst 个
+// 一次取走的令牌数可以超过 burst，此时令牌数为负，之后的请求需要等待令牌数恢复
+// nil 的 Limiter 表示不限制
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New 创建令牌桶，初始时是满的，rate 小于等于 0 时返回 nil，即不限制；burst 小于 1 时为 1
+func New(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	b := float64(max(burst, 1))
+	return &Limiter{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// advance 补充从上次到 now 生成的令牌，需要持有锁
+func (l *Limiter) advance(now time.Time) {
+	if now.After(l.last) {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+		l.last = now
+	}
+}
+
+// wait 令牌数为 tokens 时，需要等待多久才能恢复到 0
+func (l *Limiter) wait(tokens float64) time.Duration {
+	if tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tokens / l.rate * float64(time.Second))
+}
+
+// Reserve 取走 n 个令牌，返回需要等待的时间，调用方需要等待后再使用
+func (l *Limiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	l.tokens -= float64(n)
+	return l.wait(l.tokens)
+}
+
+// ReserveWithin 需要等待的时间不超过 maxWait 时，取走 n 个令牌并返回需要等待的时间，否则不取走并返回 false
+func (l *Limiter) ReserveWithin(n int, maxWait time.Duration) (time.Duration, bool) {
+	if l == nil {
+		return 0, true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance(time.Now())
+	d := l.wait(l.tokens - float64(n))
+	if d > maxWait {
+		return 0, false
+	}
+	l.tokens -= float64(n)
+	return d, true
+}
+
+// Sleep 等待 d，ctx 结束时返回其错误
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-tm.C:
+		return nil
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestLimiter(t *testing.T) {
+	t.Run("nil", func(t *testing.T) {
+		l := New(0, 10)
+		xt.Nil(t, l)
+		xt.Equal(t, time.Duration(0), l.Reserve(100))
+		_, ok := l.ReserveWithin(100, 0)
+		xt.True(t, ok)
+	})
+
+	t.Run("reserve", func(t *testing.T) {
+		l := New(1000, 100)
+		xt.Equal(t, time.Duration(0), l.Reserve(100))
+		// 超过 burst 时令牌数为负，需要等待恢复
+		d := l.Reserve(100)
+		xt.True(t, d > 90*time.Millisecond && d <= 100*time.Millisecond)
+		_, ok := l.ReserveWithin(1, 0)
+		xt.False(t, ok)
+	})
+
+	t.Run("within", func(t *testing.T) {
+		l := New(100, 1)
+		_, ok := l.ReserveWithin(1, 0)
+		xt.True(t, ok)
+		_, ok = l.ReserveWithin(1, time.Millisecond)
+		xt.False(t, ok)
+		d, ok := l.ReserveWithin(1, 20*time.Millisecond)
+		xt.True(t, ok)
+		xt.True(t, d > 0 && d <= 10*time.Millisecond)
+	})
+
+	t.Run("refill", func(t *testing.T) {
+		l := New(1000, 10)
+		xt.Equal(t, time.Duration(0), l.Reserve(10))
+		time.Sleep(20 * time.Millisecond)
+		// 最多积攒 burst 个
+		xt.Equal(t, time.Duration(0), l.Reserve(10))
+		xt.True(t, l.Reserve(1) > 0)
+	})
+
+	t.Run("sleep", func(t *testing.T) {
+		l := New(1000, 10)
+		start := time.Now()
+		for range 5 {
+			xt.NoError(t, Sleep(t.Context(), l.Reserve(10)))
+		}
+		xt.True(t, time.Since(start) >= 35*time.Millisecond)
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		xt.ErrorIs(t, Sleep(ctx, l.Reserve(1000)), context.Canceled)
+	})
+}
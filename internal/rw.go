@@ -4,19 +4,190 @@
 
 package internal
 
-import "io"
-
-func RWCopy(in io.ReadWriteCloser, out io.ReadWriteCloser) error {
-	defer in.Close()
-	defer out.Close()
-	ec := make(chan error, 2)
-	go func() {
-		_, err := io.Copy(in, out)
-		ec <- err
-	}()
-	go func() {
-		_, err := io.Copy(out, in)
-		ec <- err
-	}()
-	return <-ec
+import (
+	"cmp"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout RWCopy 时两个方向都超过空闲时间没有数据
+var ErrIdleTimeout = errors.New("idle timeout")
+
+// halfCloseIdle RWCopy 的 idle 为 0 时，一个方向半关闭后另一个方向的空闲超时时间，
+// 避免对端一直不关闭也没有数据时 RWCopy 永远不返回
+var halfCloseIdle = 2 * time.Minute
+
+// CloseWriter 支持半关闭的连接，如 *net.TCPConn
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite 关闭 w 的写方向，w 不支持半关闭时返回 errors.ErrUnsupported
+// w 没有 CloseWrite 方法时，会尝试使用 NetConn 返回的底层连接，如 xnet.DialContext 返回的连接
+func CloseWrite(w any) error {
+	for w != nil {
+		if cw, ok := w.(CloseWriter); ok {
+			return cw.CloseWrite()
+		}
+		u, ok := w.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		w = u.NetConn()
+	}
+	return errors.ErrUnsupported
+}
+
+// CopyResult RWCopy 的结果
+type CopyResult struct {
+	InBytes  int64 // 从 out 读取后写入 in 的字节数
+	OutBytes int64 // 从 in 读取后写入 out 的字节数
+	InErr    error // out -> in 方向的错误
+	OutErr   error // in -> out 方向的错误
+
+	IdleTimeout bool // 是否因为空闲超时而结束
+}
+
+// Err 返回第一个错误，没有错误但空闲超时时返回 ErrIdleTimeout
+func (r *CopyResult) Err() error {
+	if err := cmp.Or(r.InErr, r.OutErr); err != nil {
+		return err
+	}
+	if r.IdleTimeout {
+		return ErrIdleTimeout
+	}
+	return nil
+}
+
+// RWCopy 在 in 和 out 之间双向复制数据，直到两个方向都结束，然后关闭 in 和 out
+// in 和 out 都支持半关闭时，一个方向读取到 EOF 后对另一端调用 CloseWrite，继续复制另一个方向，
+// 否则和一个方向出错时一样，直接关闭两端。
+// idle 大于 0 时，两个方向都超过 idle 没有数据则关闭两端；
+// idle 为 0 时，一个方向半关闭后，另一个方向超过 2 分钟没有数据则关闭两端
+func RWCopy(in io.ReadWriteCloser, out io.ReadWriteCloser, idle time.Duration) *CopyResult {
+	var closing atomic.Bool
+	closeAll := sync.OnceFunc(func() {
+		closing.Store(true)
+		_ = in.Close()
+		_ = out.Close()
+	})
+	defer closeAll()
+
+	result := &CopyResult{}
+	var timeout atomic.Bool
+	w := newIdleWatcher(func() {
+		timeout.Store(true)
+		closeAll()
+	})
+	defer w.stop()
+	if idle > 0 {
+		w.start(idle)
+	}
+	src := [2]io.ReadWriteCloser{&activeRW{ReadWriteCloser: out, w: w}, &activeRW{ReadWriteCloser: in, w: w}}
+	dst := [2]io.ReadWriteCloser{in, out}
+	_, ok1 := in.(CloseWriter)
+	_, ok2 := out.(CloseWriter)
+	halfClose := ok1 && ok2
+	copyTo := func(dst io.ReadWriteCloser, src io.ReadWriteCloser, n *int64, errp *error) {
+		var err error
+		*n, err = Copy(dst, src)
+		if err == nil {
+			if !halfClose {
+				closeAll()
+				return
+			}
+			err = CloseWrite(dst)
+			if errors.Is(err, errors.ErrUnsupported) {
+				closeAll()
+				return
+			}
+			if err == nil && idle <= 0 {
+				w.start(halfCloseIdle)
+			}
+		}
+		if err != nil && !closing.Load() {
+			*errp = err
+			closeAll()
+		}
+	}
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		copyTo(dst[0], src[0], &result.InBytes, &result.InErr)
+	})
+	copyTo(dst[1], src[1], &result.OutBytes, &result.OutErr)
+	wg.Wait()
+	result.IdleTimeout = timeout.Load()
+	return result
+}
+
+// idleWatcher 调用 start 后，超过 idle 没有调用 touch 时执行 fn
+type idleWatcher struct {
+	idle   time.Duration
+	last   atomic.Int64
+	timer  *time.Timer
+	fn     func()
+	mu     sync.Mutex
+	closed bool
+}
+
+func newIdleWatcher(fn func()) *idleWatcher {
+	w := &idleWatcher{fn: fn}
+	w.touch()
+	return w
+}
+
+// start 开始检查，已经开始或者已经停止时不做任何事情
+func (w *idleWatcher) start(idle time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || w.timer != nil {
+		return
+	}
+	w.idle = idle
+	w.timer = time.AfterFunc(idle, w.check)
+}
+
+func (w *idleWatcher) touch() {
+	w.last.Store(time.Now().UnixNano())
+}
+
+func (w *idleWatcher) check() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	if d := time.Duration(w.last.Load() + int64(w.idle) - time.Now().UnixNano()); d > 0 {
+		w.timer.Reset(d)
+		return
+	}
+	w.closed = true
+	go w.fn()
+}
+
+func (w *idleWatcher) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
+
+// activeRW 读取到数据时更新 idleWatcher
+type activeRW struct {
+	io.ReadWriteCloser
+	w *idleWatcher
+}
+
+func (a *activeRW) Read(p []byte) (int, error) {
+	n, err := a.ReadWriteCloser.Read(p)
+	if n > 0 {
+		a.w.touch()
+	}
+	return n, err
 }
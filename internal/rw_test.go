@@ -0,0 +1,151 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// tcpPair 返回一对已连接的 tcp 连接
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	defer l.Close()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	xt.NoError(t, err)
+	c2, err := l.Accept()
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = c2.Close()
+	})
+	return c1.(*net.TCPConn), c2.(*net.TCPConn)
+}
+
+func TestRWCopy(t *testing.T) {
+	t.Run("half close", func(t *testing.T) {
+		client, in := tcpPair(t)
+		out, server := tcpPair(t)
+		done := make(chan *CopyResult, 1)
+		go func() {
+			done <- RWCopy(in, out, 0)
+		}()
+
+		req := []byte("GET / HTTP/1.0\r\n\r\n")
+		_, err := client.Write(req)
+		xt.NoError(t, err)
+		xt.NoError(t, client.CloseWrite())
+
+		// server 读取到 EOF 后才回复
+		got, err := io.ReadAll(server)
+		xt.NoError(t, err)
+		xt.Equal(t, req, got)
+		resp := bytes.Repeat([]byte("a"), 1<<20)
+		_, err = server.Write(resp)
+		xt.NoError(t, err)
+		xt.NoError(t, server.Close())
+
+		got, err = io.ReadAll(client)
+		xt.NoError(t, err)
+		xt.Equal(t, len(resp), len(got))
+
+		res := <-done
+		xt.NoError(t, res.Err())
+		xt.Equal(t, int64(len(resp)), res.InBytes)
+		xt.Equal(t, int64(len(req)), res.OutBytes)
+	})
+
+	t.Run("no half close", func(t *testing.T) {
+		client, in := net.Pipe()
+		out, server := tcpPair(t)
+		done := make(chan *CopyResult, 1)
+		go func() {
+			done <- RWCopy(in, out, 0)
+		}()
+		xt.NoError(t, client.Close())
+		// in 不支持半关闭，一端结束后直接关闭两端
+		_, err := io.ReadAll(server)
+		xt.NoError(t, err)
+		xt.NoError(t, (<-done).Err())
+	})
+
+	t.Run("half close idle", func(t *testing.T) {
+		old := halfCloseIdle
+		halfCloseIdle = 50 * time.Millisecond
+		defer func() {
+			halfCloseIdle = old
+		}()
+		client, in := tcpPair(t)
+		out, server := tcpPair(t)
+		done := make(chan *CopyResult, 1)
+		go func() {
+			done <- RWCopy(in, out, 0)
+		}()
+		xt.NoError(t, client.CloseWrite())
+		_, err := io.ReadAll(server)
+		xt.NoError(t, err)
+		// server 一直不关闭，也不再发送数据
+		for range 3 {
+			time.Sleep(30 * time.Millisecond)
+			_, err = server.Write([]byte("a"))
+			xt.NoError(t, err)
+		}
+		select {
+		case res := <-done:
+			xt.True(t, res.IdleTimeout)
+			xt.Equal(t, int64(3), res.InBytes)
+		case <-time.After(time.Second):
+			t.Fatal("half close idle timeout not work")
+		}
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		client, in := tcpPair(t)
+		out, _ := tcpPair(t)
+		done := make(chan *CopyResult, 1)
+		go func() {
+			done <- RWCopy(in, out, 50*time.Millisecond)
+		}()
+		for range 3 {
+			time.Sleep(30 * time.Millisecond)
+			_, err := client.Write([]byte("a"))
+			xt.NoError(t, err)
+		}
+		select {
+		case res := <-done:
+			xt.True(t, res.IdleTimeout)
+			xt.ErrorIs(t, res.Err(), ErrIdleTimeout)
+			xt.Equal(t, int64(3), res.OutBytes)
+		case <-time.After(time.Second):
+			t.Fatal("idle timeout not work")
+		}
+	})
+}
+
+func TestCloseWrite(t *testing.T) {
+	c1, _ := net.Pipe()
+	xt.True(t, errors.Is(CloseWrite(c1), errors.ErrUnsupported))
+	c2, _ := tcpPair(t)
+	xt.NoError(t, CloseWrite(c2))
+	_, c3 := tcpPair(t)
+	xt.NoError(t, CloseWrite(&wrapConn{Conn: c3}))
+}
+
+// wrapConn 没有 CloseWrite 方法，但可以通过 NetConn 获取底层连接
+type wrapConn struct {
+	net.Conn
+}
+
+func (w *wrapConn) NetConn() net.Conn {
+	return w.Conn
+}
@@ -0,0 +1,192 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/xio/xfs"
+
+	"github.com/fsgo/networks/internal"
+)
+
+// 访问日志的格式
+const (
+	AccessLogJSON     = "json"     // 每行一个 JSON 对象
+	AccessLogCombined = "combined" // 类似 nginx 的 combined 格式，以空格分隔
+)
+
+// 访问日志中连接结束的原因
+const (
+	reasonEOF      = "eof"          // 正常结束
+	reasonError    = "error"        // 读写出错
+	reasonIdle     = "idle_timeout" // 空闲超时
+	reasonShutdown = "shutdown"     // server 停止时被关闭
+	reasonNoClient = "no_client"    // 没有可用的 tunnel client
+	reasonRejected = "rejected"     // client 连接本地服务失败
+)
+
+// accessRecord 一条访问日志，对应一个外部的 tcp 连接
+type accessRecord struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Tunnel    string    `json:"tunnel,omitempty"` // Server 的名称
+	Peer      string    `json:"peer"`             // 外部用户的地址
+	Service   string    `json:"service"`          // 服务名称
+	ClientID  string    `json:"client_id"`        // tunnel client 的标识
+	Client    int64     `json:"client"`           // tunnel client 连接的 id
+	SID       uint32    `json:"sid"`              // stream 的 id
+	BytesUp   int64     `json:"bytes_up"`         // 从外部用户读取的字节数
+	BytesDown int64     `json:"bytes_down"`
+	Reason    string    `json:"reason"`
+	Err       string    `json:"err,omitempty"`
+}
+
+func checkAccessLogFormat(format string) error {
+	switch format {
+	case "", AccessLogJSON, AccessLogCombined:
+		return nil
+	default:
+		return fmt.Errorf("unsupported access log format %q", format)
+	}
+}
+
+// accessLogger 将访问日志写入按时间切割的文件，为 nil 时不记录
+type accessLogger struct {
+	w      io.WriteCloser
+	format string
+
+	mu     sync.Mutex
+	buf    []byte
+	closed bool
+}
+
+// newAccessLogger path 为空时返回 nil
+func newAccessLogger(path string, format string, rotate string, maxFiles int) (*accessLogger, error) {
+	if path == "" {
+		return nil, nil
+	}
+	if rotate == "" {
+		rotate = "1hour"
+	}
+	w := &xfs.Rotator{
+		Path:     path,
+		ExtRule:  rotate,
+		MaxFiles: maxFiles,
+	}
+	if err := w.Init(); err != nil {
+		return nil, fmt.Errorf("init access log: %w", err)
+	}
+	return &accessLogger{w: w, format: format}, nil
+}
+
+func (l *accessLogger) log(r *accessRecord) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if l.format == AccessLogCombined {
+		l.buf = r.appendCombined(l.buf[:0])
+	} else {
+		bf, err := json.Marshal(r)
+		if err != nil {
+			return
+		}
+		l.buf = append(bf, '\n')
+	}
+	_, _ = l.w.Write(l.buf)
+}
+
+func (l *accessLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.w.Close()
+}
+
+// appendCombined 格式如：
+//
+//	1.2.3.4:5678 main client-1 [18/Oct/2026:10:00:00 +0800] "web 3" eof 120 4096 1.250 #2 "-"
+//
+// 依次为外部用户地址、Server 名称、client 标识、开始时间、服务名称和 stream id、结束原因、上行和下行字节数、耗时（秒）、
+// client 连接的 id 以及错误信息
+func (r *accessRecord) appendCombined(bf []byte) []byte {
+	bf = append(bf, r.Peer...)
+	bf = append(bf, ' ')
+	bf = appendField(bf, r.Tunnel)
+	bf = append(bf, ' ')
+	bf = appendField(bf, r.ClientID)
+	bf = append(bf, " ["...)
+	bf = r.Start.AppendFormat(bf, "02/Jan/2006:15:04:05 -0700")
+	bf = append(bf, "] "...)
+	bf = strconv.AppendQuote(bf, r.Service+" "+strconv.FormatUint(uint64(r.SID), 10))
+	bf = append(bf, ' ')
+	bf = append(bf, r.Reason...)
+	bf = append(bf, ' ')
+	bf = strconv.AppendInt(bf, r.BytesUp, 10)
+	bf = append(bf, ' ')
+	bf = strconv.AppendInt(bf, r.BytesDown, 10)
+	bf = append(bf, ' ')
+	bf = strconv.AppendFloat(bf, r.End.Sub(r.Start).Seconds(), 'f', 3, 64)
+	bf = append(bf, " #"...)
+	bf = strconv.AppendInt(bf, r.Client, 10)
+	bf = append(bf, ' ')
+	if r.Err == "" {
+		bf = append(bf, `"-"`...)
+	} else {
+		bf = strconv.AppendQuote(bf, r.Err)
+	}
+	return append(bf, '\n')
+}
+
+// appendField 空值使用 - 代替，包含空格、引号或者不可打印的字符时加上引号，
+// 避免 ClientID 等由 client 提供的值破坏日志的格式
+func appendField(bf []byte, s string) []byte {
+	if s == "" {
+		return append(bf, '-')
+	}
+	for _, c := range s {
+		if c == ' ' || c == '"' || c == '\\' || !strconv.IsPrint(c) {
+			return strconv.AppendQuote(bf, s)
+		}
+	}
+	return append(bf, s...)
+}
+
+// closeReason 返回 stream 结束的原因
+func closeReason(res *internal.CopyResult, closing bool) string {
+	switch {
+	case res.IdleTimeout:
+		return reasonIdle
+	case res.Err() == nil:
+		return reasonEOF
+	case closing:
+		return reasonShutdown
+	default:
+		return reasonError
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,100 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+
+	"github.com/fsgo/networks/internal"
+)
+
+func Test_accessRecord_appendCombined(t *testing.T) {
+	start := time.Date(2026, 10, 18, 10, 0, 0, 0, time.FixedZone("", 8*3600))
+	r := &accessRecord{
+		Start:     start,
+		End:       start.Add(1250 * time.Millisecond),
+		Peer:      "1.2.3.4:5678",
+		Service:   "web",
+		Client:    2,
+		SID:       3,
+		BytesUp:   120,
+		BytesDown: 4096,
+		Reason:    reasonEOF,
+	}
+	want := `1.2.3.4:5678 - - [18/Oct/2026:10:00:00 +0800] "web 3" eof 120 4096 1.250 #2 "-"` + "\n"
+	xt.Equal(t, want, string(r.appendCombined(nil)))
+
+	r.Tunnel, r.ClientID, r.Reason, r.Err = "main", "client-1", reasonError, `read "x" failed`
+	want = `1.2.3.4:5678 main client-1 [18/Oct/2026:10:00:00 +0800] "web 3" error 120 4096 1.250 #2 "read \"x\" failed"` + "\n"
+	xt.Equal(t, want, string(r.appendCombined(nil)))
+
+	// client 提供的 ClientID 不能破坏日志的格式
+	r.ClientID = "c1 [x]\n"
+	want = `1.2.3.4:5678 main "c1 [x]\n" [18/Oct/2026:10:00:00 +0800] "web 3" error 120 4096 1.250 #2 "read \"x\" failed"` + "\n"
+	xt.Equal(t, want, string(r.appendCombined(nil)))
+}
+
+func Test_accessLogger_Close(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "access.log")
+	al, err := newAccessLogger(fp, AccessLogJSON, "no", 0)
+	xt.NoError(t, err)
+	al.log(&accessRecord{Service: "a"})
+	xt.NoError(t, al.Close())
+	xt.NoError(t, al.Close())
+	// 关闭后的日志直接丢弃
+	al.log(&accessRecord{Service: "b"})
+	content, err := os.ReadFile(fp)
+	xt.NoError(t, err)
+	xt.Equal(t, 1, bytes.Count(content, []byte("\n")))
+}
+
+func Test_closeReason(t *testing.T) {
+	xt.Equal(t, reasonEOF, closeReason(&internal.CopyResult{}, false))
+	xt.Equal(t, reasonIdle, closeReason(&internal.CopyResult{IdleTimeout: true}, false))
+	xt.Equal(t, reasonError, closeReason(&internal.CopyResult{InErr: errors.New("x")}, false))
+	xt.Equal(t, reasonShutdown, closeReason(&internal.CopyResult{OutErr: errors.New("x")}, true))
+}
+
+func TestServerAccessLog(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "access.log")
+	s := &Server{Name: "main", AccessLog: fp, AccessLogRotate: "no"}
+	c := &Client{ClientID: "c1"}
+	serr, _ := startTestTunnel(t, s, c)
+	// server 退出后才会关闭日志文件，需要在删除临时目录之前等待 server 退出
+	t.Cleanup(func() {
+		<-serr
+	})
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+
+	xt.NoError(t, echoOnce(s.ListenOut, "hello"))
+	var rec accessRecord
+	waitFor(t, func() bool {
+		content, err := os.ReadFile(fp)
+		if err != nil || !bytes.HasSuffix(content, []byte("\n")) {
+			return false
+		}
+		return json.Unmarshal(content, &rec) == nil
+	})
+	xt.Equal(t, "main", rec.Tunnel)
+	xt.Equal(t, defaultService, rec.Service)
+	xt.Equal(t, "c1", rec.ClientID)
+	xt.Equal(t, reasonEOF, rec.Reason)
+	xt.Equal(t, int64(5), rec.BytesUp)
+	xt.Equal(t, int64(5), rec.BytesDown)
+	xt.True(t, rec.SID > 0)
+	xt.NotEmpty(t, rec.Peer)
+	xt.False(t, rec.End.Before(rec.Start))
+	waitStreamsDone(t, c)
+}
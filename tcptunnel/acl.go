@@ -0,0 +1,160 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// 监听地址的类型，用于 ACL 的指标和日志
+const (
+	listenerOut    = "out"    // ListenOut、Services 和为 client 监听的端口
+	listenerClient = "client" // ListenClient
+)
+
+var (
+	errACLDenied     = errors.New("ip is denied")
+	errACLNotAllowed = errors.New("ip is not allowed")
+)
+
+// ipACL 按照来源 IP 允许或者拒绝连接：先匹配 deny，allow 不为空时只允许其中的 IP
+type ipACL struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+func newIPACL(allow string, deny string) (*ipACL, error) {
+	a := &ipACL{}
+	var err error
+	if a.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// parsePrefixes 解析多个 CIDR 或者 IP，格式如 10.0.0.0/8,192.168.1.10,2001:db8::/32
+func parsePrefixes(str string) ([]netip.Prefix, error) {
+	var result []netip.Prefix
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			p, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", item)
+			}
+			result = append(result, p.Masked())
+			continue
+		}
+		ip, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q", item)
+		}
+		ip = ip.Unmap()
+		result = append(result, netip.PrefixFrom(ip, ip.BitLen()))
+	}
+	return result, nil
+}
+
+func matchPrefixes(ps []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range ps {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// check 检查来源地址是否被允许，a 为 nil 时都允许
+func (a *ipACL) check(addr net.Addr) error {
+	if a == nil || (len(a.allow) == 0 && len(a.deny) == 0) {
+		return nil
+	}
+	ip, err := addrIP(addr)
+	if err != nil {
+		return err
+	}
+	if matchPrefixes(a.deny, ip) {
+		return errACLDenied
+	}
+	if len(a.allow) > 0 && !matchPrefixes(a.allow, ip) {
+		return errACLNotAllowed
+	}
+	return nil
+}
+
+func addrIP(addr net.Addr) (netip.Addr, error) {
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.AddrPort().Addr().Unmap(), nil
+	case *net.UDPAddr:
+		return v.AddrPort().Addr().Unmap(), nil
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid remote addr %q", addr.String())
+	}
+	return ap.Addr().Unmap(), nil
+}
+
+// serverACL Server 各类监听地址的 ACL，热更新时整体替换
+type serverACL struct {
+	out    *ipACL
+	client *ipACL
+}
+
+func (s *Server) newACL() (*serverACL, error) {
+	out, err := newIPACL(s.OutAllow, s.OutDeny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OutAllow or OutDeny: %w", err)
+	}
+	client, err := newIPACL(s.ClientAllow, s.ClientDeny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ClientAllow or ClientDeny: %w", err)
+	}
+	return &serverACL{out: out, client: client}, nil
+}
+
+// allowed 检查 listener 上的连接的来源地址是否被允许，不允许时记录指标和日志
+func (s *Server) allowed(listener string, addr net.Addr) bool {
+	acl := s.acl.Load()
+	if acl == nil {
+		return true
+	}
+	rule := acl.out
+	if listener == listenerClient {
+		rule = acl.client
+	}
+	err := rule.check(addr)
+	if err == nil {
+		return true
+	}
+	s.getMetrics().aclRejects.With(listener).Inc()
+	s.aclLog.log(s.logger(), "connection rejected by acl", "listener", listener, logKeyRemote, addr.String(), errAttr(err))
+	return false
+}
+
+// hotUpdate 热更新时，只有 ACL 变化的 server 不需要重启，直接使用新的 ACL
+func (s *Server) hotUpdate(next Runner) error {
+	ns, ok := next.(*Server)
+	if !ok {
+		return fmt.Errorf("expect *Server, got %T", next)
+	}
+	acl, err := ns.newACL()
+	if err != nil {
+		return err
+	}
+	s.acl.Store(acl)
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func Test_ipACL(t *testing.T) {
+	addr := func(s string) net.Addr {
+		return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+	}
+	var nilACL *ipACL
+	xt.NoError(t, nilACL.check(addr("1.2.3.4:1")))
+
+	a, err := newIPACL("10.0.0.0/8, 192.168.1.10,2001:db8::/32", "10.1.0.0/16")
+	xt.NoError(t, err)
+	xt.NoError(t, a.check(addr("10.2.3.4:1")))
+	xt.NoError(t, a.check(addr("192.168.1.10:1")))
+	xt.NoError(t, a.check(addr("[::ffff:10.2.3.4]:1")))
+	xt.NoError(t, a.check(addr("[2001:db8::1]:1")))
+	xt.ErrorIs(t, a.check(addr("10.1.2.3:1")), errACLDenied)
+	xt.ErrorIs(t, a.check(addr("192.168.1.11:1")), errACLNotAllowed)
+
+	a, err = newIPACL("", "192.168.0.0/16")
+	xt.NoError(t, err)
+	xt.NoError(t, a.check(addr("10.2.3.4:1")))
+	xt.ErrorIs(t, a.check(addr("192.168.1.1:1")), errACLDenied)
+
+	for _, str := range []string{"10.0.0.0/33", "10.0.0", "host"} {
+		_, err = newIPACL(str, "")
+		xt.Error(t, err)
+	}
+}
+
+func TestServerACL(t *testing.T) {
+	readEOF := func(t *testing.T, addr string) {
+		conn, err := net.Dial("tcp", addr)
+		xt.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		xt.Error(t, err)
+	}
+	t.Run("out", func(t *testing.T) {
+		bf := &syncBuffer{}
+		s := &Server{OutDeny: "127.0.0.0/8", Logger: slog.New(slog.NewTextHandler(bf, nil))}
+		startTestTunnel(t, s, &Client{})
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		readEOF(t, s.ListenOut)
+		readEOF(t, s.ListenOut)
+		xt.Equal(t, uint64(2), s.getMetrics().aclRejects.With(listenerOut).Load())
+		// 频率受限，只有第一次以 Warn 级别输出
+		xt.Equal(t, 1, strings.Count(bf.String(), "connection rejected by acl"))
+
+		xt.NoError(t, s.hotUpdate(&Server{OutAllow: "127.0.0.1"}))
+		xt.NoError(t, echoOnce(s.ListenOut, "hello"))
+	})
+	t.Run("client", func(t *testing.T) {
+		s := &Server{ClientAllow: "10.0.0.0/8"}
+		startTestTunnel(t, s, &Client{})
+		waitFor(t, func() bool {
+			return s.getMetrics().aclRejects.With(listenerClient).Load() > 0
+		})
+		xt.Equal(t, 0, s.clients.len())
+	})
+}
+
+func Test_logLimiter(t *testing.T) {
+	bf := &syncBuffer{}
+	logger := slog.New(slog.NewTextHandler(bf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	l := &logLimiter{every: 50 * time.Millisecond}
+	for range 3 {
+		l.log(logger, "rejected")
+	}
+	xt.Equal(t, 1, strings.Count(bf.String(), "level=WARN"))
+	xt.Equal(t, 2, strings.Count(bf.String(), "level=DEBUG"))
+	time.Sleep(60 * time.Millisecond)
+	l.log(logger, "rejected")
+	xt.Equal(t, 2, strings.Count(bf.String(), "level=WARN"))
+	xt.True(t, strings.Contains(bf.String(), "suppressed=2"))
+}
+
+func TestConfigGroupReloadACL(t *testing.T) {
+	in, out, local := freeAddr(t), freeAddr(t), startEchoServer(t)
+	fp := filepath.Join(t.TempDir(), "tunnels.json")
+	writeConfig := func(deny string) {
+		content := fmt.Sprintf(`{"servers": [{"name": "a", "in": %q, "out": %q, "out-deny": %q}], "clients": [{"name": "a", "remote": %q, "local": %q}]}`,
+			in, out, deny, in, local)
+		xt.NoError(t, os.WriteFile(fp, []byte(content), 0600))
+	}
+	writeConfig("")
+	g := &ConfigGroup{
+		Load: func() (*Config, error) {
+			return LoadConfig(fp)
+		},
+		Servers: true,
+		Clients: true,
+	}
+	go func() {
+		_ = g.Start(t.Context())
+	}()
+	server := func() *Server {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if item := g.items["server/a"]; item != nil {
+			return item.runner.(*Server)
+		}
+		return nil
+	}
+	waitFor(t, func() bool {
+		s := server()
+		return s != nil && s.clients.len() == 1
+	})
+	s := server()
+	xt.NoError(t, echoOnce(out, "hello"))
+
+	writeConfig("127.0.0.1")
+	result, err := g.Reload()
+	xt.NoError(t, err)
+	xt.Equal(t, []string{"server/a"}, result.Updated)
+	xt.Equal(t, []string{"client/a"}, result.Unchanged)
+	xt.Len(t, result.Changed, 0)
+	// 没有重启，client 的连接不受影响
+	xt.True(t, s == server())
+	xt.Equal(t, 1, s.clients.len())
+	xt.Error(t, echoOnce(out, "hello"))
+	xt.Equal(t, uint64(1), s.getMetrics().aclRejects.With(listenerOut).Load())
+}
@@ -0,0 +1,195 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+)
+
+// adminClient 管理接口中的 tunnel client 连接
+type adminClient struct {
+	ID       int64     `json:"id"`
+	ClientID string    `json:"client_id,omitempty"`
+	Remote   string    `json:"remote"`
+	Since    time.Time `json:"since"`
+	Services []string  `json:"services"`
+	Streams  int64     `json:"streams"`
+	BytesIn  int64     `json:"bytes_in"`  // 从对端连接读取的字节数
+	BytesOut int64     `json:"bytes_out"` // 写入到对端连接的字节数
+}
+
+// adminStream 管理接口中的 stream
+type adminStream struct {
+	Client   int64     `json:"client"` // 所属的 tunnel client 连接的 id
+	ID       uint32    `json:"id"`
+	Service  string    `json:"service,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Network  string    `json:"network"`
+	Peer     string    `json:"peer,omitempty"`
+	Since    time.Time `json:"since"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+// AdminHandler 管理接口的 http.Handler，需要在 Header 中携带 Authorization: Bearer {AdminToken}
+//
+//	GET    /clients               所有的 tunnel client 连接
+//	DELETE /clients/{id}          断开指定的 tunnel client 连接
+//	GET    /streams               所有活跃的 stream
+//	DELETE /streams/{client}/{id} 关闭指定的 stream
+//	POST   /reload                热更新配置，需要配置 OnReload
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /clients", s.adminClients)
+	mux.HandleFunc("DELETE /clients/{id}", s.adminKillClient)
+	mux.HandleFunc("GET /streams", s.adminStreams)
+	mux.HandleFunc("DELETE /streams/{client}/{id}", s.adminKillStream)
+	mux.HandleFunc("POST /reload", s.adminReload)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.checkAdminToken(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) checkAdminToken(r *http.Request) bool {
+	if s.AdminToken == "" {
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1
+}
+
+func (s *Server) adminClients(w http.ResponseWriter, _ *http.Request) {
+	items := s.clients.all()
+	result := make([]*adminClient, 0, len(items))
+	for _, cm := range items {
+		read, written := cm.totalBytes()
+		result = append(result, &adminClient{
+			ID:       cm.id,
+			ClientID: cm.clientID,
+			Remote:   cm.remote,
+			Since:    cm.createAt,
+			Services: cm.services,
+			Streams:  cm.streams.Load(),
+			BytesIn:  read,
+			BytesOut: written,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) adminStreams(w http.ResponseWriter, _ *http.Request) {
+	result := make([]*adminStream, 0)
+	for _, cm := range s.clients.all() {
+		cm.mux.Range(func(stream *xio.MuxStream) bool {
+			item := &adminStream{
+				Client:  cm.id,
+				ID:      stream.ID(),
+				Network: networkTCP,
+				Since:   stream.CreateAt(),
+			}
+			// stream 刚创建或者即将结束时，可能没有对应的信息
+			if info := cm.streamInfo(stream.ID()); info != nil {
+				item.Service = info.meta.Service
+				item.Target = info.meta.Target
+				item.Network = info.meta.network()
+				item.Peer = info.peer
+				item.Since = info.since
+				item.BytesIn = info.bytes.read.Load()
+				item.BytesOut = info.bytes.written.Load()
+			}
+			result = append(result, item)
+			return true
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Client != result[j].Client {
+			return result[i].Client < result[j].Client
+		}
+		return result[i].ID < result[j].ID
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) adminKillClient(w http.ResponseWriter, r *http.Request) {
+	cm := s.adminGetClient(w, r.PathValue("id"))
+	if cm == nil {
+		return
+	}
+	_ = cm.mux.Close()
+	writeJSON(w, http.StatusOK, map[string]int64{"closed": cm.id})
+}
+
+func (s *Server) adminKillStream(w http.ResponseWriter, r *http.Request) {
+	cm := s.adminGetClient(w, r.PathValue("client"))
+	if cm == nil {
+		return
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 32)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid stream id"})
+		return
+	}
+	var found *xio.MuxStream
+	cm.mux.Range(func(stream *xio.MuxStream) bool {
+		if stream.ID() == uint32(id) {
+			found = stream
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "stream not found"})
+		return
+	}
+	_ = found.Close()
+	writeJSON(w, http.StatusOK, map[string]uint32{"closed": found.ID()})
+}
+
+func (s *Server) adminReload(w http.ResponseWriter, _ *http.Request) {
+	if s.OnReload == nil {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "reload is not supported"})
+		return
+	}
+	result, err := s.OnReload()
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) adminGetClient(w http.ResponseWriter, idStr string) *clientMux {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid client id"})
+		return nil
+	}
+	cm := s.clients.get(id)
+	if cm == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "client not found"})
+	}
+	return cm
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,92 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func adminDo(t *testing.T, s *Server, method string, path string, token string, result any) int {
+	t.Helper()
+	req, err := http.NewRequest(method, "http://"+s.AdminAddr+path, nil)
+	xt.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	xt.NoError(t, err)
+	defer resp.Body.Close()
+	if result != nil && resp.StatusCode == http.StatusOK {
+		xt.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return resp.StatusCode
+}
+
+func TestServerAdmin(t *testing.T) {
+	s := &Server{AdminAddr: freeAddr(t), AdminToken: "admin-secret"}
+	c := &Client{}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	waitFor(t, func() bool {
+		return adminDo(t, s, http.MethodGet, "/clients", "", nil) == http.StatusUnauthorized
+	})
+	xt.Equal(t, http.StatusUnauthorized, adminDo(t, s, http.MethodGet, "/clients", "bad", nil))
+
+	conn := dialEcho(t, s.ListenOut)
+	defer conn.Close()
+
+	var clients []*adminClient
+	xt.Equal(t, http.StatusOK, adminDo(t, s, http.MethodGet, "/clients", s.AdminToken, &clients))
+	xt.Len(t, clients, 1)
+	xt.Equal(t, c.ClientID, clients[0].ClientID)
+	xt.Equal(t, int64(1), clients[0].Streams)
+	xt.Equal(t, int64(5), clients[0].BytesIn)
+	xt.Equal(t, int64(5), clients[0].BytesOut)
+
+	var streams []*adminStream
+	xt.Equal(t, http.StatusOK, adminDo(t, s, http.MethodGet, "/streams", s.AdminToken, &streams))
+	xt.Len(t, streams, 1)
+	xt.Equal(t, clients[0].ID, streams[0].Client)
+	xt.Equal(t, defaultService, streams[0].Service)
+	xt.Equal(t, networkTCP, streams[0].Network)
+	xt.Equal(t, conn.LocalAddr().String(), streams[0].Peer)
+
+	t.Run("kill stream", func(t *testing.T) {
+		xt.Equal(t, http.StatusNotFound, adminDo(t, s, http.MethodDelete, fmt.Sprintf("/streams/%d/100000", clients[0].ID), s.AdminToken, nil))
+		path := fmt.Sprintf("/streams/%d/%d", clients[0].ID, streams[0].ID)
+		xt.Equal(t, http.StatusOK, adminDo(t, s, http.MethodDelete, path, s.AdminToken, nil))
+		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		xt.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("kill client", func(t *testing.T) {
+		xt.Equal(t, http.StatusBadRequest, adminDo(t, s, http.MethodDelete, "/clients/abc", s.AdminToken, nil))
+		path := fmt.Sprintf("/clients/%d", clients[0].ID)
+		xt.Equal(t, http.StatusOK, adminDo(t, s, http.MethodDelete, path, s.AdminToken, nil))
+		waitFor(t, func() bool {
+			return s.clients.get(clients[0].ID) == nil
+		})
+		xt.Equal(t, http.StatusNotFound, adminDo(t, s, http.MethodDelete, path, s.AdminToken, nil))
+		// client 会重新连接
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+	})
+}
+
+func TestServerAdminToken(t *testing.T) {
+	s := &Server{ListenOut: freeAddr(t), ListenClient: freeAddr(t), AdminAddr: freeAddr(t)}
+	xt.Error(t, s.Start(t.Context()))
+}
@@ -0,0 +1,225 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/fsgo/networks/internal"
+)
+
+// 加密算法，握手时会互相校验，双方配置的必须一致
+const (
+	cipherAESCTR           byte = 1 // aes-ctr，默认，只加密不校验
+	cipherAESGCM           byte = 2 // aes-gcm
+	cipherChaCha20Poly1305 byte = 3 // chacha20-poly1305
+)
+
+var cipherNames = map[byte]string{
+	cipherAESCTR:           "aes-ctr",
+	cipherAESGCM:           "aes-gcm",
+	cipherChaCha20Poly1305: "chacha20-poly1305",
+}
+
+const cipherUsage = "cipher: aes-ctr, aes-gcm, chacha20-poly1305"
+
+func cipherName(id byte) string {
+	if name, ok := cipherNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+// parseCipher 解析加密算法名称，为空时使用 aes-ctr
+func parseCipher(name string) (byte, error) {
+	if name == "" {
+		return cipherAESCTR, nil
+	}
+	for id, n := range cipherNames {
+		if n == name {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported cipher %q", name)
+}
+
+const (
+	// maxRecordPayload 单个 record 的最大明文长度
+	maxRecordPayload = 16 * 1024
+
+	// recordHeaderSize record 头部长度：4 字节密文长度（大端序）
+	recordHeaderSize = 4
+)
+
+var errRecordAuth = errors.New("aead record authentication failed")
+
+func newAEAD(id byte, key []byte) (cipher.AEAD, error) {
+	switch id {
+	case cipherAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case cipherChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	default:
+		return nil, fmt.Errorf("cipher %s is not aead", cipherName(id))
+	}
+}
+
+// aeadSealer 一个方向的 AEAD 状态，nonce 由 IV 和递增的序号异或得到，
+// 序号不会在网络上传输，所以重放、丢弃、乱序的 record 都会校验失败
+type aeadSealer struct {
+	aead  cipher.AEAD
+	iv    []byte
+	seq   uint64
+	nonce []byte
+}
+
+func newAEADSealer(id byte, sk *streamKey) *aeadSealer {
+	a, err := newAEAD(id, sk.Key)
+	if err != nil {
+		panic(err)
+	}
+	return &aeadSealer{
+		aead:  a,
+		iv:    sk.IV[:a.NonceSize()],
+		nonce: make([]byte, a.NonceSize()),
+	}
+}
+
+func (s *aeadSealer) nextNonce() []byte {
+	copy(s.nonce, s.iv)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], s.seq)
+	s.seq++
+	off := len(s.nonce) - len(seq)
+	for i, b := range seq {
+		s.nonce[off+i] ^= b
+	}
+	return s.nonce
+}
+
+var _ io.ReadWriteCloser = (*aeadConn)(nil)
+
+// aeadConn 将数据切分为 record 并使用 AEAD 加密
+// record 格式：4 字节密文长度（大端序）| 密文（包含 tag）
+// 任意一个 record 校验失败，都会立即关闭底层连接
+type aeadConn struct {
+	rw  io.ReadWriteCloser
+	msg string
+
+	wmu    sync.Mutex
+	sealer *aeadSealer
+	wbuf   []byte
+
+	opener  *aeadSealer
+	header  [recordHeaderSize]byte
+	rbuf    []byte
+	pending []byte
+	rerr    error
+}
+
+func newAEADConn(rw io.ReadWriteCloser, id byte, wk *streamKey, rk *streamKey) *aeadConn {
+	return &aeadConn{
+		rw:     rw,
+		msg:    rwInfo(rw),
+		sealer: newAEADSealer(id, wk),
+		opener: newAEADSealer(id, rk),
+	}
+}
+
+func (a *aeadConn) Read(p []byte) (int, error) {
+	if len(a.pending) == 0 {
+		if a.rerr != nil {
+			return 0, a.rerr
+		}
+		if err := a.readRecord(); err != nil {
+			a.rerr = err
+			return 0, err
+		}
+	}
+	n := copy(p, a.pending)
+	a.pending = a.pending[n:]
+	return n, nil
+}
+
+func (a *aeadConn) readRecord() error {
+	if _, err := io.ReadFull(a.rw, a.header[:]); err != nil {
+		return err
+	}
+	size := int(binary.BigEndian.Uint32(a.header[:]))
+	overhead := a.opener.aead.Overhead()
+	if size < overhead || size > maxRecordPayload+overhead {
+		_ = a.rw.Close()
+		return fmt.Errorf("%w: invalid record size %d", errRecordAuth, size)
+	}
+	if cap(a.rbuf) < size {
+		a.rbuf = make([]byte, size)
+	}
+	bf := a.rbuf[:size]
+	if _, err := io.ReadFull(a.rw, bf); err != nil {
+		return err
+	}
+	plain, err := a.opener.aead.Open(bf[:0], a.opener.nextNonce(), bf, a.header[:])
+	if err != nil {
+		_ = a.rw.Close()
+		return fmt.Errorf("%w: %w", errRecordAuth, err)
+	}
+	a.pending = plain
+	return nil
+}
+
+func (a *aeadConn) Write(p []byte) (int, error) {
+	a.wmu.Lock()
+	defer a.wmu.Unlock()
+	var n int
+	overhead := a.sealer.aead.Overhead()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxRecordPayload {
+			chunk = chunk[:maxRecordPayload]
+		}
+		size := recordHeaderSize + len(chunk) + overhead
+		if cap(a.wbuf) < size {
+			a.wbuf = make([]byte, size)
+		}
+		bf := a.wbuf[:recordHeaderSize]
+		binary.BigEndian.PutUint32(bf, uint32(len(chunk)+overhead))
+		bf = a.sealer.aead.Seal(bf, a.sealer.nextNonce(), chunk, bf)
+		if _, err := a.rw.Write(bf); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+func (a *aeadConn) Close() error {
+	return a.rw.Close()
+}
+
+func (a *aeadConn) String() string {
+	return a.msg
+}
+
+func (a *aeadConn) isBadConn() error {
+	conn, ok := a.rw.(net.Conn)
+	if !ok {
+		return nil
+	}
+	return internal.ConnCheck(conn)
+}
@@ -0,0 +1,104 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func testAEADPair(id byte, b *tb) (w io.ReadWriteCloser, r io.ReadWriteCloser) {
+	var cn, sn [nonceSize]byte
+	keys := deriveKeys("hello-world", cn, sn)
+	w = rwWithKeys(b, id, keys.c2s, keys.s2c)
+	r = rwWithKeys(b, id, keys.s2c, keys.c2s)
+	return w, r
+}
+
+func Test_aeadConn(t *testing.T) {
+	for _, id := range []byte{cipherAESGCM, cipherChaCha20Poly1305} {
+		t.Run(cipherName(id), func(t *testing.T) {
+			t.Run("read write", func(t *testing.T) {
+				b := &tb{bf: &bytes.Buffer{}}
+				w, r := testAEADPair(id, b)
+				data := bytes.Repeat([]byte("hello"), maxRecordPayload)
+				n, err := w.Write(data)
+				xt.NoError(t, err)
+				xt.Equal(t, len(data), n)
+				xt.NotContains(t, b.bf.String(), "hellohello")
+
+				got, err := io.ReadAll(r)
+				xt.NoError(t, err)
+				xt.Equal(t, string(data), string(got))
+			})
+
+			t.Run("tamper", func(t *testing.T) {
+				b := &tb{bf: &bytes.Buffer{}}
+				w, r := testAEADPair(id, b)
+				_, err := w.Write([]byte("hello world"))
+				xt.NoError(t, err)
+				b.bf.Bytes()[recordHeaderSize+1] ^= 0x01
+
+				_, err = io.ReadAll(r)
+				xt.ErrorIs(t, err, errRecordAuth)
+				xt.True(t, b.closed)
+			})
+
+			t.Run("replay", func(t *testing.T) {
+				b := &tb{bf: &bytes.Buffer{}}
+				w, r := testAEADPair(id, b)
+				_, err := w.Write([]byte("hello world"))
+				xt.NoError(t, err)
+				record := bytes.Clone(b.bf.Bytes())
+				b.bf.Write(record)
+
+				bf := make([]byte, 11)
+				_, err = io.ReadFull(r, bf)
+				xt.NoError(t, err)
+				xt.Equal(t, "hello world", string(bf))
+				_, err = r.Read(bf)
+				xt.ErrorIs(t, err, errRecordAuth)
+			})
+
+			t.Run("wrong cipher", func(t *testing.T) {
+				b := &tb{bf: &bytes.Buffer{}}
+				w, _ := testAEADPair(id, b)
+				other := cipherAESGCM
+				if id == cipherAESGCM {
+					other = cipherChaCha20Poly1305
+				}
+				_, r := testAEADPair(other, b)
+				_, err := w.Write([]byte("hello world"))
+				xt.NoError(t, err)
+				_, err = io.ReadAll(r)
+				xt.ErrorIs(t, err, errRecordAuth)
+			})
+		})
+	}
+}
+
+func Fuzz_aeadConnRead(f *testing.F) {
+	plain := []byte("hello world")
+	b := &tb{bf: &bytes.Buffer{}}
+	w, _ := testAEADPair(cipherChaCha20Poly1305, b)
+	_, _ = w.Write(plain)
+	_, _ = w.Write(plain)
+	f.Add(bytes.Clone(b.bf.Bytes()))
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, r := testAEADPair(cipherChaCha20Poly1305, &tb{bf: bytes.NewBuffer(data)})
+		got, _ := io.ReadAll(r)
+		// 伪造的数据不可能通过校验，能读出的只会是真实数据的前缀
+		want := bytes.Repeat(plain, 2)
+		if !bytes.HasPrefix(want, got) {
+			t.Fatalf("got unexpected plaintext %q", got)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBackoffInitial    = 200 * time.Millisecond
+	defaultBackoffMax        = 30 * time.Second
+	defaultBackoffMultiplier = 2
+
+	// breakerFailures 本地服务连续失败此次数后熔断，等待期间新的 stream 直接失败
+	breakerFailures = 3
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+// Backoff 连接失败后重试的退避策略
+//
+//	第 n 次连续失败后，等待 [0, min(Max, Initial*Multiplier^(n-1))] 之间的随机时间（full jitter），
+//	避免大量 client 在 server 恢复时同时重连
+type Backoff struct {
+	// Initial 第一次失败后等待时间的上限，可选，默认 200ms
+	Initial time.Duration
+
+	// Max 等待时间的上限，可选，默认 30s
+	Max time.Duration
+
+	// Multiplier 每次失败后等待时间上限的增长倍数，可选，默认 2，不能小于 1
+	Multiplier float64
+}
+
+func (b *Backoff) check() error {
+	if b.Initial < 0 || b.Max < 0 {
+		return errors.New("backoff duration must not be negative")
+	}
+	if b.Multiplier != 0 && b.Multiplier < 1 {
+		return errors.New("backoff multiplier must not be less than 1")
+	}
+	if b.Initial > 0 && b.Max > 0 && b.Initial > b.Max {
+		return errors.New("backoff initial must not be greater than max")
+	}
+	return nil
+}
+
+func (b *Backoff) getInitial() time.Duration {
+	if b.Initial > 0 {
+		return b.Initial
+	}
+	return defaultBackoffInitial
+}
+
+func (b *Backoff) getMax() time.Duration {
+	if b.Max > 0 {
+		return b.Max
+	}
+	return max(defaultBackoffMax, b.getInitial())
+}
+
+func (b *Backoff) getMultiplier() float64 {
+	if b.Multiplier >= 1 {
+		return b.Multiplier
+	}
+	return defaultBackoffMultiplier
+}
+
+// Ceil 第 failures 次连续失败后，等待时间的上限
+func (b *Backoff) Ceil(failures int) time.Duration {
+	limit := float64(b.getMax())
+	v := float64(b.getInitial()) * math.Pow(b.getMultiplier(), float64(max(failures, 1)-1))
+	if v >= limit || math.IsInf(v, 0) || math.IsNaN(v) {
+		return b.getMax()
+	}
+	return time.Duration(v)
+}
+
+// Delay 第 failures 次连续失败后，需要等待的时间，为 [0, Ceil(failures)] 之间的随机值
+func (b *Backoff) Delay(failures int) time.Duration {
+	return rand.N(b.Ceil(failures) + 1)
+}
+
+// retryState 连接同一个目标的连续失败状态，所有连接该目标的 goroutine 共用
+type retryState struct {
+	mu       sync.Mutex
+	failures int       // 连续失败的次数
+	until    time.Time // 最后一次失败后，等待到此时间再重试
+}
+
+// fail 记录一次失败，返回连续失败的次数和需要等待的时间
+func (r *retryState) fail(b *Backoff) (failures int, delay time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	delay = b.Delay(r.failures)
+	r.until = time.Now().Add(delay)
+	return r.failures, delay
+}
+
+// reset 连接成功后清除失败状态
+func (r *retryState) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures = 0
+	r.until = time.Time{}
+}
+
+func (r *retryState) getFailures() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures
+}
+
+// broken 是否处于熔断中：连续失败达到 breakerFailures 次，并且还没有到重试的时间
+func (r *retryState) broken() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failures >= breakerFailures && time.Now().Before(r.until)
+}
+
+// remaining 距离下次可以重试还需要等待的时间
+func (r *retryState) remaining() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return max(time.Until(r.until), 0)
+}
@@ -0,0 +1,95 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestBackoff(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		b := &Backoff{}
+		xt.Equal(t, 200*time.Millisecond, b.Ceil(0))
+		xt.Equal(t, 200*time.Millisecond, b.Ceil(1))
+		xt.Equal(t, 400*time.Millisecond, b.Ceil(2))
+		xt.Equal(t, 800*time.Millisecond, b.Ceil(3))
+		xt.Equal(t, 30*time.Second, b.Ceil(100))
+		xt.Equal(t, 30*time.Second, b.Ceil(100000))
+	})
+	t.Run("custom", func(t *testing.T) {
+		b := &Backoff{Initial: time.Second, Max: 5 * time.Second, Multiplier: 1.5}
+		xt.Equal(t, 1500*time.Millisecond, b.Ceil(2))
+		xt.Equal(t, 5*time.Second, b.Ceil(10))
+		for i := 1; i < 20; i++ {
+			d := b.Delay(i)
+			xt.True(t, d >= 0 && d <= b.Ceil(i))
+		}
+	})
+	t.Run("jitter", func(t *testing.T) {
+		b := &Backoff{}
+		got := map[time.Duration]bool{}
+		for range 20 {
+			got[b.Delay(10)] = true
+		}
+		xt.True(t, len(got) > 1)
+	})
+	t.Run("check", func(t *testing.T) {
+		xt.NoError(t, (&Backoff{}).check())
+		xt.ErrorContains(t, (&Backoff{Multiplier: 0.5}).check(), "multiplier")
+		xt.ErrorContains(t, (&Backoff{Initial: -1}).check(), "negative")
+		xt.ErrorContains(t, (&Backoff{Initial: time.Minute, Max: time.Second}).check(), "greater than max")
+	})
+}
+
+func Test_retryState(t *testing.T) {
+	b := &Backoff{Initial: time.Hour, Max: time.Hour, Multiplier: 1}
+	rs := &retryState{}
+	for i := 1; i < breakerFailures; i++ {
+		n, _ := rs.fail(b)
+		xt.Equal(t, i, n)
+		xt.False(t, rs.broken())
+	}
+	_, delay := rs.fail(b)
+	xt.Equal(t, breakerFailures, rs.getFailures())
+	// 随机等待的时间可能为 0
+	xt.Equal(t, delay > 0, rs.broken())
+	rs.reset()
+	xt.Equal(t, 0, rs.getFailures())
+	xt.False(t, rs.broken())
+}
+
+func TestClientBreaker(t *testing.T) {
+	s := &Server{}
+	// 前两次失败后等待的时间很短，第三次失败后熔断很长时间
+	c := &Client{
+		LocalAddr: freeAddr(t), // 本地服务不可用
+		Backoff:   Backoff{Initial: 10 * time.Microsecond, Max: time.Hour, Multiplier: 30000},
+	}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	read := func() {
+		conn, err := net.Dial("tcp", s.ListenOut)
+		xt.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		xt.ErrorIs(t, err, io.EOF)
+	}
+	read()
+	rs := c.localRetry(c.LocalAddr)
+	xt.Equal(t, breakerFailures, rs.getFailures())
+	xt.True(t, rs.broken())
+
+	read()
+	xt.Equal(t, uint64(1), c.getMetrics().breakerRejects.Load())
+	xt.Equal(t, breakerFailures, rs.getFailures())
+}
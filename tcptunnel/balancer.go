@@ -0,0 +1,276 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/ds/xsync"
+	"github.com/xanygo/anygo/xnet"
+
+	"github.com/fsgo/networks/internal"
+)
+
+// 在一个服务的多个本地地址之间选择的策略，BalanceRoundRobin 为默认的平滑加权轮询
+const (
+	BalanceLeastConns = "least_conns" // 选择活跃连接数和权重之比最小的地址
+	BalanceRandom     = "random"      // 按照权重随机选择
+	BalanceIPHash     = "ip_hash"     // 按照外部用户的 IP 一致性哈希，同一个 IP 总是选择同一个地址
+)
+
+const (
+	defaultHealthCheckInterval = 5 * time.Second
+	defaultHealthCheckFails    = 3
+)
+
+func checkLocalBalance(name string) error {
+	switch name {
+	case "", BalanceRoundRobin, BalanceLeastConns, BalanceRandom, BalanceIPHash:
+		return nil
+	default:
+		return fmt.Errorf("unsupported local balance %q", name)
+	}
+}
+
+// backend 服务的一个本地地址
+type backend struct {
+	addr   string
+	weight int
+
+	conns atomic.Int64 // 活跃的连接数
+	down  atomic.Bool  // 健康检查失败，不参与选择
+
+	current int // 平滑加权轮询的当前权重，由 balancer.mu 保护
+	fails   int // 健康检查连续失败的次数，只在检查的 goroutine 中使用
+}
+
+// parseBackends 解析多个本地地址，使用 | 分隔，地址后可以使用 *weight 指定权重，默认为 1
+// 如 127.0.0.1:8080*2|127.0.0.1:8081
+func parseBackends(str string) ([]*backend, error) {
+	var items []*backend
+	for _, addr := range strings.Split(str, "|") {
+		addr = strings.TrimSpace(addr)
+		b := &backend{addr: addr, weight: 1}
+		if before, after, ok := strings.Cut(addr, "*"); ok {
+			w, err := strconv.Atoi(after)
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight of %q", addr)
+			}
+			b.addr, b.weight = before, w
+		}
+		if b.addr == "" {
+			return nil, fmt.Errorf("invalid local addr %q", str)
+		}
+		items = append(items, b)
+	}
+	return items, nil
+}
+
+// balancer 在一个服务的多个本地地址之间选择
+type balancer struct {
+	policy   string
+	network  string
+	backends []*backend
+
+	mu   sync.Mutex
+	next int
+}
+
+func newBalancer(policy string, svc *ClientService) (*balancer, error) {
+	backends, err := parseBackends(svc.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &balancer{policy: policy, network: svc.network(), backends: backends}, nil
+}
+
+var errNoBackend = errors.New("no local addr available")
+
+// pick 选择一个 skip 之外的地址，优先选择健康的地址，都不健康时在所有地址中选择
+// peer 为外部用户的地址，用于 ip_hash
+func (b *balancer) pick(peer string, skip func(*backend) bool) (*backend, error) {
+	var items []*backend
+	for _, item := range b.backends {
+		if !item.down.Load() && !skip(item) {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		for _, item := range b.backends {
+			if !skip(item) {
+				items = append(items, item)
+			}
+		}
+	}
+	switch {
+	case len(items) == 0:
+		return nil, errNoBackend
+	case len(items) == 1:
+		return items[0], nil
+	}
+	switch b.policy {
+	case BalanceLeastConns:
+		return b.leastConns(items), nil
+	case BalanceRandom:
+		return pickRandom(items), nil
+	case BalanceIPHash:
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			// 旧版本的 server 不会发送外部用户的地址
+			return pickRandom(items), nil
+		}
+		return pickHash(items, host), nil
+	default:
+		return b.roundRobin(items), nil
+	}
+}
+
+// roundRobin 平滑加权轮询，同 nginx 的实现
+func (b *balancer) roundRobin(items []*backend) *backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var best *backend
+	var total int
+	for _, item := range items {
+		item.current += item.weight
+		total += item.weight
+		if best == nil || item.current > best.current {
+			best = item
+		}
+	}
+	best.current -= total
+	return best
+}
+
+func (b *balancer) leastConns(items []*backend) *backend {
+	b.mu.Lock()
+	b.next++
+	next := b.next
+	b.mu.Unlock()
+	// 从轮询的位置开始找，使得连接数相同时也能均匀分配
+	var best *backend
+	for i := range items {
+		item := items[(next+i)%len(items)]
+		if best == nil || item.conns.Load()*int64(best.weight) < best.conns.Load()*int64(item.weight) {
+			best = item
+		}
+	}
+	return best
+}
+
+func pickRandom(items []*backend) *backend {
+	var total int
+	for _, item := range items {
+		total += item.weight
+	}
+	n := rand.N(total)
+	for _, item := range items {
+		if n < item.weight {
+			return item
+		}
+		n -= item.weight
+	}
+	return items[len(items)-1]
+}
+
+// pickHash 加权的 rendezvous hash，地址变化时，只有原来选择该地址的 key 会改变选择
+func pickHash(items []*backend, key string) *backend {
+	var best *backend
+	var bestScore float64
+	for _, item := range items {
+		h := fnv.New64a()
+		_, _ = io.WriteString(h, key)
+		_, _ = io.WriteString(h, item.addr)
+		// 将 hash 值映射到 (0, 1)
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := float64(item.weight) / -math.Log(u)
+		if best == nil || score > bestScore {
+			best, bestScore = item, score
+		}
+	}
+	return best
+}
+
+// healthCheck 定期检查所有地址是否可以连接，连续失败 fails 次后不再选择，直到检查成功
+func (b *balancer) healthCheck(ctx context.Context, c *Client) {
+	interval := c.getHealthCheckInterval()
+	fails := c.HealthCheckFails
+	if fails <= 0 {
+		fails = defaultHealthCheckFails
+	}
+	tm := time.NewTicker(interval)
+	defer tm.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tm.C:
+		}
+		var wg xsync.WaitGroup
+		for _, item := range b.backends {
+			wg.Go(func() {
+				b.check(ctx, c, item, min(interval, c.getConnectTimeout()), fails)
+			})
+		}
+		wg.Wait()
+	}
+}
+
+func (b *balancer) check(ctx context.Context, c *Client, item *backend, timeout time.Duration, fails int) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	conn, err := xnet.DialContext(ctx, networkTCP, item.addr)
+	if err == nil {
+		_ = conn.Close()
+		item.fails = 0
+		if item.down.CompareAndSwap(true, false) {
+			c.logger().Info("local addr is up", "addr", item.addr)
+		}
+		return
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+	item.fails++
+	c.logger().Debug("health check failed", "addr", item.addr, "fails", item.fails, errAttr(err))
+	if item.fails >= fails && item.down.CompareAndSwap(false, true) {
+		c.logger().Warn("local addr is down", "addr", item.addr, "fails", item.fails, errAttr(err))
+	}
+}
+
+// backendConn 到本地地址的连接，关闭时更新活跃的连接数
+type backendConn struct {
+	io.ReadWriteCloser
+	b    *backend
+	once sync.Once
+}
+
+func newBackendConn(rw io.ReadWriteCloser, b *backend) *backendConn {
+	b.conns.Add(1)
+	return &backendConn{ReadWriteCloser: rw, b: b}
+}
+
+func (c *backendConn) CloseWrite() error {
+	return internal.CloseWrite(c.ReadWriteCloser)
+}
+
+func (c *backendConn) Close() error {
+	c.once.Do(func() {
+		c.b.conns.Add(-1)
+	})
+	return c.ReadWriteCloser.Close()
+}
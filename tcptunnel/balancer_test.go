@@ -0,0 +1,174 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func Test_parseBackends(t *testing.T) {
+	items, err := parseBackends("127.0.0.1:8080*2| 127.0.0.1:8081")
+	xt.NoError(t, err)
+	xt.Len(t, items, 2)
+	xt.Equal(t, "127.0.0.1:8080", items[0].addr)
+	xt.Equal(t, 2, items[0].weight)
+	xt.Equal(t, "127.0.0.1:8081", items[1].addr)
+	xt.Equal(t, 1, items[1].weight)
+
+	for _, str := range []string{"a:1*0", "a:1*x", "a:1|", "*2"} {
+		_, err = parseBackends(str)
+		xt.Error(t, err)
+	}
+}
+
+func Test_balancerPick(t *testing.T) {
+	newBalancer := func(policy string) *balancer {
+		b, err := newBalancer(policy, &ClientService{LocalAddr: "a:1*2|b:1|c:1"})
+		xt.NoError(t, err)
+		return b
+	}
+	noSkip := func(*backend) bool {
+		return false
+	}
+	pickN := func(b *balancer, n int, peer func(i int) string) map[string]int {
+		got := map[string]int{}
+		for i := range n {
+			item, err := b.pick(peer(i), noSkip)
+			xt.NoError(t, err)
+			got[item.addr]++
+		}
+		return got
+	}
+	noPeer := func(int) string {
+		return ""
+	}
+
+	t.Run("round_robin", func(t *testing.T) {
+		b := newBalancer("")
+		var seq string
+		for range 4 {
+			item, _ := b.pick("", noSkip)
+			seq += item.addr[:1]
+		}
+		// 平滑加权轮询，权重大的地址不会被连续选择
+		xt.Equal(t, "abca", seq)
+		xt.Equal(t, map[string]int{"a": 200, "b": 100, "c": 100}, trimPort(pickN(b, 400, noPeer)))
+	})
+
+	t.Run("least_conns", func(t *testing.T) {
+		b := newBalancer(BalanceLeastConns)
+		b.backends[0].conns.Store(3)
+		b.backends[1].conns.Store(1)
+		b.backends[2].conns.Store(2)
+		item, _ := b.pick("", noSkip)
+		xt.Equal(t, "b:1", item.addr)
+		b.backends[1].conns.Store(2)
+		// a 的权重为 2，3/2 < 2/1
+		item, _ = b.pick("", noSkip)
+		xt.Equal(t, "a:1", item.addr)
+	})
+
+	t.Run("random", func(t *testing.T) {
+		got := trimPort(pickN(newBalancer(BalanceRandom), 4000, noPeer))
+		xt.True(t, got["a"] > got["b"] && got["a"] > got["c"])
+		xt.True(t, got["b"] > 500 && got["c"] > 500)
+	})
+
+	t.Run("ip_hash", func(t *testing.T) {
+		b := newBalancer(BalanceIPHash)
+		peer := func(i int) string {
+			return fmt.Sprintf("10.0.%d.%d:%d", i/256, i%256, 10000+i)
+		}
+		picked := make([]string, 1000)
+		for i := range picked {
+			item, _ := b.pick(peer(i), noSkip)
+			picked[i] = item.addr
+			// 同一个 IP 不同端口的选择相同
+			item, _ = b.pick(fmt.Sprintf("10.0.%d.%d:1", i/256, i%256), noSkip)
+			xt.Equal(t, picked[i], item.addr)
+		}
+		got := trimPort(pickN(b, 1000, peer))
+		xt.True(t, got["a"] > got["b"] && got["a"] > got["c"])
+
+		// 地址不可用时，只有原来选择该地址的 IP 会改变选择
+		b.backends[2].down.Store(true)
+		for i := range picked {
+			item, _ := b.pick(peer(i), noSkip)
+			if picked[i] != "c:1" {
+				xt.Equal(t, picked[i], item.addr)
+			} else {
+				xt.NotEqual(t, "c:1", item.addr)
+			}
+		}
+	})
+
+	t.Run("down", func(t *testing.T) {
+		b := newBalancer("")
+		b.backends[0].down.Store(true)
+		b.backends[1].down.Store(true)
+		xt.Equal(t, map[string]int{"c": 10}, trimPort(pickN(b, 10, noPeer)))
+
+		// 都不可用时，在所有地址中选择
+		b.backends[2].down.Store(true)
+		xt.Len(t, pickN(b, 10, noPeer), 3)
+
+		_, err := b.pick("", func(*backend) bool {
+			return true
+		})
+		xt.ErrorIs(t, err, errNoBackend)
+	})
+}
+
+func trimPort(m map[string]int) map[string]int {
+	got := make(map[string]int, len(m))
+	for k, v := range m {
+		host, _, _ := net.SplitHostPort(k)
+		got[host] += v
+	}
+	return got
+}
+
+func TestClientLoadBalance(t *testing.T) {
+	down := freeAddr(t)
+	c := &Client{
+		LocalAddr:           startNamedServer(t, "a") + "|" + startNamedServer(t, "b") + "|" + down,
+		HealthCheckInterval: 20 * time.Millisecond,
+		HealthCheckFails:    1,
+	}
+	s := &Server{}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	b := c.balancers[defaultService]
+	waitFor(t, func() bool {
+		return b.backends[2].down.Load()
+	})
+	xt.False(t, b.backends[0].down.Load())
+
+	readName := func() string {
+		conn, err := net.Dial("tcp", s.ListenOut)
+		xt.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		bf := make([]byte, 1)
+		_, err = io.ReadFull(conn, bf)
+		xt.NoError(t, err)
+		return string(bf)
+	}
+	got := map[string]int{}
+	for range 6 {
+		got[readName()]++
+	}
+	xt.Equal(t, map[string]int{"a": 3, "b": 3}, got)
+	xt.Equal(t, uint64(3), c.getMetrics().backendConns.With(b.backends[0].addr).Load())
+	xt.Equal(t, uint64(0), c.getMetrics().backendConns.With(down).Load())
+}
@@ -5,16 +5,25 @@
 package tcptunnel
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/xanygo/anygo/cli/xflag"
 	"github.com/xanygo/anygo/xnet"
+
+	"github.com/fsgo/networks/internal/proxyproto"
 )
 
 func NewClient() *Client {
@@ -29,19 +38,133 @@ type Client struct {
 	// ServerAddr 服务端的地址，必填，如 192.168.1.10:8080
 	ServerAddr string
 
-	// LocalAddr 期望对外发布的本地服务的地址，必填，如 127.0.0.1:8090
+	// LocalAddr 期望对外发布的本地服务的地址，即默认服务的地址，如 127.0.0.1:8090
+	// 和 Services 至少配置一个
+	// 可以使用 | 分隔多个地址，并使用 *weight 指定权重，如 127.0.0.1:8090*2|127.0.0.1:8091，Services 中的地址同理
 	LocalAddr string
 
+	// RemotePort 请求 server 为默认服务监听的端口，可选
+	// 0 表示使用 server 上配置的 ListenOut；RemotePortAny(-1) 表示由 server 在允许的范围内任选
+	RemotePort int
+
+	// Services 期望对外发布的多个本地服务，可选
+	// 若服务没有配置 RemotePort，server 上需要配置同名的服务（ServerService）
+	Services ClientServices
+
+	locals    map[string]*ClientService // 服务名称 -> 本地服务
+	balancers map[string]*balancer      // 服务名称 -> 本地地址
+	ports     map[string]int            // 服务名称 -> 请求 server 监听的端口
+
+	// LocalBalance 服务有多个本地地址时，选择地址的策略，可选
+	// 可选值：round_robin（默认）、least_conns、random、ip_hash
+	LocalBalance string
+
+	// HealthCheckInterval 服务有多个本地地址时，检查地址是否可以连接的间隔，可选，默认 5 秒，小于 0 时不检查
+	// 只检查 tcp 服务，连续失败 HealthCheckFails 次的地址不会再被选择，直到检查成功
+	HealthCheckInterval time.Duration
+
+	// HealthCheckFails 健康检查连续失败多少次后不再选择该地址，可选，默认 3
+	HealthCheckFails int
+
+	// ProxyProtocol 在到本地 tcp 服务的连接上发送 PROXY protocol header 的版本，使本地服务可以获取外部用户的地址，可选
+	// 可选值：v1、v2，为空时不发送，本地服务需要支持，如 nginx 的 listen ... proxy_protocol
+	ProxyProtocol string
+
+	proxyVersion int
+
+	// ClientID client 的标识，可选，默认随机生成
+	// server 以此识别同一个 client 的多个连接，使它们共用 server 为其监听的端口
+	ClientID string
+
+	remoteAddrs sync.Map // 服务名称 -> server 实际监听的地址
+
+	// Forwards 正向隧道，可选，client 在本地监听，连接经 server 转发到 server 侧的目标地址
+	Forwards ClientForwards
+
 	// Worker
 	Worker int
 
 	// ConnectTimeout 网络连接超时时间，可选
 	ConnectTimeout time.Duration
 
+	// IdleTimeout tcp 的 stream 两个方向都超过此时间没有数据时关闭，可选，默认不超时，
+	// 但一个方向半关闭后，另一个方向超过 2 分钟没有数据时也会关闭
+	IdleTimeout time.Duration
+
+	// UDPIdleTimeout udp 服务到本地服务的会话空闲超时时间，可选，默认为 1 分钟
+	// 应不小于 server 的 UDPIdleTimeout，否则 server 上还活跃的会话会被 client 提前关闭
+	UDPIdleTimeout time.Duration
+
+	// Backoff 连接 server 和本地服务失败后重试的退避策略，可选
+	// 本地服务连续失败多次后会熔断，在等待期间新的 stream 会直接失败
+	Backoff Backoff
+
+	serverRetry  retryState
+	localRetries sync.Map // 本地服务地址 -> *retryState
+
+	// LocalPool 为每个本地 tcp 服务预先建立的空闲连接数，可选，默认为 0，即不使用连接池
+	// 取出连接时会检查连接是否可用，不适用于连接建立后由服务端先发送数据的服务，如 ssh、mysql
+	LocalPool int
+
+	// LocalPoolIdle 连接池中的连接的最长空闲时间，超过后会被关闭并重新建立，可选，默认 30 秒
+	LocalPoolIdle time.Duration
+
+	pools map[string]*localPool // 本地地址 -> 连接池
+
+	// LocalDialAttempts 每个 stream 连接本地服务的最多尝试次数，可选，默认 3
+	// 失败时会将原因回复给 server，由 server 关闭外部的连接
+	LocalDialAttempts int
+
+	// HeartbeatInterval 和 server 之间心跳的间隔，可选，默认 15 秒，小于 0 时不发送心跳
+	// 心跳失败时会断开连接并重连，server 也会断开长时间没有心跳的连接
+	HeartbeatInterval time.Duration
+
+	// HeartbeatMisses 连续多少次心跳失败后断开连接，可选，默认 3
+	HeartbeatMisses int
+
 	// Token 加密密码，可选
 	Token string
 
-	stopped atomic.Bool
+	// Cipher 加密算法，可选，默认为 aes-ctr，和 server 的必须一致
+	// 可选值：aes-ctr、aes-gcm、chacha20-poly1305，后两者可以防止数据被篡改
+	Cipher string
+
+	cipherID byte
+
+	// TLS 是否使用 TLS 连接 server，可选
+	TLS bool
+
+	// TLSCAFile 校验 server 证书的 CA 文件，可选，默认使用系统的 CA
+	TLSCAFile string
+
+	// TLSServerName 校验 server 证书时使用的域名（SNI），可选，默认为 ServerAddr 中的 host
+	TLSServerName string
+
+	// TLSCertFile 和 TLSKeyFile 为 client 证书，server 开启 mTLS 时必填
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSPinSHA256 server 证书公钥（SPKI）的 sha256 指纹，hex 或者 base64 格式，多个使用逗号分隔，可选
+	// 若没有配置 TLSCAFile，则只校验指纹，可用于自签名证书
+	TLSPinSHA256 string
+
+	// TLSConfig 完整的 TLS 配置，可选，若有值，则会忽略上述 TLS 开头的其他配置
+	TLSConfig *tls.Config
+
+	tlsConfig *tls.Config
+
+	// MetricsAddr 以 Prometheus 文本格式输出指标的 http 监听地址，路径为 /metrics，可选
+	MetricsAddr string
+
+	metrics metricsOnce[clientMetrics]
+
+	// Logger 日志，可选，默认为 slog.Default()
+	Logger *slog.Logger
+
+	lc lifecycle
+	tl atomic.Pointer[Tunneler]
+
+	cntForwardNow atomic.Int64 // 处理中的正向隧道连接
 
 	clientConnID atomic.Int64
 	serverConnID atomic.Int64
@@ -50,20 +173,215 @@ type Client struct {
 func (c *Client) BindFlags() {
 	xflag.EnvStringVar(&c.ServerAddr, "remote", "TT_C_remove", "127.0.0.1:8090", "remote tunnel server addr")
 	xflag.EnvStringVar(&c.LocalAddr, "local", "TT_C_local", "127.0.0.1:8080", "local server addr tunnel to")
+	xflag.EnvIntVar(&c.RemotePort, "remote-port", "TT_C_remote_port", 0, "ask server to listen on this port for local addr, -1 for any free port")
 	xflag.EnvIntVar(&c.Worker, "worker", "TT_C_worker", 1, "worker number")
+	xflag.EnvStringVar(&c.LocalBalance, "local-balance", "TT_C_local_balance", BalanceRoundRobin, "balance between local addrs of a service: round_robin, least_conns, random, ip_hash")
+	xflag.EnvDurationVar(&c.HealthCheckInterval, "health-check", "TT_C_health_check", defaultHealthCheckInterval, "health check interval of local addrs when a service has more than one, negative to disable")
+	xflag.EnvIntVar(&c.HealthCheckFails, "health-check-fails", "TT_C_health_check_fails", defaultHealthCheckFails, "consecutive health check failures before a local addr is taken out")
+	xflag.EnvStringVar(&c.ProxyProtocol, "proxy-protocol", "TT_C_proxy_protocol", "", "send PROXY protocol header to local tcp services: v1, v2")
+	xflag.EnvIntVar(&c.LocalPool, "local-pool", "TT_C_local_pool", 0, "idle connections to keep pre-dialed for each local tcp service, 0 to disable")
+	xflag.EnvDurationVar(&c.LocalPoolIdle, "local-pool-idle", "TT_C_local_pool_idle", defaultLocalPoolIdle, "max idle time of pre-dialed local connections")
+	xflag.EnvIntVar(&c.LocalDialAttempts, "local-dial-attempts", "TT_C_local_dial_attempts", defaultLocalDialAttempts, "max attempts to dial local service for each stream")
+	xflag.EnvDurationVar(&c.Backoff.Initial, "backoff-initial", "TT_C_backoff_initial", defaultBackoffInitial, "max wait before the first retry of a failed connection")
+	xflag.EnvDurationVar(&c.Backoff.Max, "backoff-max", "TT_C_backoff_max", defaultBackoffMax, "max wait between retries of a failed connection")
+	xflag.EnvFloat64Var(&c.Backoff.Multiplier, "backoff-multiplier", "TT_C_backoff_multiplier", defaultBackoffMultiplier, "growth of the max wait after each failure")
+	xflag.EnvDurationVar(&c.IdleTimeout, "idle-timeout", "TT_C_idle_timeout", 0, "close tcp streams idle for this long in both directions, 0 to disable")
+	xflag.EnvDurationVar(&c.UDPIdleTimeout, "udp-idle", "TT_C_udp_idle", defaultUDPIdleTimeout, "idle timeout of udp sessions to local services, should not be less than the server's")
+	xflag.EnvDurationVar(&c.HeartbeatInterval, "heartbeat", "TT_C_heartbeat", defaultHeartbeatInterval, "interval of heartbeats to server, negative to disable")
+	xflag.EnvIntVar(&c.HeartbeatMisses, "heartbeat-misses", "TT_C_heartbeat_misses", defaultHeartbeatMisses, "reconnect after this many heartbeats failed in a row")
 	xflag.EnvStringVar(&c.Token, "token", "TT_C_token", defaultToken, "token")
+	xflag.EnvStringVar(&c.Cipher, "cipher", "TT_C_cipher", "aes-ctr", cipherUsage)
+	xflag.EnvBoolVar(&c.TLS, "tls", "TT_C_tls", false, "connect to server with tls")
+	xflag.EnvStringVar(&c.TLSCAFile, "tls-ca", "TT_C_tls_ca", "", "tls ca file to verify server certificate")
+	xflag.EnvStringVar(&c.TLSServerName, "tls-server-name", "TT_C_tls_server_name", "", "tls server name (SNI)")
+	xflag.EnvStringVar(&c.TLSCertFile, "tls-cert", "TT_C_tls_cert", "", "tls client certificate file")
+	xflag.EnvStringVar(&c.TLSKeyFile, "tls-key", "TT_C_tls_key", "", "tls client key file")
+	xflag.EnvStringVar(&c.TLSPinSHA256, "tls-pin", "TT_C_tls_pin", "", "sha256 pins of server public key, hex or base64")
+	envVar(&c.Services, "services", "TT_C_services", "named local services, e.g. web=127.0.0.1:8080,ssh=127.0.0.1:22,dns=udp://127.0.0.1:53")
+	xflag.EnvStringVar(&c.MetricsAddr, "metrics", "TT_C_metrics", "", "addr to serve prometheus metrics at /metrics, e.g. 127.0.0.1:9101")
+	envVar(&c.Forwards, "forwards", "TT_C_forwards", "forward local listen addr to target via server, e.g. 127.0.0.1:13306=10.0.0.5:3306")
 }
 
-func (c *Client) Start() error {
-	log.Println("Starting...")
-	log.Println("Remote Addr=", c.ServerAddr, ", Local Addr=", c.LocalAddr)
+func (c *Client) logger() *slog.Logger {
+	return getLogger(c.Logger)
+}
+
+func (c *Client) initServices() error {
+	c.locals = make(map[string]*ClientService, len(c.Services)+1)
+	c.balancers = make(map[string]*balancer, len(c.Services)+1)
+	c.ports = make(map[string]int)
+	addPort := func(name string, port int) {
+		switch {
+		case port == RemotePortAny:
+			c.ports[name] = 0
+		case port > 0:
+			c.ports[name] = port
+		}
+	}
+	if c.LocalAddr != "" {
+		c.locals[defaultService] = &ClientService{Name: defaultService, LocalAddr: c.LocalAddr}
+		addPort(defaultService, c.RemotePort)
+	}
+	for _, svc := range c.Services {
+		if svc.Name == defaultService || svc.LocalAddr == "" {
+			return fmt.Errorf("invalid service %q=%q", svc.Name, svc.LocalAddr)
+		}
+		if _, has := c.locals[svc.Name]; has {
+			return fmt.Errorf("duplicate service %q", svc.Name)
+		}
+		if svc.Network != "" && svc.Network != networkTCP && svc.Network != networkUDP {
+			return fmt.Errorf("invalid network %q of service %q", svc.Network, svc.Name)
+		}
+		if svc.Network == networkUDP && svc.RemotePort != 0 {
+			return fmt.Errorf("remote port is not supported for udp service %q", svc.Name)
+		}
+		c.locals[svc.Name] = svc
+		addPort(svc.Name, svc.RemotePort)
+	}
+	for _, fw := range c.Forwards {
+		if fw.Listen == "" || fw.Target == "" {
+			return fmt.Errorf("invalid forward %q=%q", fw.Listen, fw.Target)
+		}
+	}
+	if err := checkLocalBalance(c.LocalBalance); err != nil {
+		return err
+	}
+	for name, svc := range c.locals {
+		b, err := newBalancer(c.LocalBalance, svc)
+		if err != nil {
+			return fmt.Errorf("service %q: %w", name, err)
+		}
+		c.balancers[name] = b
+	}
+	if len(c.locals) == 0 && len(c.Forwards) == 0 {
+		return errors.New("no local service, LocalAddr, Services and Forwards are all empty")
+	}
+	return nil
+}
+
+// init 校验配置并初始化
+func (c *Client) init() error {
+	if c.ServerAddr == "" {
+		return errors.New("ServerAddr is required")
+	}
+	id, err := parseCipher(c.Cipher)
+	if err != nil {
+		return err
+	}
+	c.cipherID = id
+	if err = c.Backoff.check(); err != nil {
+		return err
+	}
+	if c.proxyVersion, err = proxyproto.ParseVersion(c.ProxyProtocol); err != nil {
+		return err
+	}
+	if c.LocalPool < 0 || c.LocalDialAttempts < 0 {
+		return errors.New("LocalPool and LocalDialAttempts must not be negative")
+	}
+	c.tlsConfig, err = c.getTLSConfig()
+	if err != nil {
+		return err
+	}
+	if err = c.initServices(); err != nil {
+		return err
+	}
+	if c.ClientID == "" {
+		c.ClientID = newClientID()
+	}
+	c.pools = make(map[string]*localPool)
+	if c.LocalPool > 0 {
+		for _, b := range c.balancers {
+			if b.network != networkTCP {
+				continue
+			}
+			for _, item := range b.backends {
+				if c.pools[item.addr] == nil {
+					c.pools[item.addr] = newLocalPool(c, item.addr)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Start 启动 client，会一直运行直到 ctx 被取消、调用了 Shutdown 或者出现错误
+// 通过 ctx 或者 Shutdown 停止时返回 nil
+func (c *Client) Start(ctx context.Context) error {
+	ctx, err := c.lc.start(ctx, c.init)
+	if err != nil {
+		return err
+	}
+	c.logger().Info("starting", "server", c.ServerAddr, "local", c.LocalAddr, "services", c.Services.String(), "client_id", c.ClientID)
 	tl := &Tunneler{
-		Worker:   c.Worker,
-		Token:    c.Token,
-		RemoteRW: c.connectToServer,
-		LocalRW:  c.connectToClient,
+		Worker:            c.Worker,
+		Token:             c.Token,
+		RemoteRW:          c.connectToServer,
+		LocalDial:         c.connectToClient,
+		HeartbeatInterval: c.getHeartbeatInterval(),
+		HeartbeatMisses:   c.HeartbeatMisses,
+		IdleTimeout:       c.IdleTimeout,
+		Logger:            c.Logger,
+		metrics:           c.getMetrics().stream,
+		heartbeatMetrics:  c.getMetrics().heartbeat,
 	}
-	return tl.Start()
+	c.tl.Store(tl)
+	fns := []func() error{
+		func() error {
+			return tl.Start(ctx)
+		},
+	}
+	for _, pool := range c.pools {
+		fns = append(fns, func() error {
+			pool.run(ctx)
+			return nil
+		})
+	}
+	if c.getHealthCheckInterval() > 0 {
+		for _, b := range c.balancers {
+			if b.network != networkTCP || len(b.backends) < 2 {
+				continue
+			}
+			fns = append(fns, func() error {
+				b.healthCheck(ctx, c)
+				return nil
+			})
+		}
+	}
+	for _, fw := range c.Forwards {
+		fns = append(fns, func() error {
+			return c.startForward(tl, fw)
+		})
+	}
+	if c.MetricsAddr != "" {
+		fns = append(fns, func() error {
+			return serveMetrics(&c.lc, c.logger(), c.MetricsAddr, c.MetricsHandler())
+		})
+	}
+	// Tunneler 使用的 ctx 会在停止时被取消，不需要额外的关闭
+	return c.lc.run(fns, func() {})
+}
+
+// Shutdown 优雅关闭：停止正向隧道的监听，不再接受 server 创建的 stream，
+// 等待处理中的连接结束，若 ctx 超时则强制关闭
+func (c *Client) Shutdown(ctx context.Context) error {
+	c.closeListeners()
+	tl := c.tl.Load()
+	return c.lc.shutdown(ctx, func() bool {
+		if tl == nil {
+			return c.cntForwardNow.Load() > 0
+		}
+		// 没有活跃 stream 的连接可以先断开，避免 server 继续在上面创建 stream
+		tl.closeIdle()
+		return c.cntForwardNow.Load() > 0 || tl.cntStreamNow.Load() > 0
+	})
+}
+
+// closeListeners 停止正向隧道的监听，不再接受 server 创建的 stream
+func (c *Client) closeListeners() {
+	if tl := c.tl.Load(); tl != nil {
+		tl.lc.closeListeners()
+	}
+	c.lc.closeListeners()
 }
 
 func (c *Client) getConnectTimeout() time.Duration {
@@ -73,61 +391,255 @@ func (c *Client) getConnectTimeout() time.Duration {
 	return 10 * time.Second
 }
 
-var helloMsgReq = []byte("Hello")
-var helloMsgResp = []byte("OK")
-
-func (c *Client) checkServerToken(rw io.ReadWriteCloser) error {
-	// 单独发送一个消息给 server，用于检验 token
-	// 若 server 解析不出来，server 会主动断开连接
-	if _, err := rw.Write(helloMsgReq); err != nil {
-		return fmt.Errorf("write helloMsgReq failed: %w", err)
+// getHealthCheckInterval 返回健康检查的间隔，为 0 表示不检查
+func (c *Client) getHealthCheckInterval() time.Duration {
+	switch {
+	case c.HealthCheckInterval > 0:
+		return c.HealthCheckInterval
+	case c.HealthCheckInterval < 0:
+		return 0
+	default:
+		return defaultHealthCheckInterval
 	}
-	bf := make([]byte, len(helloMsgResp))
-	if _, err := io.ReadFull(rw, bf); err != nil {
-		return fmt.Errorf("read helloMsgResp failed: %w", err)
+}
+
+func (c *Client) getLocalDialAttempts() int {
+	if c.LocalDialAttempts > 0 {
+		return c.LocalDialAttempts
 	}
-	if !bytes.Equal(bf, helloMsgResp) {
-		return fmt.Errorf("invalid helloMsgResp: %q", bf)
+	return defaultLocalDialAttempts
+}
+
+// getLocalDialTimeout 每个 stream 连接本地服务最多需要的时间，即每次尝试的超时时间和重试前的等待时间之和
+func (c *Client) getLocalDialTimeout() time.Duration {
+	attempts := c.getLocalDialAttempts()
+	d := c.getConnectTimeout() * time.Duration(attempts)
+	// 连续失败 breakerFailures 次后不再重试，每次等待的时间不超过 Ceil(breakerFailures)
+	d += c.Backoff.Ceil(breakerFailures) * time.Duration(attempts-1)
+	return d
+}
+
+// getHeartbeatInterval 返回心跳间隔，为 0 表示不发送心跳
+func (c *Client) getHeartbeatInterval() time.Duration {
+	switch {
+	case c.HeartbeatInterval > 0:
+		return c.HeartbeatInterval
+	case c.HeartbeatInterval < 0:
+		return 0
+	default:
+		return defaultHeartbeatInterval
 	}
-	return nil
 }
 
 func (c *Client) connectToServer() io.ReadWriteCloser {
-	for i := 0; ; i++ {
-		rw := c.connectTo("server", c.ServerAddr, c.serverConnID.Add(1))
-		if rw == nil {
+	for {
+		conn, err := c.connectTo("server", networkTCP, c.ServerAddr, c.serverConnID.Add(1), &c.serverRetry)
+		if err != nil {
 			return nil
 		}
-		rw = rwWithToken(rw, c.Token)
-		if err := c.checkServerToken(rw); err != nil {
-			_ = rw.Close()
-			log.Println("[connect_server]", rwInfo(rw), "check server conn failed,", err)
-			wait(i)
+		rw, err := c.handshake(conn)
+		if err != nil {
+			_ = conn.Close()
+			c.getMetrics().handshakes.With(handshakeFailReason(err)).Inc()
+			failures, delay := c.serverRetry.fail(&c.Backoff)
+			c.logger().Warn("handshake failed", remoteAttr(conn), errAttr(err), "failures", failures, "retry_in", delay)
+			sleep(c.lc.context(), delay)
 			continue
 		}
+		c.serverRetry.reset()
 		return rw
 	}
 }
 
-func (c *Client) connectToClient() io.ReadWriteCloser {
-	return c.connectTo("local", c.LocalAddr, c.clientConnID.Add(1))
+// handshake 和 server 握手：协商会话密钥，并和 server 互相校验 token
+// 若启用了 TLS，会先完成 TLS 握手
+func (c *Client) handshake(conn io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+	if nc, ok := conn.(net.Conn); ok {
+		_ = nc.SetDeadline(time.Now().Add(c.getConnectTimeout()))
+		defer nc.SetDeadline(time.Time{})
+
+		if c.tlsConfig != nil {
+			tc := tls.Client(nc, c.tlsConfig)
+			if err := tc.Handshake(); err != nil {
+				return nil, fmt.Errorf("%w: %w", errTLS, err)
+			}
+			conn = tc
+		}
+	}
+	rw, err := clientHandshake(conn, c.Token, c.cipherID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = c.register(rw); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// register 向 server 注册本 client 发布的服务
+func (c *Client) register(rw io.ReadWriter) (*registerResponse, error) {
+	req := &registerRequest{
+		ClientID: c.ClientID,
+	}
+	if interval := c.getHeartbeatInterval(); interval > 0 {
+		// 比 client 的检测多等待一个间隔，由 client 先发现并重连
+		req.Heartbeat = interval * time.Duration(getHeartbeatMisses(c.HeartbeatMisses)+1)
+	}
+	req.DialTimeout = c.getLocalDialTimeout()
+	if len(c.ports) > 0 {
+		req.Ports = c.ports
+	}
+	for name := range c.locals {
+		req.Services = append(req.Services, name)
+	}
+	sort.Strings(req.Services)
+	if err := writeMsg(rw, req); err != nil {
+		return nil, fmt.Errorf("write register request failed: %w", err)
+	}
+	resp := &registerResponse{}
+	if err := readMsg(rw, resp); err != nil {
+		return nil, fmt.Errorf("read register response failed: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%w: %s", errRegister, resp.Error)
+	}
+	for _, name := range req.Services {
+		if !slices.Contains(resp.Services, name) {
+			c.logger().Warn("service is not exported by server", logKeyService, name)
+		}
+	}
+	for name, addr := range resp.Addrs {
+		if old, loaded := c.remoteAddrs.Swap(name, addr); !loaded || old != addr {
+			c.logger().Info("service is exported by server", logKeyService, name, "addr", addr)
+		}
+	}
+	return resp, nil
+}
+
+// RemoteAddr 返回 server 为服务实际监听的地址，服务名称为空表示默认服务
+// 只有请求了 RemotePort 并注册成功后才有值
+func (c *Client) RemoteAddr(name string) string {
+	v, ok := c.remoteAddrs.Load(name)
+	if !ok {
+		return ""
+	}
+	return v.(string)
+}
+
+func newClientID() string {
+	bf := make([]byte, 8)
+	_, _ = rand.Read(bf)
+	return hex.EncodeToString(bf)
 }
 
-func (c *Client) connectTo(tp string, address string, id int64) io.ReadWriteCloser {
-	for i := 0; !c.stopped.Load(); i++ {
-		msg := fmt.Sprintf("[connect_%s] [%d] [try=%d] %s", tp, id, i, address)
-		start := time.Now()
-		ctx, cancel := context.WithTimeout(context.Background(), c.getConnectTimeout())
-		conn, err := xnet.DialContext(ctx, "tcp", address)
-		cost := time.Since(start)
-		cancel()
+func (c *Client) connectToClient(meta *StreamMeta) (io.ReadWriteCloser, error) {
+	svc, ok := c.locals[meta.Service]
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", meta.Service)
+	}
+	if svc.network() != meta.network() {
+		return nil, fmt.Errorf("network of service %q mismatch, local=%s, server=%s", meta.Service, svc.network(), meta.network())
+	}
+	// 连接失败时，换其他的地址重试
+	b := c.balancers[meta.Service]
+	tried := make(map[*backend]bool, 1)
+	var lastErr error
+	for {
+		item, err := b.pick(meta.Peer, func(item *backend) bool {
+			return tried[item]
+		})
 		if err != nil {
-			log.Println(msg, ", failed, err=", err, ", cost=", cost.String())
-			wait(i)
-			continue
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		tried[item] = true
+		conn, err := c.connectBackend(svc, item)
+		if err == nil && c.proxyVersion > 0 && svc.network() == networkTCP {
+			if err = writeProxyHeader(conn, c.proxyVersion, meta); err != nil {
+				_ = conn.Close()
+			}
+		}
+		if err == nil {
+			c.getMetrics().backendConns.With(item.addr).Inc()
+			return newBackendConn(conn, item), nil
+		}
+		lastErr = err
+		if c.lc.context().Err() != nil {
+			return nil, err
 		}
-		log.Println(msg, ", success, cost=", cost.String())
-		return conn
 	}
-	return nil
+}
+
+func (c *Client) connectBackend(svc *ClientService, item *backend) (io.ReadWriteCloser, error) {
+	if pool := c.pools[item.addr]; pool != nil {
+		if conn := pool.get(); conn != nil {
+			return conn, nil
+		}
+	}
+	conn, err := c.connectTo("local", svc.network(), item.addr, c.clientConnID.Add(1), c.localRetry(item.addr))
+	if err != nil {
+		return nil, err
+	}
+	if svc.network() == networkUDP {
+		return newDatagramConn(conn.(net.Conn), c.getUDPIdleTimeout()), nil
+	}
+	return conn, nil
+}
+
+// localRetry 返回本地服务地址的失败状态
+func (c *Client) localRetry(address string) *retryState {
+	v, _ := c.localRetries.LoadOrStore(address, &retryState{})
+	return v.(*retryState)
+}
+
+// connectTo 连接 address，失败时按照 Backoff 重试
+// 连接 server 时会一直重试直到停止，需要握手成功后再调用 rs.reset；
+// 连接本地服务时，最多尝试 LocalDialAttempts 次，连续失败后会熔断，返回最后一次的错误
+func (c *Client) connectTo(tp string, network string, address string, id int64, rs *retryState) (io.ReadWriteCloser, error) {
+	ctx := c.lc.context()
+	for i := 0; ctx.Err() == nil; i++ {
+		if tp == "local" && rs.broken() {
+			c.getMetrics().breakerRejects.Inc()
+			c.logger().Warn("connect rejected, circuit open", "kind", tp, slog.Int64(logKeyConnID, id), "addr", address,
+				"failures", rs.getFailures())
+			return nil, fmt.Errorf("%w: %s", errCircuitOpen, address)
+		}
+		conn, cost, err := c.dial(ctx, tp, network, address, id)
+		if err == nil {
+			if tp == "local" {
+				rs.reset()
+			}
+			return conn, nil
+		}
+		failures, delay := rs.fail(&c.Backoff)
+		c.logger().Warn("connect failed", "kind", tp, slog.Int64(logKeyConnID, id), "try", i, "addr", address,
+			errAttr(err), slog.Duration(logKeyCost, cost), "failures", failures, "retry_in", delay)
+		if tp == "local" && (failures >= breakerFailures || i+1 >= c.getLocalDialAttempts()) {
+			return nil, err
+		}
+		sleep(ctx, delay)
+	}
+	return nil, ctx.Err()
+}
+
+// dial 连接一次 address，超时时间为 ConnectTimeout
+func (c *Client) dial(ctx context.Context, tp string, network string, address string, id int64) (net.Conn, time.Duration, error) {
+	start := time.Now()
+	dctx, cancel := context.WithTimeout(ctx, c.getConnectTimeout())
+	defer cancel()
+	conn, err := xnet.DialContext(dctx, network, address)
+	cost := time.Since(start)
+	if err != nil {
+		if tp == "local" {
+			c.getMetrics().dialFailures.Inc()
+		}
+		return nil, cost, err
+	}
+	if tp == "local" {
+		c.getMetrics().dial.Observe(cost.Seconds())
+	}
+	c.logger().Debug("connected", "kind", tp, slog.Int64(logKeyConnID, id), "addr", address, slog.Duration(logKeyCost, cost))
+	return conn, cost, nil
 }
@@ -7,58 +7,103 @@ package tcptunnel
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/hkdf"
+	"crypto/pbkdf2"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"net"
 	"sync"
-	"time"
 
 	"github.com/fsgo/networks/internal"
 )
 
-func wait(n int) {
-	if n < 10 {
-		time.Sleep(200 * time.Millisecond)
-		return
+// noToken Token 为此值时不加密，明文传输
+const noToken = "no"
+
+var tokenCache sync.Map
+
+// masterKey 使用 PBKDF2 将 token 扩展为主密钥，结果会缓存
+func masterKey(token string) []byte {
+	if val, has := tokenCache.Load(token); has {
+		return val.([]byte)
+	}
+	key, err := pbkdf2.Key(sha256.New, token, []byte("45869c46255b13cd1d740b0ce6c11d61"), 4096, 32)
+	if err != nil {
+		panic(err)
 	}
-	time.Sleep(time.Second)
+	tokenCache.Store(token, key)
+	return key
 }
 
-var tokenCache sync.Map
+// streamKey 单个方向的加密密钥
+type streamKey struct {
+	Key []byte // AES-256 密钥
+	IV  []byte // CTR 模式的初始向量
+}
+
+// sessionKeys 一个连接的会话密钥，每个方向使用独立的密钥
+type sessionKeys struct {
+	c2s  *streamKey // client -> server
+	s2c  *streamKey // server -> client
+	auth []byte     // 握手时 HMAC 使用的密钥
+}
 
-func newStream(token string) cipher.Stream {
-	val, has := tokenCache.Load(token)
-	var block cipher.Block
-	if has {
-		block = val.(cipher.Block)
-	} else {
-		m := md5.New()
-		m.Write([]byte("45869c46255b13cd1d740b0ce6c11d61"))
-		m.Write([]byte(token))
-		key := []byte(hex.EncodeToString(m.Sum(nil)))
-		var err error
-		block, err = aes.NewCipher(key)
+// deriveKeys 使用 HKDF 从主密钥和双方的随机数派生出本连接的会话密钥，
+// 每个连接、每个方向的密钥流都不相同
+func deriveKeys(token string, clientNonce, serverNonce [nonceSize]byte) *sessionKeys {
+	salt := make([]byte, 0, 2*nonceSize)
+	salt = append(salt, clientNonce[:]...)
+	salt = append(salt, serverNonce[:]...)
+	mk := masterKey(token)
+	derive := func(info string, size int) []byte {
+		bf, err := hkdf.Key(sha256.New, mk, salt, info, size)
 		if err != nil {
 			panic(err)
 		}
-		tokenCache.Store(token, block)
+		return bf
 	}
-	var iv [aes.BlockSize]byte
-	return cipher.NewCTR(block, iv[:])
+	keys := &sessionKeys{
+		auth: derive("fsgo/tcptunnel auth", sha256.Size),
+	}
+	if token == noToken {
+		return keys
+	}
+	streamKeyOf := func(info string) *streamKey {
+		bf := derive(info, 32+aes.BlockSize)
+		return &streamKey{
+			Key: bf[:32],
+			IV:  bf[32:],
+		}
+	}
+	keys.c2s = streamKeyOf("fsgo/tcptunnel c2s")
+	keys.s2c = streamKeyOf("fsgo/tcptunnel s2c")
+	return keys
 }
 
-func rwWithToken(rw io.ReadWriteCloser, token string) io.ReadWriteCloser {
-	if token == "no" {
+func newStream(sk *streamKey) cipher.Stream {
+	block, err := aes.NewCipher(sk.Key)
+	if err != nil {
+		panic(err)
+	}
+	return cipher.NewCTR(block, sk.IV)
+}
+
+// rwWithKeys 使用 wk 加密写入的数据，使用 rk 解密读取的数据，
+// 若密钥为 nil（Token 为 "no"）则直接返回 rw
+func rwWithKeys(rw io.ReadWriteCloser, cipherID byte, wk *streamKey, rk *streamKey) io.ReadWriteCloser {
+	if wk == nil || rk == nil {
 		return rw
 	}
+	if cipherID != cipherAESCTR {
+		return newAEADConn(rw, cipherID, wk, rk)
+	}
 	writer := &cipher.StreamWriter{
-		S: newStream(token),
+		S: newStream(wk),
 		W: rw,
 	}
 	reader := &cipher.StreamReader{
-		S: newStream(token),
+		S: newStream(rk),
 		R: rw,
 	}
 
@@ -12,11 +12,15 @@ import (
 	"github.com/xanygo/anygo/xt"
 )
 
-func Test_rwWithToken(t *testing.T) {
+func Test_rwWithKeys(t *testing.T) {
+	var cn, sn [nonceSize]byte
+	cn[0] = 1
+	sn[0] = 2
 	t.Run("no", func(t *testing.T) {
 		bf := &bytes.Buffer{}
 		b1 := &tb{bf: bf}
-		w1 := rwWithToken(b1, "no")
+		keys := deriveKeys(noToken, cn, sn)
+		w1 := rwWithKeys(b1, cipherAESCTR, keys.c2s, keys.s2c)
 		_, e1 := w1.Write([]byte("hello"))
 		xt.NoError(t, e1)
 		xt.Equal(t, "hello", bf.String())
@@ -26,19 +30,31 @@ func Test_rwWithToken(t *testing.T) {
 	t.Run("has", func(t *testing.T) {
 		bf := &bytes.Buffer{}
 		b1 := &tb{bf: bf}
-		w1 := rwWithToken(b1, "hello-world")
+		keys := deriveKeys("hello-world", cn, sn)
+		w1 := rwWithKeys(b1, cipherAESCTR, keys.c2s, keys.s2c)
 		_, e1 := w1.Write([]byte("hello"))
 		xt.NoError(t, e1)
 		xt.NotEqual(t, "hello", bf.String())
-		content, _ := io.ReadAll(w1)
+
+		// 读写方向的密钥不同，用 c2s 的密钥才能解开
+		r1 := rwWithKeys(b1, cipherAESCTR, keys.s2c, keys.c2s)
+		content, _ := io.ReadAll(r1)
 		xt.Equal(t, "hello", string(content))
 	})
+	t.Run("nonce", func(t *testing.T) {
+		k1 := deriveKeys("hello-world", cn, sn)
+		sn[1] = 1
+		k2 := deriveKeys("hello-world", cn, sn)
+		xt.NotEqual(t, k1.c2s.Key, k2.c2s.Key)
+		xt.NotEqual(t, k1.c2s.Key, k1.s2c.Key)
+	})
 }
 
 var _ io.ReadWriteCloser = (*tb)(nil)
 
 type tb struct {
-	bf *bytes.Buffer
+	bf     *bytes.Buffer
+	closed bool
 }
 
 func (t *tb) Read(p []byte) (n int, err error) {
@@ -50,5 +66,6 @@ func (t *tb) Write(p []byte) (n int, err error) {
 }
 
 func (t *tb) Close() error {
+	t.closed = true
 	return nil
 }
@@ -0,0 +1,394 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config 配置文件，可以同时包含多个 server 和 client，格式为 JSON
+//
+// 字段名和命令行参数相同，如：
+//
+//	{
+//	  "servers": [
+//	    {"name": "web", "in": ":8090", "out": ":8100", "token": "xxx", "services": "ssh=:8022"}
+//	  ],
+//	  "clients": [
+//	    {"name": "web", "remote": "1.2.3.4:8090", "local": "127.0.0.1:8080", "token": "xxx"}
+//	  ]
+//	}
+type Config struct {
+	Servers []*ServerConfig `json:"servers"`
+	Clients []*ClientConfig `json:"clients"`
+}
+
+// ServerConfig 配置文件中的一个 server，字段含义见 Server
+type ServerConfig struct {
+	// Name 名称，可选，用于日志和错误信息，不能重复
+	Name string `json:"name"`
+
+	ListenOut           string   `json:"out"`
+	ListenClient        string   `json:"in"`
+	Services            string   `json:"services"` // 格式同命令行参数，如 web=:8100,dns=udp://:8053
+	Token               string   `json:"token"`
+	AllowPorts          string   `json:"allow-ports"`
+	Tokens              string   `json:"tokens"` // 格式同命令行参数，如 token1:20000-20100;token2:30000
+	RemoteHost          string   `json:"remote-host"`
+	AllowTargets        string   `json:"allow-targets"`
+	Cipher              string   `json:"cipher"`
+	TLSCertFile         string   `json:"tls-cert"`
+	TLSKeyFile          string   `json:"tls-key"`
+	TLSClientCAFile     string   `json:"tls-client-ca"`
+	Balance             string   `json:"balance"`
+	UDPIdleTimeout      Duration `json:"udp-idle"`
+	IdleTimeout         Duration `json:"idle-timeout"`
+	AcceptProxyProtocol bool     `json:"accept-proxy-protocol"`
+	TrustedProxies      string   `json:"trusted-proxies"`
+	OutAllow            string   `json:"out-allow"`
+	OutDeny             string   `json:"out-deny"`
+	ClientAllow         string   `json:"client-allow"`
+	ClientDeny          string   `json:"client-deny"`
+	Bandwidth           int      `json:"bandwidth"`
+	ServiceBandwidth    int      `json:"service-bandwidth"`
+	IPBandwidth         int      `json:"ip-bandwidth"`
+	MaxStreams          int      `json:"max-streams"`
+	StreamRate          float64  `json:"stream-rate"`
+	LimitWait           Duration `json:"limit-wait"`
+	AccessLog           string   `json:"access-log"`
+	AccessLogFormat     string   `json:"access-log-format"`
+	AccessLogRotate     string   `json:"access-log-rotate"`
+	AccessLogMaxFiles   int      `json:"access-log-max-files"`
+	MetricsAddr         string   `json:"metrics"`
+	AdminAddr           string   `json:"admin"`
+	AdminToken          string   `json:"admin-token"`
+}
+
+// ClientConfig 配置文件中的一个 client，字段含义见 Client
+type ClientConfig struct {
+	// Name 名称，可选，用于日志和错误信息，不能重复
+	Name string `json:"name"`
+
+	ServerAddr          string   `json:"remote"`
+	LocalAddr           string   `json:"local"`
+	RemotePort          int      `json:"remote-port"`
+	Services            string   `json:"services"` // 格式同命令行参数，如 web=127.0.0.1:8080,ssh=127.0.0.1:22@2222
+	Forwards            string   `json:"forwards"` // 格式同命令行参数，如 127.0.0.1:13306=10.0.0.5:3306
+	ClientID            string   `json:"id"`
+	Worker              int      `json:"worker"`
+	ConnectTimeout      Duration `json:"connect-timeout"`
+	IdleTimeout         Duration `json:"idle-timeout"`
+	UDPIdleTimeout      Duration `json:"udp-idle"`
+	HeartbeatInterval   Duration `json:"heartbeat"`
+	HeartbeatMisses     int      `json:"heartbeat-misses"`
+	BackoffInitial      Duration `json:"backoff-initial"`
+	BackoffMax          Duration `json:"backoff-max"`
+	BackoffMultiplier   float64  `json:"backoff-multiplier"`
+	LocalBalance        string   `json:"local-balance"`
+	HealthCheckInterval Duration `json:"health-check"`
+	HealthCheckFails    int      `json:"health-check-fails"`
+	ProxyProtocol       string   `json:"proxy-protocol"`
+	LocalPool           int      `json:"local-pool"`
+	LocalPoolIdle       Duration `json:"local-pool-idle"`
+	LocalDialAttempts   int      `json:"local-dial-attempts"`
+	Token               string   `json:"token"`
+	Cipher              string   `json:"cipher"`
+	TLS                 bool     `json:"tls"`
+	TLSCAFile           string   `json:"tls-ca"`
+	TLSServerName       string   `json:"tls-server-name"`
+	TLSCertFile         string   `json:"tls-cert"`
+	TLSKeyFile          string   `json:"tls-key"`
+	TLSPinSHA256        string   `json:"tls-pin"`
+	MetricsAddr         string   `json:"metrics"`
+}
+
+// Duration 配置文件中的时长，格式如 "30s"、"1m"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("invalid duration %s, expect string like \"30s\"", b)
+	}
+	v, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig 读取并解析配置文件，会校验所有的 server 和 client 的配置
+func LoadConfig(fileName string) (*Config, error) {
+	bf, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ParseConfig(bf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig 解析 JSON 格式的配置，会校验所有的 server 和 client 的配置
+func ParseConfig(bf []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(bf))
+	dec.DisallowUnknownFields()
+	cfg := &Config{}
+	if err := dec.Decode(cfg); err != nil {
+		return nil, jsonError(bf, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// jsonError 为 JSON 解析错误补充行号和列号
+func jsonError(bf []byte, err error) error {
+	var offset int64
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &se):
+		offset = se.Offset
+	case errors.As(err, &te):
+		offset = te.Offset
+	default:
+		return err
+	}
+	// Offset 为已经读取的字节数，出错的字符是最后读取的一个
+	pos := max(min(offset, int64(len(bf)))-1, 0)
+	line := 1 + bytes.Count(bf[:pos], []byte("\n"))
+	col := pos - int64(bytes.LastIndexByte(bf[:pos], '\n'))
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
+// Validate 校验配置，错误信息中会包含出错的 server 或 client
+func (c *Config) Validate() error {
+	if len(c.Servers) == 0 && len(c.Clients) == 0 {
+		return errors.New("no servers or clients")
+	}
+	names := make(map[string]bool)
+	listens := make(map[string]string) // 监听地址 -> 使用者
+	checkListen := func(owner string, addrs ...string) error {
+		for _, addr := range addrs {
+			if addr == "" {
+				continue
+			}
+			if other, has := listens[addr]; has {
+				return fmt.Errorf("%s: listen addr %q is already used by %s", owner, addr, other)
+			}
+			listens[addr] = owner
+		}
+		return nil
+	}
+	for i, sc := range c.Servers {
+		owner := itemName("servers", i, sc.Name)
+		if err := checkName(names, "server", sc.Name); err != nil {
+			return fmt.Errorf("%s: %w", owner, err)
+		}
+		s, err := sc.NewServer()
+		if err == nil {
+			err = s.init()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", owner, err)
+		}
+		addrs := []string{s.ListenClient, s.MetricsAddr, s.AdminAddr}
+		for _, svc := range s.outs {
+			addrs = append(addrs, joinNetwork(svc.Network, svc.Listen))
+		}
+		if err = checkListen(owner, addrs...); err != nil {
+			return err
+		}
+	}
+	for i, cc := range c.Clients {
+		owner := itemName("clients", i, cc.Name)
+		if err := checkName(names, "client", cc.Name); err != nil {
+			return fmt.Errorf("%s: %w", owner, err)
+		}
+		cl, err := cc.NewClient()
+		if err == nil {
+			err = cl.init()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", owner, err)
+		}
+		addrs := []string{cl.MetricsAddr}
+		for _, fw := range cl.Forwards {
+			addrs = append(addrs, fw.Listen)
+		}
+		if err = checkListen(owner, addrs...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewServers 使用配置创建所有的 Server，日志会添加 tunnel 属性，值为 server 的名称
+func (c *Config) NewServers(logger *slog.Logger) ([]*Server, error) {
+	result := make([]*Server, 0, len(c.Servers))
+	for i, sc := range c.Servers {
+		s, err := sc.NewServer()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", itemName("servers", i, sc.Name), err)
+		}
+		s.Name = tunnelName(i, sc.Name)
+		s.Logger = getLogger(logger).With("tunnel", s.Name)
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// NewClients 使用配置创建所有的 Client，日志会添加 tunnel 属性，值为 client 的名称
+func (c *Config) NewClients(logger *slog.Logger) ([]*Client, error) {
+	result := make([]*Client, 0, len(c.Clients))
+	for i, cc := range c.Clients {
+		cl, err := cc.NewClient()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", itemName("clients", i, cc.Name), err)
+		}
+		cl.Logger = getLogger(logger).With("tunnel", tunnelName(i, cc.Name))
+		result = append(result, cl)
+	}
+	return result, nil
+}
+
+func tunnelName(index int, name string) string {
+	if name != "" {
+		return name
+	}
+	return strconv.Itoa(index)
+}
+
+func itemName(kind string, index int, name string) string {
+	str := kind + "[" + strconv.Itoa(index) + "]"
+	if name != "" {
+		str += " " + strconv.Quote(name)
+	}
+	return str
+}
+
+func checkName(names map[string]bool, kind string, name string) error {
+	if name == "" {
+		return nil
+	}
+	key := kind + "/" + name
+	if names[key] {
+		return fmt.Errorf("duplicate %s name", kind)
+	}
+	names[key] = true
+	return nil
+}
+
+// NewServer 使用配置创建 Server
+func (sc *ServerConfig) NewServer() (*Server, error) {
+	s := &Server{
+		ListenOut:           sc.ListenOut,
+		ListenClient:        sc.ListenClient,
+		Token:               sc.Token,
+		AllowPorts:          sc.AllowPorts,
+		RemoteHost:          sc.RemoteHost,
+		AllowTargets:        sc.AllowTargets,
+		Cipher:              sc.Cipher,
+		TLSCertFile:         sc.TLSCertFile,
+		TLSKeyFile:          sc.TLSKeyFile,
+		TLSClientCAFile:     sc.TLSClientCAFile,
+		Balance:             sc.Balance,
+		UDPIdleTimeout:      time.Duration(sc.UDPIdleTimeout),
+		IdleTimeout:         time.Duration(sc.IdleTimeout),
+		AcceptProxyProtocol: sc.AcceptProxyProtocol,
+		TrustedProxies:      sc.TrustedProxies,
+		OutAllow:            sc.OutAllow,
+		OutDeny:             sc.OutDeny,
+		ClientAllow:         sc.ClientAllow,
+		ClientDeny:          sc.ClientDeny,
+		Bandwidth:           sc.Bandwidth,
+		ServiceBandwidth:    sc.ServiceBandwidth,
+		IPBandwidth:         sc.IPBandwidth,
+		MaxStreams:          sc.MaxStreams,
+		StreamRate:          sc.StreamRate,
+		LimitWait:           time.Duration(sc.LimitWait),
+		AccessLog:           sc.AccessLog,
+		AccessLogFormat:     sc.AccessLogFormat,
+		AccessLogRotate:     sc.AccessLogRotate,
+		AccessLogMaxFiles:   sc.AccessLogMaxFiles,
+		MetricsAddr:         sc.MetricsAddr,
+		AdminAddr:           sc.AdminAddr,
+		AdminToken:          sc.AdminToken,
+	}
+	if s.Token == "" {
+		s.Token = defaultToken
+	}
+	if err := s.Services.Set(sc.Services); err != nil {
+		return nil, fmt.Errorf("invalid services: %w", err)
+	}
+	if sc.Tokens != "" {
+		if err := s.Tokens.Set(sc.Tokens); err != nil {
+			return nil, fmt.Errorf("invalid tokens: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// NewClient 使用配置创建 Client
+func (cc *ClientConfig) NewClient() (*Client, error) {
+	c := &Client{
+		ServerAddr:        cc.ServerAddr,
+		LocalAddr:         cc.LocalAddr,
+		RemotePort:        cc.RemotePort,
+		ClientID:          cc.ClientID,
+		Worker:            cc.Worker,
+		ConnectTimeout:    time.Duration(cc.ConnectTimeout),
+		IdleTimeout:       time.Duration(cc.IdleTimeout),
+		UDPIdleTimeout:    time.Duration(cc.UDPIdleTimeout),
+		HeartbeatInterval: time.Duration(cc.HeartbeatInterval),
+		HeartbeatMisses:   cc.HeartbeatMisses,
+		Backoff: Backoff{
+			Initial:    time.Duration(cc.BackoffInitial),
+			Max:        time.Duration(cc.BackoffMax),
+			Multiplier: cc.BackoffMultiplier,
+		},
+		LocalBalance:        cc.LocalBalance,
+		HealthCheckInterval: time.Duration(cc.HealthCheckInterval),
+		HealthCheckFails:    cc.HealthCheckFails,
+		ProxyProtocol:       cc.ProxyProtocol,
+		LocalPool:           cc.LocalPool,
+		LocalPoolIdle:       time.Duration(cc.LocalPoolIdle),
+		LocalDialAttempts:   cc.LocalDialAttempts,
+		Token:               cc.Token,
+		Cipher:              cc.Cipher,
+		TLS:                 cc.TLS,
+		TLSCAFile:           cc.TLSCAFile,
+		TLSServerName:       cc.TLSServerName,
+		TLSCertFile:         cc.TLSCertFile,
+		TLSKeyFile:          cc.TLSKeyFile,
+		TLSPinSHA256:        cc.TLSPinSHA256,
+		MetricsAddr:         cc.MetricsAddr,
+	}
+	if c.Token == "" {
+		c.Token = defaultToken
+	}
+	if err := c.Services.Set(cc.Services); err != nil {
+		return nil, fmt.Errorf("invalid services: %w", err)
+	}
+	if err := c.Forwards.Set(cc.Forwards); err != nil {
+		return nil, fmt.Errorf("invalid forwards: %w", err)
+	}
+	return c, nil
+}
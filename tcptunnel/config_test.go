@@ -0,0 +1,170 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestParseConfig(t *testing.T) {
+	t.Run("ok", func(t *testing.T) {
+		cfg, err := ParseConfig([]byte(`{
+  "servers": [
+    {"name": "a", "in": ":8090", "out": ":8100", "services": "dns=udp://:8053", "udp-idle": "30s", "tokens": "t1:20000-20010"}
+  ],
+  "clients": [
+    {"name": "a", "remote": "127.0.0.1:8090", "services": "web=127.0.0.1:8080@any", "connect-timeout": "3s", "heartbeat": "-1s", "udp-idle": "2m"}
+  ]
+}`))
+		xt.NoError(t, err)
+		servers, err := cfg.NewServers(nil)
+		xt.NoError(t, err)
+		xt.Len(t, servers, 1)
+		xt.Equal(t, 30*time.Second, servers[0].UDPIdleTimeout)
+		xt.Equal(t, networkUDP, servers[0].Services[0].Network)
+		xt.Equal(t, "20000-20010", servers[0].Tokens["t1"])
+		xt.Equal(t, defaultToken, servers[0].Token)
+
+		clients, err := cfg.NewClients(nil)
+		xt.NoError(t, err)
+		xt.Len(t, clients, 1)
+		xt.Equal(t, 3*time.Second, clients[0].ConnectTimeout)
+		xt.Equal(t, 2*time.Minute, clients[0].getUDPIdleTimeout())
+		xt.Equal(t, RemotePortAny, clients[0].Services[0].RemotePort)
+		xt.Equal(t, time.Duration(0), clients[0].getHeartbeatInterval())
+	})
+
+	errCases := []struct {
+		name string
+		cfg  string
+		want string
+	}{
+		{"empty", `{}`, "no servers or clients"},
+		{"syntax", "{\n  \"servers\": [\n    {\"in\": \":8090\",}\n  ]\n}", "line 3, column 20"},
+		{"unknown field", `{"servers": [{"in": ":8090", "listen": ":8100"}]}`, `unknown field "listen"`},
+		{"type", "{\"clients\": [\n{\"remote-port\": \"80\"}]}", "line 2, column"},
+		{"duration", `{"servers": [{"in": ":8090", "out": ":8100", "udp-idle": 30}]}`, "invalid duration 30"},
+		{"no in", `{"servers": [{"name": "a", "out": ":8100"}]}`, `servers[0] "a": ListenClient is required`},
+		{"services", `{"servers": [{"in": ":8090", "services": "web"}]}`, "servers[0]: invalid services"},
+		{"cipher", `{"clients": [{"remote": "x:1", "local": "y:1", "cipher": "des"}]}`, `clients[0]: unsupported cipher "des"`},
+		{"no remote", `{"clients": [{"local": "y:1"}]}`, "clients[0]: ServerAddr is required"},
+		{"backoff", `{"clients": [{"remote": "x:1", "local": "y:1", "backoff-multiplier": 0.5}]}`, "clients[0]: backoff multiplier"},
+		{"local-balance", `{"clients": [{"remote": "x:1", "local": "y:1|y:2", "local-balance": "hash"}]}`, `clients[0]: unsupported local balance "hash"`},
+		{"local weight", `{"clients": [{"remote": "x:1", "local": "y:1*0"}]}`, `clients[0]: service "": invalid weight of "y:1*0"`},
+		{"limits", `{"servers": [{"in": ":8090", "out": ":8100", "max-streams": -1}]}`, `servers[0]: bandwidth and connection limits must not be negative`},
+		{"access log", `{"servers": [{"in": ":8090", "out": ":8100", "access-log-format": "xml"}]}`, `servers[0]: unsupported access log format "xml"`},
+		{"acl", `{"servers": [{"in": ":8090", "out": ":8100", "out-allow": "10.0.0.0/33"}]}`, `servers[0]: invalid OutAllow or OutDeny: invalid CIDR "10.0.0.0/33"`},
+		{"trusted-proxies", `{"servers": [{"in": ":8090", "out": ":8100", "accept-proxy-protocol": true}]}`, `servers[0]: TrustedProxies is required`},
+		{"proxy-protocol", `{"clients": [{"remote": "x:1", "local": "y:1", "proxy-protocol": "v3"}]}`, `clients[0]: unsupported PROXY protocol version "v3"`},
+		{"local-pool", `{"clients": [{"remote": "x:1", "local": "y:1", "local-pool": -1}]}`, "clients[0]: LocalPool"},
+		{
+			"duplicate name",
+			`{"servers": [{"name": "a", "in": ":8090", "out": ":8100"}, {"name": "a", "in": ":8091", "out": ":8101"}]}`,
+			`servers[1] "a": duplicate server name`,
+		},
+		{
+			"duplicate listen",
+			`{"servers": [{"in": ":8090", "out": ":8100"}, {"name": "b", "in": ":8091", "out": ":8100"}]}`,
+			`servers[1] "b": listen addr ":8100" is already used by servers[0]`,
+		},
+		{
+			"duplicate forward",
+			`{"servers": [{"in": ":8090", "out": ":8100"}], "clients": [{"remote": "x:1", "forwards": ":8090=y:1"}]}`,
+			`clients[0]: listen addr ":8090" is already used by servers[0]`,
+		},
+	}
+	for _, tt := range errCases {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConfig([]byte(tt.cfg))
+			xt.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "tunnels.json")
+	xt.NoError(t, os.WriteFile(fp, []byte(`{"servers": [{"in": ":8090"}]}`), 0600))
+	_, err := LoadConfig(fp)
+	xt.Error(t, err)
+	xt.HasPrefix(t, err.Error(), fp+": servers[0]: no service to export")
+}
+
+func TestGroup(t *testing.T) {
+	type tunnel struct {
+		in, out, local string
+	}
+	tunnels := make([]tunnel, 2)
+	var servers, clients []string
+	for i := range tunnels {
+		tn := tunnel{in: freeAddr(t), out: freeAddr(t), local: startNamedServer(t, fmt.Sprint(i))}
+		tunnels[i] = tn
+		token := fmt.Sprintf("token-%d", i)
+		servers = append(servers, fmt.Sprintf(`{"name": "s%d", "in": %q, "out": %q, "token": %q}`, i, tn.in, tn.out, token))
+		clients = append(clients, fmt.Sprintf(`{"name": "c%d", "remote": %q, "local": %q, "token": %q}`, i, tn.in, tn.local, token))
+	}
+	cfg, err := ParseConfig([]byte(`{"servers": [` + strings.Join(servers, ",") + `], "clients": [` + strings.Join(clients, ",") + `]}`))
+	xt.NoError(t, err)
+	ss, err := cfg.NewServers(nil)
+	xt.NoError(t, err)
+	cs, err := cfg.NewClients(nil)
+	xt.NoError(t, err)
+	var runners []Runner
+	for _, s := range ss {
+		runners = append(runners, s)
+	}
+	for _, c := range cs {
+		runners = append(runners, c)
+	}
+	g := NewGroup(runners...)
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Start(t.Context())
+	}()
+	for _, s := range ss {
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+	}
+	for i, tn := range tunnels {
+		conn, err := net.Dial("tcp", tn.out)
+		xt.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		bf := make([]byte, 1)
+		_, err = conn.Read(bf)
+		xt.NoError(t, err)
+		xt.Equal(t, fmt.Sprint(i), string(bf))
+		_ = conn.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	xt.NoError(t, g.Shutdown(ctx))
+	select {
+	case err = <-done:
+		xt.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("group not stopped")
+	}
+}
+
+func TestGroupError(t *testing.T) {
+	s := &Server{ListenOut: freeAddr(t), ListenClient: freeAddr(t)}
+	// 监听地址已被占用，启动失败，会停止其他的 Runner
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	defer l.Close()
+	bad := &Server{ListenOut: l.Addr().String(), ListenClient: freeAddr(t)}
+	err = NewGroup(s, bad).Start(t.Context())
+	xt.ErrorContains(t, err, "address already in use")
+}
@@ -0,0 +1,251 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+	"github.com/xanygo/anygo/xnet"
+	"github.com/xanygo/anygo/xnet/xrps"
+
+	"github.com/fsgo/networks/internal"
+)
+
+// ClientForward 正向隧道：client 在本地监听，连接通过 server 转发到 server 侧的目标地址，类似 ssh -L
+type ClientForward struct {
+	// Listen client 本地的监听地址，必填，如 127.0.0.1:13306
+	Listen string
+
+	// Target server 侧的目标地址，必填，如 10.0.0.5:3306，需要在 server 的 AllowTargets 中
+	Target string
+}
+
+var _ flag.Value = (*ClientForwards)(nil)
+
+// ClientForwards 多个正向隧道，可以作为 flag 使用，格式如 127.0.0.1:13306=10.0.0.5:3306,:8022=10.0.0.6:22
+type ClientForwards []*ClientForward
+
+func (cf *ClientForwards) Set(str string) error {
+	items, err := parseNameAddrs(str)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		*cf = append(*cf, &ClientForward{Listen: item[0], Target: item[1]})
+	}
+	return nil
+}
+
+func (cf *ClientForwards) String() string {
+	if cf == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*cf))
+	for _, f := range *cf {
+		items = append(items, f.Listen+"="+f.Target)
+	}
+	return strings.Join(items, ",")
+}
+
+// startForward 在本地监听，并将连接转发给 server
+func (c *Client) startForward(tl *Tunneler, fw *ClientForward) error {
+	c.logger().Info("listen forward", "addr", fw.Listen, "target", fw.Target)
+	l, err := net.Listen("tcp", fw.Listen)
+	if err != nil {
+		return err
+	}
+	if !c.lc.addCloser(l) {
+		return nil
+	}
+	meta := (&StreamMeta{Target: fw.Target}).encode()
+	var connID atomic.Int64
+	fs := &xrps.AnyServer{
+		Handler: xrps.HandleFunc(func(ctx context.Context, conn net.Conn) {
+			id := connID.Add(1)
+			c.forwardHandler(ctx, tl, conn, id, fw, meta)
+		}),
+	}
+	return fs.Serve(l)
+}
+
+func (c *Client) forwardHandler(ctx context.Context, tl *Tunneler, conn net.Conn, id int64, fw *ClientForward, meta []byte) {
+	defer conn.Close()
+	c.cntForwardNow.Add(1)
+	defer c.cntForwardNow.Add(-1)
+	logger := c.logger().With(slog.String("kind", "forward"), slog.String("target", fw.Target),
+		slog.Int64(logKeyConnID, id), remoteAttr(conn))
+	logger.Debug("conn accepted")
+	start := time.Now()
+
+	var stream *xio.MuxStream
+	var err error
+	for i := 0; i < 10; i++ {
+		stream, err = tl.Open(meta)
+		if err == nil {
+			break
+		}
+		logger.Warn("open stream failed", errAttr(err), "try", i)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	if stream != nil {
+		logger = logger.With(sidAttr(stream.ID()))
+		logger.Debug("start RWCopy")
+		cc := &countRW{ReadWriteCloser: conn}
+		streamStart := time.Now()
+		err = internal.RWCopy(newHalfStream(stream), cc, c.IdleTimeout).Err()
+		c.getMetrics().stream.observe(streamStart, &cc.byteCounter)
+	}
+	logger.Debug("conn closed", errAttr(err), costAttr(start))
+}
+
+// targetRule 正向隧道允许访问的目标地址规则
+type targetRule struct {
+	host   string       // 域名或者 IP，* 表示任意 host
+	prefix netip.Prefix // host 为 CIDR 时有效，只匹配 IP 格式的目标地址
+	ports  portRanges   // 为空表示任意端口
+}
+
+// targetRules 多个目标地址规则，格式如 10.0.0.0/8:3306,db.internal:*,127.0.0.1:8000-8100
+type targetRules []*targetRule
+
+func parseTargetRules(str string) (targetRules, error) {
+	var result targetRules
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, ports, err := net.SplitHostPort(item)
+		if err != nil || host == "" || ports == "" {
+			return nil, fmt.Errorf("invalid target rule %q, expect host:port", item)
+		}
+		rule := &targetRule{host: host}
+		if strings.Contains(host, "/") {
+			if rule.prefix, err = netip.ParsePrefix(host); err != nil {
+				return nil, fmt.Errorf("invalid target rule %q: %w", item, err)
+			}
+		}
+		if ports != "*" {
+			if rule.ports, err = parsePortRanges(ports); err != nil {
+				return nil, fmt.Errorf("invalid target rule %q: %w", item, err)
+			}
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func (r *targetRule) match(host string, port int) bool {
+	if len(r.ports) > 0 && !r.ports.contains(port) {
+		return false
+	}
+	switch {
+	case r.host == "*":
+		return true
+	case r.prefix.IsValid():
+		ip, err := netip.ParseAddr(host)
+		return err == nil && r.prefix.Contains(ip.Unmap())
+	default:
+		return strings.EqualFold(r.host, host)
+	}
+}
+
+var errTargetNotAllowed = errors.New("target not allowed")
+
+// check 校验目标地址是否被允许
+func (rs targetRules) check(target string) error {
+	host, ps, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(ps)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", ps)
+	}
+	for _, r := range rs {
+		if r.match(host, port) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", errTargetNotAllowed, target)
+}
+
+// acceptStreams 接受 client 发起的正向隧道 stream，直到连接断开
+func (s *Server) acceptStreams(cm *clientMux) {
+	for {
+		stream, err := cm.mux.Accept()
+		if err != nil {
+			return
+		}
+		if isPingStream(stream) {
+			// 停止中也需要回复心跳，否则 client 会断开还有活跃 stream 的连接
+			go s.pingHandler(cm, stream)
+			continue
+		}
+		if s.lc.isClosing() {
+			// 停止中，不再接受新的 stream
+			_ = stream.Close()
+			continue
+		}
+		go s.forwardHandler(cm, stream)
+	}
+}
+
+func (s *Server) forwardHandler(cm *clientMux, stream *xio.MuxStream) {
+	defer stream.Close()
+	s.cntForwardNow.Add(1)
+	s.cntForwardTotal.Add(1)
+	defer s.cntForwardNow.Add(-1)
+
+	logger := s.logger().With(slog.String("kind", "forward"), slog.Int64(logKeyClient, cm.id), sidAttr(stream.ID()))
+	meta, err := decodeStreamMeta(stream.Hello())
+	if err == nil && meta.Target == "" {
+		err = errors.New("empty target")
+	}
+	if err == nil {
+		err = s.targets.check(meta.Target)
+	}
+	if err != nil {
+		logger.Warn("stream rejected", errAttr(err))
+		return
+	}
+	logger = logger.With(slog.String("target", meta.Target))
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	conn, err := xnet.DialContext(ctx, "tcp", meta.Target)
+	cancel()
+	if err != nil {
+		logger.Warn("dial failed", errAttr(err))
+		return
+	}
+	logger.Debug("start RWCopy")
+	cc := &countRW{ReadWriteCloser: conn}
+	streamStart := time.Now()
+	cm.addStream(stream, &streamInfo{
+		meta:  meta,
+		peer:  cm.remote,
+		since: streamStart,
+		bytes: &cc.byteCounter,
+	})
+	err = internal.RWCopy(newHalfStream(stream), cc, s.IdleTimeout).Err()
+	cm.removeStream(stream)
+	s.getMetrics().stream.observe(streamStart, &cc.byteCounter)
+	logger.Debug("stream closed", errAttr(err), costAttr(start))
+}
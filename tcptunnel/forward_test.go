@@ -0,0 +1,75 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestClientForwards(t *testing.T) {
+	var cf ClientForwards
+	xt.NoError(t, cf.Set("127.0.0.1:13306=10.0.0.5:3306,:8022=10.0.0.6:22"))
+	xt.Equal(t, 2, len(cf))
+	xt.Equal(t, ":8022", cf[1].Listen)
+	xt.Equal(t, "10.0.0.6:22", cf[1].Target)
+	xt.Equal(t, "127.0.0.1:13306=10.0.0.5:3306,:8022=10.0.0.6:22", cf.String())
+	xt.Error(t, cf.Set("127.0.0.1:13306"))
+
+	c := &Client{Forwards: cf}
+	xt.NoError(t, c.initServices())
+}
+
+func Test_targetRules(t *testing.T) {
+	rs, err := parseTargetRules("10.0.0.0/8:3306, db.internal:*, 127.0.0.1:8000-8100, *:22")
+	xt.NoError(t, err)
+	xt.Equal(t, 4, len(rs))
+
+	for _, target := range []string{"10.1.2.3:3306", "DB.internal:6379", "127.0.0.1:8080", "example.com:22", "[::ffff:10.0.0.1]:3306"} {
+		xt.NoError(t, rs.check(target))
+	}
+	for _, target := range []string{"10.1.2.3:3307", "11.0.0.1:3306", "db.internal.evil:80", "127.0.0.1:9000", "example.com", "localhost:80"} {
+		xt.Error(t, rs.check(target))
+	}
+
+	for _, str := range []string{"10.0.0.0", "10.0.0.0/33:80", "host:abc", ":80"} {
+		_, err = parseTargetRules(str)
+		xt.Error(t, err)
+	}
+
+	rs, err = parseTargetRules("")
+	xt.NoError(t, err)
+	xt.ErrorIs(t, rs.check("127.0.0.1:80"), errTargetNotAllowed)
+}
+
+func Test_tunnelForward(t *testing.T) {
+	target := startEchoServer(t)
+	s := &Server{AllowTargets: target}
+	c := &Client{
+		Forwards: ClientForwards{
+			{Listen: freeAddr(t), Target: target},
+			{Listen: freeAddr(t), Target: startEchoServer(t)}, // 不在 AllowTargets 中
+		},
+	}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	for i := 0; i < 3; i++ {
+		xt.NoError(t, echoOnce(c.Forwards[0].Listen, "hello"))
+	}
+	xt.Equal(t, int64(3), s.cntForwardTotal.Load())
+
+	conn, err := net.Dial("tcp", c.Forwards[1].Listen)
+	xt.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	xt.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,75 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Runner 可以启动和优雅关闭的服务，Server、Client 和 Tunneler 都实现了此接口
+type Runner interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+var _ Runner = (*Server)(nil)
+var _ Runner = (*Client)(nil)
+var _ Runner = (*Tunneler)(nil)
+
+// NewGroup 创建一个 Group
+func NewGroup(items ...Runner) *Group {
+	return &Group{items: items}
+}
+
+// Group 在一个进程内同时运行多个 Runner
+type Group struct {
+	items   []Runner
+	closing atomic.Bool
+}
+
+// Start 启动所有的 Runner，会一直运行直到 ctx 被取消、调用了 Shutdown 或者任意一个 Runner 出错
+// 任意一个 Runner 出错时，会停止其他的 Runner，并返回第一个错误
+func (g *Group) Start(ctx context.Context) error {
+	if len(g.items) == 0 {
+		return errors.New("no runner in group")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(g.items))
+	for _, item := range g.items {
+		go func() {
+			errs <- item.Start(ctx)
+		}()
+	}
+	var first error
+	for range g.items {
+		err := <-errs
+		if err != nil && first == nil {
+			first = err
+		}
+		// Shutdown 时，每个 Runner 各自等待处理中的连接结束，不需要强制停止其他的
+		if err != nil || !g.closing.Load() {
+			cancel()
+		}
+	}
+	return first
+}
+
+// Shutdown 同时优雅关闭所有的 Runner
+func (g *Group) Shutdown(ctx context.Context) error {
+	g.closing.Store(true)
+	errs := make([]error, len(g.items))
+	var wg sync.WaitGroup
+	for i, item := range g.items {
+		wg.Go(func() {
+			errs[i] = item.Shutdown(ctx)
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,180 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+)
+
+// halfStream 中帧的类型
+const (
+	frameData byte = iota // 数据，之后是 4 字节长度和数据
+	frameFIN              // 不再发送数据，即 CloseWrite
+	frameACK              // 已经读取到对端的 FIN
+)
+
+// halfCloseLinger 关闭 halfStream 时，最多等待对端确认 FIN 的时间
+const halfCloseLinger = 5 * time.Second
+
+var (
+	errWriteClosed = errors.New("stream write closed")
+	errStreamReset = errors.New("stream closed before FIN")
+)
+
+// halfStream 在 stream 上使用帧传递半关闭：
+// Mux 的 stream 只能整体关闭，并且关闭时对端还未读取的数据会丢失，
+// 所以一端调用 CloseWrite 时发送 FIN，对端读取到 FIN 后回复 ACK，
+// 双方都读取到对端的 FIN，并且自己的 FIN 被确认后，才真正关闭 stream
+type halfStream struct {
+	stream *xio.MuxStream
+
+	remain  int         // 当前数据帧还未读取的长度
+	finRecv atomic.Bool // 已读取到对端的 FIN
+	header  [5]byte
+
+	wmu     sync.Mutex
+	finSent bool
+	wheader [5]byte
+
+	ackOnce sync.Once
+	acked   chan struct{} // 对端已确认 FIN
+}
+
+// wrapStream halfClose 为 true 时返回 halfStream，否则直接返回 stream
+// tcp 的 stream 都使用 halfStream，udp 的 stream 使用自己的帧格式
+func wrapStream(stream *xio.MuxStream, halfClose bool) io.ReadWriteCloser {
+	if halfClose {
+		return newHalfStream(stream)
+	}
+	return stream
+}
+
+func newHalfStream(stream *xio.MuxStream) *halfStream {
+	return &halfStream{
+		stream: stream,
+		acked:  make(chan struct{}),
+	}
+}
+
+func (h *halfStream) Read(p []byte) (int, error) {
+	for h.remain == 0 {
+		if h.finRecv.Load() {
+			return 0, io.EOF
+		}
+		if err := h.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := h.stream.Read(p[:min(len(p), h.remain)])
+	h.remain -= n
+	if err == io.EOF && h.remain > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// readFrame 读取一个帧头，数据帧的数据由 Read 读取
+func (h *halfStream) readFrame() error {
+	if _, err := io.ReadFull(h.stream, h.header[:1]); err != nil {
+		if err == io.EOF {
+			// 对端没有发送 FIN 就关闭了 stream，如出错或者强制关闭
+			return errStreamReset
+		}
+		return err
+	}
+	switch h.header[0] {
+	case frameData:
+		if _, err := io.ReadFull(h.stream, h.header[1:5]); err != nil {
+			return err
+		}
+		h.remain = int(binary.BigEndian.Uint32(h.header[1:5]))
+	case frameFIN:
+		h.finRecv.Store(true)
+		// 发送失败时 stream 已经不可用，不影响已读取的数据
+		_ = h.writeFrame(frameACK, nil)
+	case frameACK:
+		h.ackOnce.Do(func() {
+			close(h.acked)
+		})
+	default:
+		return fmt.Errorf("invalid stream frame type %d", h.header[0])
+	}
+	return nil
+}
+
+func (h *halfStream) writeFrame(tp byte, p []byte) error {
+	h.wmu.Lock()
+	defer h.wmu.Unlock()
+	if tp != frameACK && h.finSent {
+		return errWriteClosed
+	}
+	header := h.wheader[:1]
+	header[0] = tp
+	if tp == frameData {
+		header = binary.BigEndian.AppendUint32(header, uint32(len(p)))
+	}
+	if _, err := h.stream.Write(header); err != nil {
+		return err
+	}
+	if len(p) > 0 {
+		if _, err := h.stream.Write(p); err != nil {
+			return err
+		}
+	}
+	if tp == frameFIN {
+		h.finSent = true
+	}
+	return nil
+}
+
+func (h *halfStream) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := h.writeFrame(frameData, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite 发送 FIN，之后不能再写入数据
+func (h *halfStream) CloseWrite() error {
+	return h.writeFrame(frameFIN, nil)
+}
+
+// Close 双方都已经发送 FIN 时，等待对端确认后再关闭 stream，否则直接关闭
+func (h *halfStream) Close() error {
+	h.wmu.Lock()
+	finSent := h.finSent
+	h.wmu.Unlock()
+	if finSent && h.finRecv.Load() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			// 对端在 FIN 之后只会发送 ACK
+			for h.readFrame() == nil {
+				if h.remain > 0 {
+					return
+				}
+			}
+		}()
+		tm := time.NewTimer(halfCloseLinger)
+		defer tm.Stop()
+		select {
+		case <-h.acked:
+		case <-done:
+		case <-tm.C:
+		}
+	}
+	return h.stream.Close()
+}
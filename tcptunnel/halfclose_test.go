@@ -0,0 +1,160 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// startHandlerServer 启动一个本地服务，每个连接由 fn 处理，fn 返回后关闭连接
+func startHandlerServer(t testing.TB, fn func(conn *net.TCPConn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fn(conn.(*net.TCPConn))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// waitStreamsDone 等待 client 上的 stream 都结束，避免测试结束时关闭 Mux 影响还未结束的 stream
+func waitStreamsDone(t *testing.T, c *Client) {
+	t.Helper()
+	waitFor(t, func() bool {
+		tl := c.tl.Load()
+		return tl.cntStreamNow.Load() == 0 && c.cntForwardNow.Load() == 0
+	})
+}
+
+func dialTCP(t *testing.T, addr string) *net.TCPConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+func Test_tunnelHalfClose(t *testing.T) {
+	resp := bytes.Repeat([]byte("0123456789"), 100*1024)
+
+	t.Run("http1.0", func(t *testing.T) {
+		// 读取完整个请求后回复，然后立即关闭连接
+		local := startHandlerServer(t, func(conn *net.TCPConn) {
+			req, err := io.ReadAll(conn)
+			if err != nil || string(req) != "GET / HTTP/1.0\r\n\r\n" {
+				return
+			}
+			_, _ = conn.Write(resp)
+		})
+		s := &Server{}
+		c := &Client{LocalAddr: local}
+		startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		for range 5 {
+			conn := dialTCP(t, s.ListenOut)
+			_, err := conn.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+			xt.NoError(t, err)
+			xt.NoError(t, conn.CloseWrite())
+			got, err := io.ReadAll(conn)
+			xt.NoError(t, err)
+			xt.Equal(t, len(resp), len(got))
+			xt.True(t, bytes.Equal(resp, got))
+		}
+		waitStreamsDone(t, c)
+	})
+
+	t.Run("rsync", func(t *testing.T) {
+		// 双方同时发送数据，各自发送完后半关闭，并读取对端的全部数据
+		exchange := func(conn *net.TCPConn, data []byte) ([]byte, error) {
+			errc := make(chan error, 1)
+			go func() {
+				_, err := conn.Write(data)
+				if err == nil {
+					err = conn.CloseWrite()
+				}
+				errc <- err
+			}()
+			got, err := io.ReadAll(conn)
+			if err1 := <-errc; err == nil {
+				err = err1
+			}
+			return got, err
+		}
+		local := startHandlerServer(t, func(conn *net.TCPConn) {
+			_, _ = exchange(conn, resp[:len(resp)/2])
+		})
+		s := &Server{}
+		c := &Client{LocalAddr: local}
+		startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		conn := dialTCP(t, s.ListenOut)
+		got, err := exchange(conn, resp)
+		xt.NoError(t, err)
+		xt.True(t, bytes.Equal(resp[:len(resp)/2], got))
+		waitStreamsDone(t, c)
+	})
+
+	t.Run("forward", func(t *testing.T) {
+		target := startHandlerServer(t, func(conn *net.TCPConn) {
+			if _, err := io.ReadAll(conn); err == nil {
+				_, _ = conn.Write(resp)
+			}
+		})
+		s := &Server{AllowTargets: "127.0.0.1:*"}
+		c := &Client{Forwards: ClientForwards{{Listen: freeAddr(t), Target: target}}}
+		startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		conn := dialTCP(t, c.Forwards[0].Listen)
+		_, err := conn.Write([]byte("hello"))
+		xt.NoError(t, err)
+		xt.NoError(t, conn.CloseWrite())
+		got, err := io.ReadAll(conn)
+		xt.NoError(t, err)
+		xt.Equal(t, len(resp), len(got))
+		_ = conn.Close()
+		waitStreamsDone(t, c)
+	})
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	s := &Server{IdleTimeout: 100 * time.Millisecond}
+	startTestTunnel(t, s, &Client{})
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	conn := dialEcho(t, s.ListenOut)
+	defer conn.Close()
+	start := time.Now()
+	_, err := conn.Read(make([]byte, 1))
+	xt.Error(t, err)
+	xt.True(t, time.Since(start) < 2*time.Second)
+}
@@ -0,0 +1,260 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// protocolVersion 隧道协议版本号，握手时的第一个字节
+// 老版本协议没有版本号（可以视为版本 1），版本 2 只交换随机数派生会话密钥，
+// 版本 3 增加了 token 标识和双向的 HMAC 认证。不同版本的 client 和 server 无法互通，
+// 握手阶段即会报错
+const protocolVersion byte = 3
+
+// nonceSize 握手时双方各自生成的随机数的长度
+const nonceSize = 16
+
+// maxClockSkew client 和 server 之间允许的最大时钟偏差
+const maxClockSkew = 5 * time.Minute
+
+var (
+	errVersion   = errors.New("protocol version mismatch")
+	errCipher    = errors.New("cipher mismatch")
+	errAuth      = errors.New("token authentication failed")
+	errClockSkew = errors.New("client timestamp out of range")
+	errReplay    = errors.New("replayed client nonce")
+)
+
+// keyIDSize token 标识的长度
+const keyIDSize = 8
+
+// helloSize 握手消息的长度
+const helloSize = 2 + nonceSize + keyIDSize
+
+// hello 握手消息，格式：1 字节版本号 | 1 字节加密算法 | 16 字节随机数 | 8 字节 token 标识
+type hello struct {
+	Version byte
+	Cipher  byte
+	Nonce   [nonceSize]byte
+	KeyID   [keyIDSize]byte // client 使用的 token 的标识，server 据此找到对应的 token
+}
+
+func newHello(cipherID byte, kid [keyIDSize]byte) (*hello, error) {
+	h := &hello{
+		Version: protocolVersion,
+		Cipher:  cipherID,
+		KeyID:   kid,
+	}
+	if _, err := rand.Read(h.Nonce[:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *hello) writeTo(w io.Writer) error {
+	bf := make([]byte, 0, helloSize)
+	bf = append(bf, h.Version, h.Cipher)
+	bf = append(bf, h.Nonce[:]...)
+	bf = append(bf, h.KeyID[:]...)
+	_, err := w.Write(bf)
+	return err
+}
+
+func readHello(r io.Reader) (*hello, error) {
+	bf := make([]byte, helloSize)
+	if _, err := io.ReadFull(r, bf[:1]); err != nil {
+		return nil, err
+	}
+	return readHelloBody(r, bf)
+}
+
+// readHelloBody 读取 hello 版本号之后的内容，bf 的长度为 helloSize，第一个字节为已读取的版本号
+func readHelloBody(r io.Reader, bf []byte) (*hello, error) {
+	if _, err := io.ReadFull(r, bf[1:]); err != nil {
+		return nil, err
+	}
+	h := &hello{
+		Version: bf[0],
+		Cipher:  bf[1],
+	}
+	copy(h.Nonce[:], bf[2:2+nonceSize])
+	copy(h.KeyID[:], bf[2+nonceSize:])
+	return h, nil
+}
+
+// clientHandshake Client 侧的握手：
+//  1. 发送 client hello，读取 server hello，然后使用双方的随机数派生出本连接的会话密钥
+//  2. 发送 时间戳 和 HMAC(client, 双方随机数, 时间戳)，证明 client 知道 token
+//  3. 读取 server 的 HMAC(server, 双方随机数, 时间戳)，校验 server 也知道 token
+func clientHandshake(rw io.ReadWriteCloser, token string, cipherID byte) (io.ReadWriteCloser, error) {
+	ch, err := newHello(cipherID, keyID(token))
+	if err != nil {
+		return nil, err
+	}
+	if err = ch.writeTo(rw); err != nil {
+		return nil, fmt.Errorf("write client hello failed: %w", err)
+	}
+	sh, err := readHello(rw)
+	if err != nil {
+		return nil, fmt.Errorf("read server hello failed: %w", err)
+	}
+	if sh.Version != protocolVersion {
+		return nil, fmt.Errorf("%w: server=%d, client=%d", errVersion, sh.Version, protocolVersion)
+	}
+	if sh.Cipher != cipherID {
+		return nil, fmt.Errorf("%w: server=%s, client=%s", errCipher, cipherName(sh.Cipher), cipherName(cipherID))
+	}
+	keys := deriveKeys(token, ch.Nonce, sh.Nonce)
+	erw := rwWithKeys(rw, cipherID, keys.c2s, keys.s2c)
+
+	ts := time.Now().UnixMilli()
+	proof := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(proof, uint64(ts))
+	proof = append(proof, authMAC(keys.auth, "client", ch, sh, ts)...)
+	if _, err = erw.Write(proof); err != nil {
+		return nil, fmt.Errorf("write client proof failed: %w", err)
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(erw, mac); err != nil {
+		return nil, fmt.Errorf("read server proof failed: %w", err)
+	}
+	if !hmac.Equal(mac, authMAC(keys.auth, "server", ch, sh, ts)) {
+		return nil, fmt.Errorf("%w: invalid server proof", errAuth)
+	}
+	return erw, nil
+}
+
+// tokenLookup 通过 token 标识查找 token
+type tokenLookup func(kid [keyIDSize]byte) (token string, ok bool)
+
+// singleToken 只有一个 token 时的 tokenLookup
+func singleToken(token string) tokenLookup {
+	id := keyID(token)
+	return func(kid [keyIDSize]byte) (string, bool) {
+		return token, kid == id
+	}
+}
+
+// keyID 计算 token 的标识，由 token 的主密钥派生，不会泄露 token 本身
+func keyID(token string) [keyIDSize]byte {
+	m := hmac.New(sha256.New, masterKey(token))
+	m.Write([]byte("fsgo/tcptunnel key id"))
+	var id [keyIDSize]byte
+	copy(id[:], m.Sum(nil))
+	return id
+}
+
+// serverHandshake Server 侧的握手，和 clientHandshake 对应，返回握手成功的连接和 client 使用的 token
+// nonces 用于记录已经使用过的 client 随机数，可以为 nil
+func serverHandshake(rw io.ReadWriteCloser, lookup tokenLookup, cipherID byte, nonces *nonceCache) (io.ReadWriteCloser, string, error) {
+	bf := make([]byte, helloSize)
+	if _, err := io.ReadFull(rw, bf[:1]); err != nil {
+		return nil, "", fmt.Errorf("read client hello failed: %w", err)
+	}
+	if bf[0] != protocolVersion {
+		// 不同版本的 hello 长度不同，不再读取后续的内容，直接回复只有版本号的 server hello，
+		// 让对端立即知道版本不一致，而不是等到超时
+		_ = (&hello{Version: protocolVersion}).writeTo(rw)
+		return nil, "", fmt.Errorf("%w: client=%d, server=%d", errVersion, bf[0], protocolVersion)
+	}
+	ch, err := readHelloBody(rw, bf)
+	if err != nil {
+		return nil, "", fmt.Errorf("read client hello failed: %w", err)
+	}
+	sh, err := newHello(cipherID, ch.KeyID)
+	if err != nil {
+		return nil, "", err
+	}
+	// 即使加密算法不一致，也回复 server hello，让对端也能明确的知道原因
+	if err = sh.writeTo(rw); err != nil {
+		return nil, "", fmt.Errorf("write server hello failed: %w", err)
+	}
+	if ch.Cipher != cipherID {
+		return nil, "", fmt.Errorf("%w: client=%s, server=%s", errCipher, cipherName(ch.Cipher), cipherName(cipherID))
+	}
+	token, ok := lookup(ch.KeyID)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: unknown token", errAuth)
+	}
+	keys := deriveKeys(token, ch.Nonce, sh.Nonce)
+	erw := rwWithKeys(rw, cipherID, keys.s2c, keys.c2s)
+
+	proof := make([]byte, 8+sha256.Size)
+	if _, err = io.ReadFull(erw, proof); err != nil {
+		return nil, "", fmt.Errorf("read client proof failed: %w", err)
+	}
+	ts := int64(binary.BigEndian.Uint64(proof))
+	if !hmac.Equal(proof[8:], authMAC(keys.auth, "client", ch, sh, ts)) {
+		return nil, "", fmt.Errorf("%w: invalid client proof", errAuth)
+	}
+	if skew := time.Since(time.UnixMilli(ts)).Abs(); skew > maxClockSkew {
+		return nil, "", fmt.Errorf("%w: skew=%s", errClockSkew, skew)
+	}
+	if nonces != nil && !nonces.add(ch.Nonce) {
+		return nil, "", errReplay
+	}
+	if _, err = erw.Write(authMAC(keys.auth, "server", ch, sh, ts)); err != nil {
+		return nil, "", fmt.Errorf("write server proof failed: %w", err)
+	}
+	return erw, token, nil
+}
+
+// authMAC 计算握手时的 HMAC，role 用于区分 client 和 server，避免将对端的 HMAC 反射回去
+func authMAC(key []byte, role string, ch *hello, sh *hello, ts int64) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(role))
+	m.Write([]byte{ch.Version, ch.Cipher})
+	m.Write(ch.Nonce[:])
+	m.Write(ch.KeyID[:])
+	m.Write(sh.Nonce[:])
+	var bf [8]byte
+	binary.BigEndian.PutUint64(bf[:], uint64(ts))
+	m.Write(bf[:])
+	return m.Sum(nil)
+}
+
+// nonceCache 记录最近一段时间内已使用的 client 随机数
+type nonceCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	items   map[[nonceSize]byte]time.Time
+	cleanAt time.Time
+}
+
+func newNonceCache(ttl time.Duration) *nonceCache {
+	return &nonceCache{
+		ttl:   ttl,
+		items: make(map[[nonceSize]byte]time.Time),
+	}
+}
+
+// add 记录随机数，若该随机数已存在则返回 false
+func (nc *nonceCache) add(nonce [nonceSize]byte) bool {
+	now := time.Now()
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if now.Sub(nc.cleanAt) > nc.ttl/10 {
+		nc.cleanAt = now
+		for k, expire := range nc.items {
+			if now.After(expire) {
+				delete(nc.items, k)
+			}
+		}
+	}
+	if expire, has := nc.items[nonce]; has && now.Before(expire) {
+		return false
+	}
+	nc.items[nonce] = now.Add(nc.ttl)
+	return true
+}
@@ -0,0 +1,172 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// recordConn 记录写入底层连接的原始数据
+type recordConn struct {
+	net.Conn
+	written []byte
+}
+
+func (r *recordConn) Write(p []byte) (int, error) {
+	r.written = append(r.written, p...)
+	return r.Conn.Write(p)
+}
+
+func handshakePair(t *testing.T, clientToken, serverToken string) (c, s io.ReadWriteCloser, craw *recordConn, cerr, serr error) {
+	t.Helper()
+	c1, s1 := net.Pipe()
+	t.Cleanup(func() {
+		_ = c1.Close()
+		_ = s1.Close()
+	})
+	craw = &recordConn{Conn: c1}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s, _, serr = serverHandshake(s1, singleToken(serverToken), cipherAESCTR, nil)
+		if serr != nil {
+			_ = s1.Close()
+		}
+	}()
+	c, cerr = clientHandshake(craw, clientToken, cipherAESCTR)
+	if cerr != nil {
+		_ = c1.Close()
+	}
+	<-done
+	return c, s, craw, cerr, serr
+}
+
+func sendRecv(t *testing.T, w io.Writer, r io.Reader, msg string) string {
+	t.Helper()
+	go func() {
+		_, _ = w.Write([]byte(msg))
+	}()
+	bf := make([]byte, len(msg))
+	_, err := io.ReadFull(r, bf)
+	xt.NoError(t, err)
+	return string(bf)
+}
+
+func Test_handshake(t *testing.T) {
+	t.Run("token", func(t *testing.T) {
+		c, s, raw, cerr, serr := handshakePair(t, "hello-world", "hello-world")
+		xt.NoError(t, cerr)
+		xt.NoError(t, serr)
+		xt.Equal(t, "hello", sendRecv(t, c, s, "hello"))
+		xt.Equal(t, "world", sendRecv(t, s, c, "world"))
+		xt.NotContains(t, string(raw.written), "hello")
+	})
+
+	t.Run("no", func(t *testing.T) {
+		c, s, raw, cerr, serr := handshakePair(t, noToken, noToken)
+		xt.NoError(t, cerr)
+		xt.NoError(t, serr)
+		xt.Equal(t, "hello", sendRecv(t, c, s, "hello"))
+		xt.Contains(t, string(raw.written), "hello")
+	})
+
+	t.Run("keystream not reused", func(t *testing.T) {
+		c1, s1, raw1, _, _ := handshakePair(t, "hello-world", "hello-world")
+		c2, s2, raw2, _, _ := handshakePair(t, "hello-world", "hello-world")
+		sendRecv(t, c1, s1, "hello")
+		sendRecv(t, c2, s2, "hello")
+		n := helloSize + 8 + sha256.Size
+		xt.NotEqual(t, string(raw1.written[n:]), string(raw2.written[n:]))
+	})
+
+	t.Run("version", func(t *testing.T) {
+		c1, s1 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			_, _ = readHello(s1)
+			_, _ = s1.Write(make([]byte, helloSize))
+			_, _ = io.ReadAll(s1)
+		}()
+		_, err := clientHandshake(c1, "hello-world", cipherAESCTR)
+		xt.ErrorIs(t, err, errVersion)
+	})
+
+	t.Run("old client", func(t *testing.T) {
+		c1, s1 := net.Pipe()
+		defer c1.Close()
+		defer s1.Close()
+		// 版本 2 的 client hello：版本号 | 加密算法 | 16 字节随机数，之后等待 server hello
+		go func() {
+			_, _ = c1.Write(append([]byte{2, cipherAESCTR}, make([]byte, nonceSize)...))
+		}()
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := serverHandshake(s1, singleToken("hello-world"), cipherAESCTR, nil)
+			errc <- err
+		}()
+		_ = c1.SetReadDeadline(time.Now().Add(time.Second))
+		bf := make([]byte, helloSize)
+		_, err := io.ReadFull(c1, bf)
+		xt.NoError(t, err)
+		xt.Equal(t, protocolVersion, bf[0])
+		xt.ErrorIs(t, <-errc, errVersion)
+	})
+
+	t.Run("cipher", func(t *testing.T) {
+		c1, s1 := net.Pipe()
+		defer c1.Close()
+		defer s1.Close()
+		go func() {
+			_, _, _ = serverHandshake(s1, singleToken("hello-world"), cipherAESGCM, nil)
+		}()
+		_, err := clientHandshake(c1, "hello-world", cipherChaCha20Poly1305)
+		xt.ErrorIs(t, err, errCipher)
+	})
+
+	t.Run("token mismatch", func(t *testing.T) {
+		_, _, _, cerr, serr := handshakePair(t, "hello-world", "hello")
+		xt.Error(t, cerr)
+		xt.ErrorIs(t, serr, errAuth)
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		c1, s1 := net.Pipe()
+		defer c1.Close()
+		go func() {
+			ch, _ := newHello(cipherAESCTR, keyID("hello-world"))
+			_ = ch.writeTo(c1)
+			sh, _ := readHello(c1)
+			keys := deriveKeys("hello-world", ch.Nonce, sh.Nonce)
+			rw := rwWithKeys(c1, cipherAESCTR, keys.c2s, keys.s2c)
+			ts := time.Now().Add(-2 * maxClockSkew).UnixMilli()
+			proof := binary.BigEndian.AppendUint64(nil, uint64(ts))
+			proof = append(proof, authMAC(keys.auth, "client", ch, sh, ts)...)
+			_, _ = rw.Write(proof)
+		}()
+		_, _, err := serverHandshake(s1, singleToken("hello-world"), cipherAESCTR, nil)
+		xt.ErrorIs(t, err, errClockSkew)
+	})
+}
+
+func Test_nonceCache(t *testing.T) {
+	nc := newNonceCache(time.Minute)
+	var n1, n2 [nonceSize]byte
+	n2[0] = 1
+	xt.True(t, nc.add(n1))
+	xt.True(t, nc.add(n2))
+	xt.False(t, nc.add(n1))
+
+	nc = newNonceCache(time.Millisecond)
+	xt.True(t, nc.add(n1))
+	time.Sleep(2 * time.Millisecond)
+	xt.True(t, nc.add(n1))
+}
@@ -0,0 +1,200 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+
+	"github.com/fsgo/networks/internal/metrics"
+)
+
+// 心跳：client 每隔一段时间在和 server 的连接上创建一个 Ping stream，server 回复 1 字节后由 client 关闭
+// 连续多次没有收到回复时，client 断开连接并重连；server 超过约定的时间没有收到心跳时，断开连接
+//
+// 心跳和普通的 stream 共用一个连接，Mux 的 readLoop 将数据分发给 stream 时，若 stream 的缓冲已满
+// （如本地服务或者外部用户读取的很慢），readLoop 会阻塞，排在后面的心跳也无法被及时处理。
+// 此时连接本身是正常的，通过 readMonitor 识别出来，不计为心跳失败
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultHeartbeatMisses   = 3
+)
+
+var (
+	errHeartbeatTimeout = errors.New("heartbeat timeout")
+
+	pingMeta = (&StreamMeta{Ping: true}).encode()
+	pong     = []byte{1}
+)
+
+func getHeartbeatMisses(n int) int {
+	if n > 0 {
+		return n
+	}
+	return defaultHeartbeatMisses
+}
+
+// heartbeatMetrics 心跳相关的指标
+type heartbeatMetrics struct {
+	rtt      *metrics.Histogram
+	timeouts *metrics.Counter
+}
+
+func newHeartbeatMetrics(r *metrics.Registry, prefix string) *heartbeatMetrics {
+	return &heartbeatMetrics{
+		rtt:      r.NewHistogram(prefix+"heartbeat_rtt_seconds", "Round trip time of heartbeats.", metrics.DefBuckets),
+		timeouts: r.NewCounter(prefix+"heartbeat_timeouts_total", "Connections closed because of heartbeat timeout."),
+	}
+}
+
+func (m *heartbeatMetrics) observe(rtt time.Duration) {
+	if m != nil {
+		m.rtt.Observe(rtt.Seconds())
+	}
+}
+
+func (m *heartbeatMetrics) timeout() {
+	if m != nil {
+		m.timeouts.Inc()
+	}
+}
+
+// readMonitor 记录 Mux 的 readLoop 从底层连接读取数据的情况
+type readMonitor struct {
+	io.ReadWriteCloser
+	n       atomic.Int64 // 已读取的字节数
+	waiting atomic.Bool  // 是否正在等待底层连接的数据
+}
+
+func (m *readMonitor) Read(p []byte) (int, error) {
+	m.waiting.Store(true)
+	n, err := m.ReadWriteCloser.Read(p)
+	m.waiting.Store(false)
+	m.n.Add(int64(n))
+	return n, err
+}
+
+// busy 读取的字节数不再是 since，或者 readLoop 没有在等待底层连接的数据（阻塞在分发数据上），
+// 说明连接是活跃的，心跳只是被慢的 stream 延迟了
+func (m *readMonitor) busy(since int64) bool {
+	return m.n.Load() != since || !m.waiting.Load()
+}
+
+// ping 发送一次心跳，返回 RTT
+func ping(muc *xio.Mux, timeout time.Duration) (time.Duration, error) {
+	start := time.Now()
+	stream, err := muc.OpenWithPayload(pingMeta)
+	if err != nil {
+		return 0, err
+	}
+	// 关闭后，读取的 goroutine 也会退出
+	defer stream.Close()
+	result := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(stream, make([]byte, len(pong)))
+		result <- err
+	}()
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	select {
+	case err = <-result:
+	case <-tm.C:
+		err = errHeartbeatTimeout
+	}
+	return time.Since(start), err
+}
+
+// heartbeat 定期发送心跳，连续多次失败时关闭 muc，直到 done 被关闭
+// rm 为 muc 的底层连接，心跳失败时若 muc 仍在读取数据，不计为失败
+func (c *Tunneler) heartbeat(muc *xio.Mux, rm *readMonitor, done <-chan struct{}, logger *slog.Logger) {
+	interval := c.HeartbeatInterval
+	tm := time.NewTicker(interval)
+	defer tm.Stop()
+	var misses int
+	for {
+		select {
+		case <-done:
+			return
+		case <-tm.C:
+		}
+		before := rm.n.Load()
+		rtt, err := ping(muc, interval)
+		if err == nil {
+			misses = 0
+			c.heartbeatMetrics.observe(rtt)
+			logger.Debug("heartbeat", "rtt", rtt)
+			continue
+		}
+		if rm.busy(before) {
+			logger.Info("heartbeat delayed by busy streams", errAttr(err))
+			continue
+		}
+		misses++
+		logger.Warn("heartbeat failed", "misses", misses, errAttr(err))
+		if misses >= getHeartbeatMisses(c.HeartbeatMisses) {
+			c.heartbeatMetrics.timeout()
+			logger.Warn("heartbeat timeout, reconnect")
+			_ = muc.Close()
+			return
+		}
+	}
+}
+
+// isPingStream 判断是否为 client 创建的心跳 stream
+func isPingStream(stream *xio.MuxStream) bool {
+	meta, err := decodeStreamMeta(stream.Hello())
+	return err == nil && meta.Ping
+}
+
+// pingHandler 回复 client 的心跳
+func (s *Server) pingHandler(cm *clientMux, stream *xio.MuxStream) {
+	defer stream.Close()
+	cm.lastPing.Store(time.Now().UnixNano())
+	if _, err := stream.Write(pong); err != nil {
+		return
+	}
+	// 由 client 读取回复后关闭，避免 client 还没有读取到回复 stream 就被关闭
+	tm := time.NewTimer(defaultHeartbeatInterval)
+	defer tm.Stop()
+	select {
+	case <-stream.Done():
+	case <-cm.done:
+	case <-tm.C:
+	}
+}
+
+// watchHeartbeat 超过 timeout 没有收到心跳时，关闭返回的 channel，连接断开后停止检查
+// 若期间 Mux 仍在读取数据，会重新计时
+func watchHeartbeat(cm *clientMux, timeout time.Duration) <-chan struct{} {
+	dead := make(chan struct{})
+	cm.lastPing.Store(time.Now().UnixNano())
+	go func() {
+		alive := time.Now().UnixNano() // 最后一次确认连接活跃的时间
+		last := cm.reads.n.Load()
+		for {
+			wait := time.Until(time.Unix(0, max(cm.lastPing.Load(), alive)).Add(timeout))
+			if wait <= 0 {
+				if !cm.reads.busy(last) {
+					close(dead)
+					return
+				}
+				alive = time.Now().UnixNano()
+				last = cm.reads.n.Load()
+				continue
+			}
+			select {
+			case <-cm.done:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}()
+	return dead
+}
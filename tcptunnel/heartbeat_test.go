@@ -0,0 +1,199 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestHeartbeat(t *testing.T) {
+	s := &Server{}
+	c := &Client{HeartbeatInterval: 20 * time.Millisecond}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	waitFor(t, func() bool {
+		return c.getMetrics().heartbeat.rtt.Count() >= 3
+	})
+	cm := s.clients.all()[0]
+	xt.True(t, time.Since(time.Unix(0, cm.lastPing.Load())) < time.Second)
+
+	// 心跳 stream 不影响正常的 stream
+	conn := dialEcho(t, s.ListenOut)
+	_ = conn.Close()
+	xt.Equal(t, uint64(0), c.getMetrics().heartbeat.timeouts.Load())
+	xt.Equal(t, uint64(0), s.getMetrics().heartbeatTimeouts.Load())
+}
+
+func TestTunnelerHeartbeatTimeout(t *testing.T) {
+	var dials atomic.Int64
+	tl := &Tunneler{
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatMisses:   2,
+		RemoteRW: func() io.ReadWriteCloser {
+			dials.Add(1)
+			c1, c2 := net.Pipe()
+			// 对端可以读写，但是不回复心跳
+			peer := xio.NewMux(false, c2)
+			t.Cleanup(func() {
+				_ = peer.Close()
+			})
+			return c1
+		},
+		LocalDial: func(*StreamMeta) (io.ReadWriteCloser, error) {
+			return nil, errNoLocal
+		},
+		heartbeatMetrics: newClientMetrics(&Client{}).heartbeat,
+	}
+	go func() {
+		_ = tl.Start(t.Context())
+	}()
+	// 心跳超时后会重新连接
+	waitFor(t, func() bool {
+		return dials.Load() >= 2
+	})
+	xt.True(t, tl.heartbeatMetrics.timeouts.Load() >= 1)
+	tl.Stop()
+}
+
+// floodStream 创建一个 stream 并一直写入数据，直到出错
+func floodStream(muc *xio.Mux) {
+	stream, err := muc.OpenWithPayload((&StreamMeta{}).encode())
+	if err != nil {
+		return
+	}
+	bf := make([]byte, 1024)
+	for {
+		if _, err = stream.Write(bf); err != nil {
+			return
+		}
+	}
+}
+
+func TestTunnelerHeartbeatBusy(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	var dials atomic.Int64
+	var peer *xio.Mux
+	locals := make(chan net.Conn, 1)
+	tl := &Tunneler{
+		HeartbeatInterval: 20 * time.Millisecond,
+		HeartbeatMisses:   2,
+		RemoteRW: func() io.ReadWriteCloser {
+			if dials.Add(1) > 1 {
+				<-ctx.Done()
+				return nil
+			}
+			c1, c2 := net.Pipe()
+			// 对端不回复心跳，但是一直在 stream 上写入数据
+			peer = xio.NewMux(false, c2)
+			go floodStream(peer)
+			return c1
+		},
+		LocalDial: func(*StreamMeta) (io.ReadWriteCloser, error) {
+			// 本地服务不读取数据，stream 的缓冲会被写满
+			c1, c2 := net.Pipe()
+			locals <- c2
+			return c1, nil
+		},
+		heartbeatMetrics: newClientMetrics(&Client{}).heartbeat,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- tl.Start(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond)
+	xt.Equal(t, int64(1), dials.Load())
+	xt.Equal(t, uint64(0), tl.heartbeatMetrics.timeouts.Load())
+	// 先读取本地连接的数据，使 readLoop 不再阻塞，再由对端关闭
+	go io.Copy(io.Discard, <-locals)
+	_ = peer.Close()
+	cancel()
+	xt.NoError(t, <-done)
+}
+
+func Test_watchHeartbeat(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		cm := newTestClientMux(t, 1)
+		dead := watchHeartbeat(cm, 50*time.Millisecond)
+		start := time.Now()
+		for range 5 {
+			time.Sleep(20 * time.Millisecond)
+			cm.lastPing.Store(time.Now().UnixNano())
+		}
+		select {
+		case <-dead:
+		case <-time.After(time.Second):
+			t.Fatal("not dead")
+		}
+		xt.True(t, time.Since(start) >= 150*time.Millisecond)
+	})
+	t.Run("busy", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		cm := newClientMux(1, c1)
+		peer := xio.NewMux(true, c2)
+		t.Cleanup(func() {
+			_ = cm.mux.Close()
+			_ = peer.Close()
+		})
+		// 对端一直写入数据，但是没有人读取 stream，readLoop 阻塞在分发数据上
+		go floodStream(peer)
+		dead := watchHeartbeat(cm, 50*time.Millisecond)
+		select {
+		case <-dead:
+			t.Fatal("should not be dead when mux is busy")
+		case <-time.After(300 * time.Millisecond):
+		}
+		// Mux 在 readLoop 阻塞在分发数据上时关闭会有 data race，先读取 stream 的数据，再由对端关闭
+		stream, err := cm.mux.Accept()
+		xt.NoError(t, err)
+		go io.Copy(io.Discard, stream)
+		_ = peer.Close()
+		<-cm.done
+	})
+	t.Run("closed", func(t *testing.T) {
+		cm := newTestClientMux(t, 1)
+		dead := watchHeartbeat(cm, 50*time.Millisecond)
+		_ = cm.mux.Close()
+		select {
+		case <-dead:
+			t.Fatal("should not be dead after closed")
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+}
+
+func TestServerHeartbeatTimeout(t *testing.T) {
+	s := &Server{ListenOut: freeAddr(t), ListenClient: freeAddr(t)}
+	go func() {
+		_ = s.Start(t.Context())
+	}()
+	var conn net.Conn
+	waitFor(t, func() bool {
+		var err error
+		conn, err = net.Dial("tcp", s.ListenClient)
+		return err == nil
+	})
+	defer conn.Close()
+	// client 注册时声明了心跳，但是没有发送
+	c := &Client{ServerAddr: s.ListenClient, LocalAddr: "127.0.0.1:1", HeartbeatInterval: 20 * time.Millisecond}
+	xt.NoError(t, c.init())
+	_, err := c.handshake(conn)
+	xt.NoError(t, err)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	waitFor(t, func() bool {
+		return s.getMetrics().heartbeatTimeouts.Load() == 1 && s.clients.len() == 0
+	})
+}
@@ -0,0 +1,158 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xanygo/anygo/safely"
+)
+
+var errStarted = errors.New("already started")
+
+// lifecycle 管理 Server、Client、Tunneler 的 Start 和 Shutdown
+//
+//	Start 之后一直运行，直到传入的 ctx 被取消、调用了 Shutdown 或者出现错误
+//	Shutdown 会先停止接受新的连接，等待处理中的连接结束后，再强制关闭所有连接
+type lifecycle struct {
+	mu      sync.Mutex
+	started bool
+	closing bool
+	closers []io.Closer // 需要在停止时关闭的 listener
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // Start 返回后关闭
+}
+
+// start 标记为已启动，返回的 ctx 在停止时会被取消
+// init 不为 nil 时，在确认未启动后调用，用于校验配置和初始化，返回错误时不会标记为已启动
+func (lc *lifecycle) start(parent context.Context, init func() error) (context.Context, error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.started {
+		return nil, errStarted
+	}
+	if init != nil {
+		if err := init(); err != nil {
+			return nil, err
+		}
+	}
+	lc.started = true
+	lc.ctx, lc.cancel = context.WithCancel(parent)
+	lc.done = make(chan struct{})
+	return lc.ctx, nil
+}
+
+// context 返回运行中的 ctx，未启动时返回 context.Background()
+func (lc *lifecycle) context() context.Context {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.ctx == nil {
+		return context.Background()
+	}
+	return lc.ctx
+}
+
+// addCloser 添加一个需要在停止时关闭的 listener，若已经在停止中，会立即关闭并返回 false
+func (lc *lifecycle) addCloser(c io.Closer) bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.closing {
+		_ = c.Close()
+		return false
+	}
+	lc.closers = append(lc.closers, c)
+	return true
+}
+
+func (lc *lifecycle) isClosing() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return lc.closing
+}
+
+// closeListeners 标记为停止中，并关闭所有的 listener
+func (lc *lifecycle) closeListeners() {
+	lc.mu.Lock()
+	lc.closing = true
+	closers := lc.closers
+	lc.closers = nil
+	lc.mu.Unlock()
+	for _, c := range closers {
+		_ = c.Close()
+	}
+}
+
+// run 运行所有的 fns，直到 ctx 被取消或者任意一个 fn 返回错误，
+// 然后调用 stop 强制关闭，并等待所有的 fn 都退出
+func (lc *lifecycle) run(fns []func() error, stop func()) error {
+	defer close(lc.done)
+	errs := make(chan error, len(fns))
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Go(func() {
+			if err := safely.Run(fn); err != nil && !lc.isClosing() {
+				errs <- err
+			}
+		})
+	}
+	var err error
+	select {
+	case <-lc.ctx.Done():
+	case err = <-errs:
+	}
+	lc.closeListeners()
+	lc.cancel()
+	stop()
+	wg.Wait()
+	return err
+}
+
+// shutdown 优雅关闭：停止接受新连接，等待 busy 返回 false，再强制关闭
+// 若在 ctx 超时前没能等到 busy 返回 false，返回 ctx.Err()
+func (lc *lifecycle) shutdown(ctx context.Context, busy func() bool) error {
+	lc.mu.Lock()
+	started := lc.started
+	lc.mu.Unlock()
+	if !started {
+		return nil
+	}
+	lc.closeListeners()
+	err := waitIdle(ctx, busy)
+	lc.cancel()
+	<-lc.done
+	return err
+}
+
+// waitIdle 等待 busy 返回 false 或者 ctx 超时
+func waitIdle(ctx context.Context, busy func() bool) error {
+	tk := time.NewTicker(20 * time.Millisecond)
+	defer tk.Stop()
+	for busy() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tk.C:
+		}
+	}
+	return nil
+}
+
+// sleep 等待 d 时间，若 ctx 被取消则提前返回 false
+func sleep(ctx context.Context, d time.Duration) bool {
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-tm.C:
+		return true
+	}
+}
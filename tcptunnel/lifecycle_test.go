@@ -0,0 +1,152 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// dialEcho 创建一个连接并完成一次 echo
+func dialEcho(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	xt.NoError(t, err)
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Write([]byte("hello"))
+	xt.NoError(t, err)
+	bf := make([]byte, 5)
+	_, err = io.ReadFull(conn, bf)
+	xt.NoError(t, err)
+	return conn
+}
+
+func TestServerShutdown(t *testing.T) {
+	t.Run("drain", func(t *testing.T) {
+		s := &Server{}
+		c := &Client{}
+		serr, cerr := startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		conn := dialEcho(t, s.ListenOut)
+
+		done := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			done <- s.Shutdown(ctx)
+		}()
+		// 停止监听后，不能再创建新的连接
+		waitFor(t, func() bool {
+			c, err := net.Dial("tcp", s.ListenOut)
+			if err == nil {
+				_ = c.Close()
+			}
+			return err != nil
+		})
+		// 处理中的连接不受影响
+		_, err := conn.Write([]byte("world"))
+		xt.NoError(t, err)
+		bf := make([]byte, 5)
+		_, err = io.ReadFull(conn, bf)
+		xt.NoError(t, err)
+		xt.Equal(t, "world", string(bf))
+
+		select {
+		case <-done:
+			t.Fatal("should wait in-flight conn")
+		case <-time.After(100 * time.Millisecond):
+		}
+		_ = conn.Close()
+		xt.NoError(t, <-done)
+		xt.NoError(t, <-serr)
+
+		xt.NoError(t, c.Shutdown(context.Background()))
+		xt.NoError(t, <-cerr)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		s := &Server{}
+		c := &Client{}
+		serr, cerr := startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		conn := dialEcho(t, s.ListenOut)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		xt.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+		xt.NoError(t, <-serr)
+		// 超时后连接被强制关闭
+		_, err := conn.Read(make([]byte, 1))
+		xt.Error(t, err)
+
+		xt.NoError(t, s.Shutdown(context.Background()))
+		xt.ErrorIs(t, s.Start(context.Background()), errStarted)
+
+		ctx2, cancel2 := context.WithCancel(context.Background())
+		cancel2()
+		_ = c.Shutdown(ctx2)
+		xt.NoError(t, <-cerr)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		s := &Server{}
+		c := &Client{}
+		serr, cerr := startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		conn := dialEcho(t, s.ListenOut)
+		defer conn.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		xt.ErrorIs(t, c.Shutdown(ctx), context.DeadlineExceeded)
+		xt.NoError(t, <-cerr)
+		// client 停止后，server 上的连接也会被关闭
+		waitFor(t, func() bool {
+			return s.clients.len() == 0
+		})
+		_, err := conn.Read(make([]byte, 1))
+		xt.Error(t, err)
+		xt.NoError(t, s.Shutdown(context.Background()))
+		xt.NoError(t, <-serr)
+	})
+
+	t.Run("not started", func(t *testing.T) {
+		xt.NoError(t, (&Server{}).Shutdown(context.Background()))
+		xt.NoError(t, (&Client{}).Shutdown(context.Background()))
+		xt.NoError(t, (&Tunneler{}).Shutdown(context.Background()))
+	})
+}
+
+func TestStartTwice(t *testing.T) {
+	s := &Server{}
+	c := &Client{}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	conn := dialEcho(t, s.ListenOut)
+	defer conn.Close()
+	// 运行中再次 Start 直接返回错误，不会重新初始化正在使用的配置
+	xt.ErrorIs(t, s.Start(context.Background()), errStarted)
+	xt.ErrorIs(t, c.Start(context.Background()), errStarted)
+	_, err := conn.Write([]byte("world"))
+	xt.NoError(t, err)
+	bf := make([]byte, 5)
+	_, err = io.ReadFull(conn, bf)
+	xt.NoError(t, err)
+	xt.Equal(t, "world", string(bf))
+}
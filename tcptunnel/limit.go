@@ -0,0 +1,266 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsgo/networks/internal"
+	"github.com/fsgo/networks/internal/ratelimit"
+)
+
+var (
+	errMaxStreams = errors.New("too many outer connections")
+	errStreamRate = errors.New("outer connection rate exceeded")
+)
+
+// 连接被拒绝的原因，用于指标
+const (
+	limitReasonMaxStreams = "max_streams"
+	limitReasonStreamRate = "stream_rate"
+)
+
+// bandwidth 一组带宽限制，read 为从外部用户读取（上行），write 为写给外部用户（下行）
+type bandwidth struct {
+	read  *ratelimit.Limiter
+	write *ratelimit.Limiter
+}
+
+// newBandwidth 创建带宽限制，rate 为每秒的字节数，小于等于 0 时返回 nil，即不限制
+func newBandwidth(rate int) *bandwidth {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidth{
+		read:  ratelimit.New(float64(rate), rate),
+		write: ratelimit.New(float64(rate), rate),
+	}
+}
+
+// ipBandwidths 每个外部用户 IP 的带宽限制，没有连接的 IP 会被删除
+type ipBandwidths struct {
+	rate  int
+	mu    sync.Mutex
+	items map[netip.Addr]*ipBandwidth
+}
+
+type ipBandwidth struct {
+	*bandwidth
+	refs int
+}
+
+// acquire 返回 ip 的带宽限制，使用完后需要调用 release
+func (m *ipBandwidths) acquire(ip netip.Addr) *bandwidth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.items == nil {
+		m.items = make(map[netip.Addr]*ipBandwidth)
+	}
+	item := m.items[ip]
+	if item == nil {
+		item = &ipBandwidth{bandwidth: newBandwidth(m.rate)}
+		m.items[ip] = item
+	}
+	item.refs++
+	return item.bandwidth
+}
+
+func (m *ipBandwidths) release(ip netip.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if item := m.items[ip]; item != nil {
+		if item.refs--; item.refs <= 0 {
+			delete(m.items, ip)
+		}
+	}
+}
+
+// serverLimits Server 上外部连接的带宽和连接数限制
+type serverLimits struct {
+	total       *bandwidth
+	serviceRate int
+	services    sync.Map // 服务名称 -> *bandwidth
+	ips         ipBandwidths
+
+	streams chan struct{} // 处理中的外部连接，为 nil 时不限制
+	rate    *ratelimit.Limiter
+	wait    time.Duration
+
+	queued         atomic.Int64 // 排队等待的新连接数
+	throttled      atomic.Int64 // 因为带宽限制正在等待的读写数
+	throttledNanos atomic.Int64 // 因为带宽限制累计等待的时间
+}
+
+func newServerLimits(s *Server) *serverLimits {
+	l := &serverLimits{
+		total:       newBandwidth(s.Bandwidth),
+		serviceRate: s.ServiceBandwidth,
+		ips:         ipBandwidths{rate: s.IPBandwidth},
+		rate:        ratelimit.New(s.StreamRate, int(math.Ceil(s.StreamRate))),
+		wait:        s.LimitWait,
+	}
+	if s.MaxStreams > 0 {
+		l.streams = make(chan struct{}, s.MaxStreams)
+	}
+	return l
+}
+
+// admit 按照 MaxStreams 和 StreamRate 接受一个新的外部连接，超过限制时最多排队等待 LimitWait
+// 返回的 release 需要在连接结束后调用
+func (l *serverLimits) admit(ctx context.Context) (release func(), err error) {
+	return l.admitWithin(ctx, l.wait)
+}
+
+// tryAdmit 和 admit 相同，但是不排队等待，用于 udp 会话，避免阻塞读取数据包的循环
+func (l *serverLimits) tryAdmit() (release func(), err error) {
+	return l.admitWithin(context.Background(), 0)
+}
+
+func (l *serverLimits) admitWithin(ctx context.Context, wait time.Duration) (release func(), err error) {
+	d, ok := l.rate.ReserveWithin(1, wait)
+	if !ok {
+		return nil, errStreamRate
+	}
+	if d > 0 {
+		l.queued.Add(1)
+		err = ratelimit.Sleep(ctx, d)
+		l.queued.Add(-1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if l.streams == nil {
+		return func() {}, nil
+	}
+	release = func() {
+		<-l.streams
+	}
+	select {
+	case l.streams <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if wait <= 0 {
+		return nil, errMaxStreams
+	}
+	l.queued.Add(1)
+	defer l.queued.Add(-1)
+	tm := time.NewTimer(wait)
+	defer tm.Stop()
+	select {
+	case l.streams <- struct{}{}:
+		return release, nil
+	case <-tm.C:
+		return nil, errMaxStreams
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *serverLimits) service(name string) *bandwidth {
+	if l.serviceRate <= 0 {
+		return nil
+	}
+	v, _ := l.services.LoadOrStore(name, newBandwidth(l.serviceRate))
+	return v.(*bandwidth)
+}
+
+// wrap 返回按照带宽限制读写 rw 的连接，release 需要在连接结束后调用
+func (l *serverLimits) wrap(rw io.ReadWriteCloser, service string, remote net.Addr) (io.ReadWriteCloser, func()) {
+	var limits []*bandwidth
+	for _, b := range []*bandwidth{l.total, l.service(service)} {
+		if b != nil {
+			limits = append(limits, b)
+		}
+	}
+	release := func() {}
+	if l.ips.rate > 0 {
+		if ip, err := addrIP(remote); err == nil {
+			limits = append(limits, l.ips.acquire(ip))
+			release = func() {
+				l.ips.release(ip)
+			}
+		}
+	}
+	if len(limits) == 0 {
+		return rw, release
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &limitRW{ReadWriteCloser: rw, l: l, limits: limits, ctx: ctx, cancel: cancel}, release
+}
+
+// limitRW 按照带宽限制读写外部用户的连接，关闭后不再等待
+type limitRW struct {
+	io.ReadWriteCloser
+	l      *serverLimits
+	limits []*bandwidth
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (rw *limitRW) Read(p []byte) (int, error) {
+	n, err := rw.ReadWriteCloser.Read(p)
+	if n > 0 {
+		if err1 := rw.wait(n, false); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return n, err
+}
+
+func (rw *limitRW) Write(p []byte) (int, error) {
+	if err := rw.wait(len(p), true); err != nil {
+		return 0, err
+	}
+	return rw.ReadWriteCloser.Write(p)
+}
+
+func (rw *limitRW) wait(n int, write bool) error {
+	var d time.Duration
+	for _, b := range rw.limits {
+		lm := b.read
+		if write {
+			lm = b.write
+		}
+		d = max(d, lm.Reserve(n))
+	}
+	if d <= 0 {
+		return nil
+	}
+	rw.l.throttled.Add(1)
+	defer rw.l.throttled.Add(-1)
+	rw.l.throttledNanos.Add(int64(d))
+	return ratelimit.Sleep(rw.ctx, d)
+}
+
+func (rw *limitRW) CloseWrite() error {
+	return internal.CloseWrite(rw.ReadWriteCloser)
+}
+
+func (rw *limitRW) Close() error {
+	rw.cancel()
+	return rw.ReadWriteCloser.Close()
+}
+
+// limitRejected 记录被连接限制拒绝的外部连接或者 udp 会话
+func (s *Server) limitRejected(service string, remote net.Addr, err error) {
+	reason := limitReasonMaxStreams
+	if errors.Is(err, errStreamRate) {
+		reason = limitReasonStreamRate
+	} else if !errors.Is(err, errMaxStreams) {
+		// 排队时连接或者 server 已经关闭
+		return
+	}
+	s.getMetrics().limitRejects.With(reason).Inc()
+	s.limitLog.log(s.logger(), "connection rejected by limits", logKeyService, service, logKeyRemote, remote.String(), errAttr(err))
+}
@@ -0,0 +1,181 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func Test_serverLimitsAdmit(t *testing.T) {
+	t.Run("unlimited", func(t *testing.T) {
+		l := newServerLimits(&Server{})
+		for range 10 {
+			release, err := l.admit(t.Context())
+			xt.NoError(t, err)
+			release()
+		}
+	})
+
+	t.Run("max streams", func(t *testing.T) {
+		l := newServerLimits(&Server{MaxStreams: 1})
+		release, err := l.admit(t.Context())
+		xt.NoError(t, err)
+		_, err = l.admit(t.Context())
+		xt.ErrorIs(t, err, errMaxStreams)
+		release()
+		release, err = l.admit(t.Context())
+		xt.NoError(t, err)
+		release()
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		l := newServerLimits(&Server{MaxStreams: 1, LimitWait: time.Second})
+		release, err := l.admit(t.Context())
+		xt.NoError(t, err)
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			xt.Equal(t, int64(1), l.queued.Load())
+			release()
+		}()
+		start := time.Now()
+		release2, err := l.admit(t.Context())
+		xt.NoError(t, err)
+		xt.True(t, time.Since(start) >= 40*time.Millisecond)
+		xt.Equal(t, int64(0), l.queued.Load())
+		release2()
+	})
+
+	t.Run("try", func(t *testing.T) {
+		l := newServerLimits(&Server{MaxStreams: 1, LimitWait: time.Second})
+		release, err := l.tryAdmit()
+		xt.NoError(t, err)
+		start := time.Now()
+		_, err = l.tryAdmit()
+		xt.ErrorIs(t, err, errMaxStreams)
+		xt.True(t, time.Since(start) < 100*time.Millisecond)
+		release()
+	})
+
+	t.Run("stream rate", func(t *testing.T) {
+		l := newServerLimits(&Server{StreamRate: 2})
+		for range 2 {
+			_, err := l.admit(t.Context())
+			xt.NoError(t, err)
+		}
+		_, err := l.admit(t.Context())
+		xt.ErrorIs(t, err, errStreamRate)
+
+		// 突发数量向上取整
+		l = newServerLimits(&Server{StreamRate: 2.5})
+		for range 3 {
+			_, err = l.admit(t.Context())
+			xt.NoError(t, err)
+		}
+		_, err = l.admit(t.Context())
+		xt.ErrorIs(t, err, errStreamRate)
+
+		l = newServerLimits(&Server{StreamRate: 20, LimitWait: time.Second})
+		start := time.Now()
+		for range 22 {
+			_, err = l.admit(t.Context())
+			xt.NoError(t, err)
+		}
+		xt.True(t, time.Since(start) >= 80*time.Millisecond)
+	})
+}
+
+func Test_serverLimitsWrap(t *testing.T) {
+	addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort("10.0.0.1:1234"))
+	l := newServerLimits(&Server{})
+	rw := &nopRW{}
+	got, release := l.wrap(rw, "web", addr)
+	xt.True(t, got == io.ReadWriteCloser(rw))
+	release()
+
+	l = newServerLimits(&Server{IPBandwidth: 1000, ServiceBandwidth: 1000})
+	got1, release1 := l.wrap(&nopRW{}, "web", addr)
+	got2, release2 := l.wrap(&nopRW{}, "web", addr)
+	// 同一个 IP 和服务共享带宽限制
+	xt.Len(t, got1.(*limitRW).limits, 2)
+	xt.True(t, got1.(*limitRW).limits[1] == got2.(*limitRW).limits[1])
+	xt.True(t, got1.(*limitRW).limits[0] == got2.(*limitRW).limits[0])
+	release1()
+	xt.Len(t, l.ips.items, 1)
+	release2()
+	xt.Len(t, l.ips.items, 0)
+
+	// 等待时关闭连接，读写立即返回
+	_, err := got1.Write(make([]byte, 3000))
+	xt.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		_, err := got1.Write(make([]byte, 1000))
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	xt.Equal(t, int64(1), l.throttled.Load())
+	xt.NoError(t, got1.Close())
+	select {
+	case err = <-done:
+		xt.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("write not canceled")
+	}
+}
+
+type nopRW struct{}
+
+func (nopRW) Read(p []byte) (int, error)  { return len(p), nil }
+func (nopRW) Write(p []byte) (int, error) { return len(p), nil }
+func (nopRW) Close() error                { return nil }
+
+func TestServerBandwidth(t *testing.T) {
+	s := &Server{Bandwidth: 100 * 1024}
+	startTestTunnel(t, s, &Client{})
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	conn, err := net.Dial("tcp", s.ListenOut)
+	xt.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 首次可以使用 burst，之后的 100KB 需要约 1s
+	msg := bytes.Repeat([]byte("a"), 200*1024)
+	start := time.Now()
+	go func() {
+		_, _ = conn.Write(msg)
+	}()
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	xt.NoError(t, err)
+	xt.True(t, time.Since(start) >= 800*time.Millisecond)
+	xt.True(t, s.limits.Load().throttledNanos.Load() > 0)
+}
+
+func TestServerMaxStreams(t *testing.T) {
+	s := &Server{MaxStreams: 1}
+	startTestTunnel(t, s, &Client{})
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	conn := dialEcho(t, s.ListenOut)
+	defer conn.Close()
+
+	xt.Error(t, echoOnce(s.ListenOut, "hello"))
+	xt.Equal(t, uint64(1), s.getMetrics().limitRejects.With(limitReasonMaxStreams).Load())
+
+	_ = conn.Close()
+	waitFor(t, func() bool {
+		return echoOnce(s.ListenOut, "hello") == nil
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/fsgo/networks/internal"
+)
+
+const (
+	defaultLocalPoolIdle     = 30 * time.Second
+	defaultLocalDialAttempts = 3
+)
+
+// localPool 预先建立的到本地服务的空闲连接，减少新 stream 建立连接的耗时
+type localPool struct {
+	c       *Client
+	address string
+	idle    time.Duration
+	rs      *retryState
+	conns   chan *idleConn
+	taken   chan struct{} // 有连接被取走或丢弃，需要补充
+}
+
+type idleConn struct {
+	net.Conn
+	since time.Time
+}
+
+func newLocalPool(c *Client, address string) *localPool {
+	idle := c.LocalPoolIdle
+	if idle <= 0 {
+		idle = defaultLocalPoolIdle
+	}
+	return &localPool{
+		c:       c,
+		address: address,
+		idle:    idle,
+		rs:      c.localRetry(address),
+		conns:   make(chan *idleConn, c.LocalPool),
+		taken:   make(chan struct{}, 1),
+	}
+}
+
+// get 取出一个可用的连接，没有时返回 nil，不会等待
+func (p *localPool) get() net.Conn {
+	defer p.notify()
+	for {
+		select {
+		case ic := <-p.conns:
+			if time.Since(ic.since) < p.idle && internal.ConnCheck(ic.Conn) == nil {
+				p.c.getMetrics().localPoolHits.Inc()
+				return ic.Conn
+			}
+			_ = ic.Conn.Close()
+		default:
+			p.c.getMetrics().localPoolMisses.Inc()
+			return nil
+		}
+	}
+}
+
+func (p *localPool) notify() {
+	select {
+	case p.taken <- struct{}{}:
+	default:
+	}
+}
+
+// run 保持连接池中的连接数量，直到 ctx 结束
+func (p *localPool) run(ctx context.Context) {
+	defer p.closeAll()
+	tm := time.NewTicker(p.idle / 2)
+	defer tm.Stop()
+	for {
+		p.fill(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.taken:
+		case <-tm.C:
+			p.evict()
+		}
+	}
+}
+
+// fill 补充连接直到连接池满，连接失败时按照 Backoff 等待
+func (p *localPool) fill(ctx context.Context) {
+	for len(p.conns) < cap(p.conns) && ctx.Err() == nil {
+		if !sleep(ctx, p.rs.remaining()) {
+			return
+		}
+		conn, _, err := p.c.dial(ctx, "local", networkTCP, p.address, 0)
+		if err != nil {
+			_, delay := p.rs.fail(&p.c.Backoff)
+			p.c.logger().Warn("pre-dial local failed", "addr", p.address, errAttr(err), "retry_in", delay)
+			continue
+		}
+		p.rs.reset()
+		select {
+		case p.conns <- &idleConn{Conn: conn, since: time.Now()}:
+		default:
+			_ = conn.Close()
+		}
+	}
+}
+
+// evict 关闭空闲时间过长或者已经不可用的连接
+func (p *localPool) evict() {
+	for range len(p.conns) {
+		select {
+		case ic := <-p.conns:
+			if time.Since(ic.since) < p.idle && internal.ConnCheck(ic.Conn) == nil {
+				p.conns <- ic
+			} else {
+				_ = ic.Conn.Close()
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *localPool) closeAll() {
+	for {
+		select {
+		case ic := <-p.conns:
+			_ = ic.Conn.Close()
+		default:
+			return
+		}
+	}
+}
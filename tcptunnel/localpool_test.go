@@ -0,0 +1,82 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestLocalPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	var accepts atomic.Int64
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepts.Add(1)
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	s := &Server{}
+	c := &Client{LocalAddr: l.Addr().String(), LocalPool: 2}
+	startTestTunnel(t, s, c)
+	// 在没有 stream 之前预先建立连接
+	waitFor(t, func() bool {
+		return accepts.Load() == 2 && s.clients.len() == 1
+	})
+
+	conn := dialEcho(t, s.ListenOut)
+	_ = conn.Close()
+	xt.Equal(t, uint64(1), c.getMetrics().localPoolHits.Load())
+	// 取走的连接会被补充
+	waitFor(t, func() bool {
+		return accepts.Load() == 3
+	})
+}
+
+func Test_localPoolGet(t *testing.T) {
+	addr := startEchoServer(t)
+	c := &Client{LocalPool: 2, LocalPoolIdle: time.Hour}
+	p := newLocalPool(c, addr)
+	xt.Nil(t, p.get())
+	xt.Equal(t, uint64(1), c.getMetrics().localPoolMisses.Load())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		xt.NoError(t, err)
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		return conn
+	}
+	// 空闲时间过长的连接和已经关闭的连接会被丢弃
+	p.conns <- &idleConn{Conn: dial(), since: time.Now().Add(-2 * time.Hour)}
+	closed := dial()
+	_ = closed.Close()
+	p.conns <- &idleConn{Conn: closed, since: time.Now()}
+	xt.Nil(t, p.get())
+	xt.Equal(t, 0, len(p.conns))
+
+	conn := dial()
+	p.conns <- &idleConn{Conn: conn, since: time.Now()}
+	xt.True(t, p.get() == conn)
+	xt.Equal(t, uint64(1), c.getMetrics().localPoolHits.Load())
+}
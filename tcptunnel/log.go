@@ -0,0 +1,82 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// 日志中统一使用的属性名
+const (
+	logKeyConnID  = "conn_id"
+	logKeySID     = "sid"
+	logKeyRemote  = "remote"
+	logKeyCost    = "cost"
+	logKeyErr     = "err"
+	logKeyService = "service"
+	logKeyClient  = "client" // server 上 tunnel client 连接的 id
+)
+
+// getLogger 返回 l，为 nil 时返回 slog.Default()
+func getLogger(l *slog.Logger) *slog.Logger {
+	if l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+func errAttr(err error) slog.Attr {
+	return slog.Any(logKeyErr, err)
+}
+
+func costAttr(start time.Time) slog.Attr {
+	return slog.Duration(logKeyCost, time.Since(start))
+}
+
+func sidAttr(sid uint32) slog.Attr {
+	return slog.Uint64(logKeySID, uint64(sid))
+}
+
+func remoteAttr(rd io.Reader) slog.Attr {
+	return slog.String(logKeyRemote, remoteAddr(rd))
+}
+
+// remoteAddr 返回连接的对端地址，若不是 net.Conn 则返回 rwInfo
+func remoteAddr(rd io.Reader) string {
+	if conn, ok := rd.(net.Conn); ok {
+		return conn.RemoteAddr().String()
+	}
+	return rwInfo(rd)
+}
+
+// logLimiter 限制日志的频率：每个周期内只有第一条以 Warn 级别输出，其余的以 Debug 级别输出
+// 用于可能被外部大量触发的日志，如被 ACL 拒绝的连接
+type logLimiter struct {
+	every      time.Duration // 周期，可选，默认 1 秒
+	last       atomic.Int64  // 最后一次以 Warn 级别输出的时间，UnixNano
+	suppressed atomic.Int64  // 上次以 Warn 级别输出后，以 Debug 级别输出的条数
+}
+
+func (l *logLimiter) log(logger *slog.Logger, msg string, args ...any) {
+	every := l.every
+	if every <= 0 {
+		every = time.Second
+	}
+	now := time.Now().UnixNano()
+	last := l.last.Load()
+	if now-last >= int64(every) && l.last.CompareAndSwap(last, now) {
+		if n := l.suppressed.Swap(0); n > 0 {
+			args = append(args, "suppressed", n)
+		}
+		logger.Warn(msg, args...)
+		return
+	}
+	l.suppressed.Add(1)
+	logger.Debug(msg, args...)
+}
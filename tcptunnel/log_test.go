@@ -0,0 +1,62 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// syncBuffer 并发安全的 bytes.Buffer
+type syncBuffer struct {
+	mu sync.Mutex
+	bf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bf.String()
+}
+
+func TestLogger(t *testing.T) {
+	bf := &syncBuffer{}
+	logger := slog.New(slog.NewJSONHandler(bf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	s := &Server{Logger: logger.With("app", "server")}
+	c := &Client{Logger: logger.With("app", "client")}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	conn := dialEcho(t, s.ListenOut)
+	_ = conn.Close()
+
+	var added bool
+	for _, line := range strings.Split(strings.TrimSpace(bf.String()), "\n") {
+		item := map[string]any{}
+		xt.NoError(t, json.Unmarshal([]byte(line), &item))
+		xt.NotEqual[any](t, "DEBUG", item["level"])
+		if item["msg"] == "added to pool" {
+			added = true
+			xt.Equal[any](t, "server", item["app"])
+			xt.NotEmpty(t, item[logKeyConnID])
+			xt.NotEmpty(t, item[logKeyRemote])
+			xt.Equal[any](t, c.ClientID, item["client_id"])
+		}
+	}
+	xt.True(t, added)
+}
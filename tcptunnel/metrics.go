@@ -0,0 +1,301 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsgo/networks/internal"
+	"github.com/fsgo/networks/internal/metrics"
+)
+
+var (
+	errTLS      = errors.New("tls handshake failed")
+	errRegister = errors.New("register failed")
+)
+
+// handshakeFailReason 握手失败的原因，用作指标的标签
+func handshakeFailReason(err error) string {
+	switch {
+	case errors.Is(err, errVersion):
+		return "version"
+	case errors.Is(err, errCipher):
+		return "cipher"
+	case errors.Is(err, errAuth):
+		return "auth"
+	case errors.Is(err, errClockSkew):
+		return "clock_skew"
+	case errors.Is(err, errReplay):
+		return "replay"
+	case errors.Is(err, errTLS), errors.Is(err, errTLSPin):
+		return "tls"
+	case errors.Is(err, errRegister):
+		return "register"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	default:
+		return "io"
+	}
+}
+
+// byteCounter 读写的字节数
+type byteCounter struct {
+	read    atomic.Int64
+	written atomic.Int64
+}
+
+// countRW 统计读写的字节数
+type countRW struct {
+	io.ReadWriteCloser
+	byteCounter
+}
+
+func (c *countRW) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c *countRW) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func (c *countRW) CloseWrite() error {
+	return internal.CloseWrite(c.ReadWriteCloser)
+}
+
+// streamMetrics stream 相关的指标
+type streamMetrics struct {
+	duration *metrics.Histogram
+	bytes    *metrics.HistogramVec
+}
+
+func newStreamMetrics(r *metrics.Registry, prefix string) *streamMetrics {
+	return &streamMetrics{
+		duration: r.NewHistogram(prefix+"stream_duration_seconds", "Duration of streams.", metrics.DefBuckets),
+		bytes: r.NewHistogramVec(prefix+"stream_bytes", "Bytes of streams, in: read from the local side conn, out: written to it.",
+			"direction", metrics.ByteBuckets),
+	}
+}
+
+// observe 记录一个 stream 结束时的数据，rw 为 stream 在本端对应的连接的读写统计
+func (m *streamMetrics) observe(start time.Time, rw *byteCounter) {
+	if m == nil {
+		return
+	}
+	m.duration.Observe(time.Since(start).Seconds())
+	m.bytes.With("in").Observe(float64(rw.read.Load()))
+	m.bytes.With("out").Observe(float64(rw.written.Load()))
+}
+
+type serverMetrics struct {
+	registry          *metrics.Registry
+	stream            *streamMetrics
+	handshakes        *metrics.CounterVec
+	heartbeatTimeouts *metrics.Counter
+	streamRejects     *metrics.Counter
+	aclRejects        *metrics.CounterVec
+	limitRejects      *metrics.CounterVec
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	atomicFn := func(v *atomic.Int64) func() float64 {
+		return func() float64 {
+			return float64(v.Load())
+		}
+	}
+	r.NewCounterFunc("tcptunnel_server_streams_total", "Streams created to tunnel clients.", atomicFn(&s.cntStreamTotal))
+	r.NewCounterFunc("tcptunnel_server_stream_errors_total", "Streams closed with error.", atomicFn(&s.cntStreamErrTotal))
+	r.NewGaugeFunc("tcptunnel_server_outer_connections", "Outer connections being served.", atomicFn(&s.cntOuterNow))
+	r.NewCounterFunc("tcptunnel_server_outer_connections_total", "Outer connections accepted.", atomicFn(&s.cntOuterTotal))
+	r.NewGaugeFunc("tcptunnel_server_client_connections", "Tunnel client connections being served.", atomicFn(&s.cntClientNow))
+	r.NewCounterFunc("tcptunnel_server_client_connections_total", "Tunnel client connections accepted.", atomicFn(&s.cntClientTotal))
+	r.NewGaugeFunc("tcptunnel_server_client_muxes", "Tunnel client connections in the pool.", func() float64 {
+		return float64(s.clients.len())
+	})
+	r.NewGaugeFunc("tcptunnel_server_remote_listeners", "Ports listened for tunnel clients.", func() float64 {
+		return float64(s.remotes.len())
+	})
+	r.NewGaugeFunc("tcptunnel_server_forward_streams", "Forward streams being served.", atomicFn(&s.cntForwardNow))
+	r.NewCounterFunc("tcptunnel_server_forward_streams_total", "Forward streams accepted.", atomicFn(&s.cntForwardTotal))
+	r.NewGaugeFunc("tcptunnel_server_udp_sessions", "Active udp sessions.", atomicFn(&s.cntUDPSessionNow))
+	r.NewCounterFunc("tcptunnel_server_udp_sessions_total", "Udp sessions created.", atomicFn(&s.cntUDPSessionTotal))
+	limits := func(fn func(l *serverLimits) float64) func() float64 {
+		return func() float64 {
+			if l := s.limits.Load(); l != nil {
+				return fn(l)
+			}
+			return 0
+		}
+	}
+	r.NewGaugeFunc("tcptunnel_server_limit_queued", "Outer connections waiting in queue for connection limits.", limits(func(l *serverLimits) float64 {
+		return float64(l.queued.Load())
+	}))
+	r.NewGaugeFunc("tcptunnel_server_throttled", "Reads and writes of outer connections waiting for bandwidth limits.", limits(func(l *serverLimits) float64 {
+		return float64(l.throttled.Load())
+	}))
+	r.NewCounterFunc("tcptunnel_server_throttled_seconds_total", "Time outer connections waited for bandwidth limits.", limits(func(l *serverLimits) float64 {
+		return time.Duration(l.throttledNanos.Load()).Seconds()
+	}))
+	return &serverMetrics{
+		registry:   r,
+		stream:     newStreamMetrics(r, "tcptunnel_server_"),
+		handshakes: r.NewCounterVec("tcptunnel_server_handshake_failures_total", "Tunnel client handshake failures by reason.", "reason"),
+		heartbeatTimeouts: r.NewCounter("tcptunnel_server_heartbeat_timeouts_total",
+			"Tunnel client connections closed because of heartbeat timeout."),
+		streamRejects: r.NewCounter("tcptunnel_server_stream_rejects_total",
+			"Streams rejected by tunnel clients because the local service is unavailable."),
+		limitRejects: r.NewCounterVec("tcptunnel_server_limit_rejects_total", "Outer connections rejected by connection limits by reason.", "reason"),
+		aclRejects:   r.NewCounterVec("tcptunnel_server_acl_rejects_total", "Connections rejected by source ip acl by listener.", "listener"),
+	}
+}
+
+type clientMetrics struct {
+	registry     *metrics.Registry
+	stream       *streamMetrics
+	handshakes   *metrics.CounterVec
+	dial         *metrics.Histogram
+	dialFailures *metrics.Counter
+	heartbeat    *heartbeatMetrics
+
+	breakerRejects *metrics.Counter
+
+	localPoolHits   *metrics.Counter
+	localPoolMisses *metrics.Counter
+
+	backendConns *metrics.CounterVec
+}
+
+func newClientMetrics(c *Client) *clientMetrics {
+	r := metrics.NewRegistry()
+	tunneler := func(fn func(tl *Tunneler) int64) func() float64 {
+		return func() float64 {
+			if tl := c.tl.Load(); tl != nil {
+				return float64(fn(tl))
+			}
+			return 0
+		}
+	}
+	r.NewGaugeFunc("tcptunnel_client_streams", "Streams being served.", tunneler(func(tl *Tunneler) int64 {
+		return tl.cntStreamNow.Load()
+	}))
+	r.NewCounterFunc("tcptunnel_client_streams_total", "Streams accepted from server.", tunneler(func(tl *Tunneler) int64 {
+		return tl.cntStreamTotal.Load()
+	}))
+	r.NewCounterFunc("tcptunnel_client_server_connections_total", "Connections established to server.", tunneler(func(tl *Tunneler) int64 {
+		return tl.cntRemoteTotal.Load()
+	}))
+	r.NewGaugeFunc("tcptunnel_client_forward_connections", "Forward connections being served.", func() float64 {
+		return float64(c.cntForwardNow.Load())
+	})
+	r.NewGaugeFunc("tcptunnel_client_server_failures", "Consecutive failures connecting to server.", func() float64 {
+		return float64(c.serverRetry.getFailures())
+	})
+	r.NewGaugeFunc("tcptunnel_client_local_circuits_open", "Local services whose circuit breaker is open.", func() float64 {
+		var n int
+		c.localRetries.Range(func(_, v any) bool {
+			if v.(*retryState).broken() {
+				n++
+			}
+			return true
+		})
+		return float64(n)
+	})
+	r.NewGaugeFunc("tcptunnel_client_local_addrs_down", "Local addrs taken out by health check.", func() float64 {
+		var n int
+		for _, b := range c.balancers {
+			for _, item := range b.backends {
+				if item.down.Load() {
+					n++
+				}
+			}
+		}
+		return float64(n)
+	})
+	return &clientMetrics{
+		registry:     r,
+		stream:       newStreamMetrics(r, "tcptunnel_client_"),
+		handshakes:   r.NewCounterVec("tcptunnel_client_handshake_failures_total", "Handshake failures with server by reason.", "reason"),
+		dial:         r.NewHistogram("tcptunnel_client_dial_duration_seconds", "Latency of successful dials to local services.", metrics.DefBuckets),
+		dialFailures: r.NewCounter("tcptunnel_client_dial_failures_total", "Failed dials to local services."),
+		heartbeat:    newHeartbeatMetrics(r, "tcptunnel_client_"),
+		breakerRejects: r.NewCounter("tcptunnel_client_local_circuit_rejects_total",
+			"Streams failed fast because the circuit breaker of the local service is open."),
+		localPoolHits:   r.NewCounter("tcptunnel_client_local_pool_hits_total", "Streams served by pre-dialed local connections."),
+		localPoolMisses: r.NewCounter("tcptunnel_client_local_pool_misses_total", "Streams that found no idle pre-dialed local connection."),
+		backendConns:    r.NewCounterVec("tcptunnel_client_local_connections_total", "Connections to local addrs by addr.", "addr"),
+	}
+}
+
+// metricsOnce 延迟创建指标，使得未调用 Start 时也可以安全使用
+type metricsOnce[T any] struct {
+	once sync.Once
+	v    *T
+}
+
+func (m *metricsOnce[T]) get(create func() *T) *T {
+	m.once.Do(func() {
+		m.v = create()
+	})
+	return m.v
+}
+
+func (s *Server) getMetrics() *serverMetrics {
+	return s.metrics.get(func() *serverMetrics {
+		return newServerMetrics(s)
+	})
+}
+
+// MetricsHandler 以 Prometheus 文本格式输出指标的 http.Handler，可用于挂载到已有的 http 服务上
+func (s *Server) MetricsHandler() http.Handler {
+	return s.getMetrics().registry.Handler()
+}
+
+func (c *Client) getMetrics() *clientMetrics {
+	return c.metrics.get(func() *clientMetrics {
+		return newClientMetrics(c)
+	})
+}
+
+// MetricsHandler 以 Prometheus 文本格式输出指标的 http.Handler，可用于挂载到已有的 http 服务上
+func (c *Client) MetricsHandler() http.Handler {
+	return c.getMetrics().registry.Handler()
+}
+
+// serveMetrics 在 addr 上提供 /metrics 接口
+func serveMetrics(lc *lifecycle, logger *slog.Logger, addr string, handler http.Handler) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	return serveHTTP(lc, logger, "metrics", addr, mux)
+}
+
+// serveHTTP 在 addr 上提供 http 服务，停止时会关闭监听
+func serveHTTP(lc *lifecycle, logger *slog.Logger, name string, addr string, handler http.Handler) error {
+	logger.Info("listen "+name, "addr", addr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if !lc.addCloser(l) {
+		return nil
+	}
+	hs := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	return hs.Serve(l)
+}
@@ -0,0 +1,96 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func Test_handshakeFailReason(t *testing.T) {
+	cases := map[error]string{
+		errAuth:                            "auth",
+		fmt.Errorf("x: %w", errReplay):     "replay",
+		fmt.Errorf("%w: bad", errTLS):      "tls",
+		errTLSPin:                          "tls",
+		fmt.Errorf("%w: bad", errRegister): "register",
+		os.ErrDeadlineExceeded:             "timeout",
+		io.ErrUnexpectedEOF:                "io",
+		errors.New("read register failed"): "io",
+		fmt.Errorf("y: %w", errClockSkew):  "clock_skew",
+		fmt.Errorf("z: %w", errVersion):    "version",
+		fmt.Errorf("z: %w", errCipher):     "cipher",
+	}
+	for err, want := range cases {
+		xt.Equal(t, want, handshakeFailReason(err))
+	}
+}
+
+func scrapeMetrics(t *testing.T, addr string) string {
+	t.Helper()
+	resp, err := http.Get("http://" + addr + "/metrics")
+	xt.NoError(t, err)
+	defer resp.Body.Close()
+	xt.Equal(t, http.StatusOK, resp.StatusCode)
+	bf, err := io.ReadAll(resp.Body)
+	xt.NoError(t, err)
+	return string(bf)
+}
+
+func TestMetrics(t *testing.T) {
+	s := &Server{MetricsAddr: freeAddr(t)}
+	c := &Client{MetricsAddr: freeAddr(t)}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+
+	conn := dialEcho(t, s.ListenOut)
+	_ = conn.Close()
+	waitFor(t, func() bool {
+		return s.getMetrics().stream.duration.Count() == 1 && c.getMetrics().stream.duration.Count() == 1
+	})
+
+	sm := scrapeMetrics(t, s.MetricsAddr)
+	xt.True(t, strings.Contains(sm, "tcptunnel_server_outer_connections_total 1\n"))
+	xt.True(t, strings.Contains(sm, "tcptunnel_server_stream_duration_seconds_count 1\n"))
+	xt.True(t, strings.Contains(sm, `tcptunnel_server_stream_bytes_sum{direction="in"} 5`+"\n"))
+	xt.True(t, strings.Contains(sm, `tcptunnel_server_stream_bytes_sum{direction="out"} 5`+"\n"))
+
+	cm := scrapeMetrics(t, c.MetricsAddr)
+	xt.True(t, strings.Contains(cm, "tcptunnel_client_streams_total 1\n"))
+	xt.True(t, strings.Contains(cm, "tcptunnel_client_dial_duration_seconds_count 1\n"))
+	xt.True(t, strings.Contains(cm, `tcptunnel_client_stream_bytes_sum{direction="in"} 5`+"\n"))
+
+	// token 错误的 client 握手失败
+	bad := &Client{ServerAddr: s.ListenClient, LocalAddr: c.LocalAddr, Token: "bad token"}
+	go bad.Start(t.Context())
+	waitFor(t, func() bool {
+		return s.getMetrics().handshakes.With("auth").Load() > 0
+	})
+	xt.True(t, strings.Contains(scrapeMetrics(t, s.MetricsAddr), `tcptunnel_server_handshake_failures_total{reason="auth"}`))
+	waitFor(t, func() bool {
+		return bad.getMetrics().handshakes.With("auth").Load() > 0 || bad.getMetrics().handshakes.With("io").Load() > 0
+	})
+}
+
+func TestMetricsHandler(t *testing.T) {
+	// 未启动时也可以输出指标
+	s := &Server{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	defer l.Close()
+	go http.Serve(l, s.MetricsHandler())
+	bf := scrapeMetrics(t, l.Addr().String())
+	xt.True(t, strings.Contains(bf, "# TYPE tcptunnel_server_streams_total counter\n"))
+}
@@ -0,0 +1,256 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+)
+
+// 在多个 tunnel client 连接之间选择的策略
+const (
+	BalanceRoundRobin   = "round_robin"   // 轮询，默认
+	BalanceLeastStreams = "least_streams" // 选择活跃 stream 最少的连接
+)
+
+func checkBalance(name string) error {
+	switch name {
+	case "", BalanceRoundRobin, BalanceLeastStreams:
+		return nil
+	default:
+		return fmt.Errorf("unsupported balance %q", name)
+	}
+}
+
+// clientMux 一个 tunnel client 连接，以及在其上创建的 Mux
+type clientMux struct {
+	id       int64
+	mux      *xio.Mux
+	remote   string
+	createAt time.Time
+	streams  atomic.Int64 // 活跃的 stream 数
+	done     <-chan struct{}
+	services []string        // client 注册的服务名称
+	clientID string          // client 的标识，同一个 client 的多个连接相同
+	keyID    [keyIDSize]byte // client 使用的 token 的标识
+	lastPing atomic.Int64    // 最后一次收到心跳的时间，UnixNano
+	reads    *readMonitor    // Mux 读取底层连接的情况
+
+	statusTimeout time.Duration // 等待 client 回复 stream 状态的超时时间
+
+	infos sync.Map    // stream id -> *streamInfo，活跃的 stream
+	bytes byteCounter // 已结束的 stream 的读写字节数
+}
+
+// streamInfo stream 的信息，用于管理接口展示
+type streamInfo struct {
+	meta  *StreamMeta
+	peer  string // 使用 stream 的对端地址，如外网用户的地址
+	since time.Time
+	bytes *byteCounter // 对端连接的读写字节数
+}
+
+// addStream 记录一个活跃的 stream，需要在结束时调用 removeStream
+func (cm *clientMux) addStream(stream *xio.MuxStream, info *streamInfo) {
+	cm.infos.Store(stream.ID(), info)
+}
+
+func (cm *clientMux) removeStream(stream *xio.MuxStream) {
+	v, ok := cm.infos.LoadAndDelete(stream.ID())
+	if !ok {
+		return
+	}
+	info := v.(*streamInfo)
+	cm.bytes.read.Add(info.bytes.read.Load())
+	cm.bytes.written.Add(info.bytes.written.Load())
+}
+
+func (cm *clientMux) streamInfo(id uint32) *streamInfo {
+	v, ok := cm.infos.Load(id)
+	if !ok {
+		return nil
+	}
+	return v.(*streamInfo)
+}
+
+// totalBytes 返回所有 stream 的读写字节数，包括活跃的 stream
+func (cm *clientMux) totalBytes() (read int64, written int64) {
+	read, written = cm.bytes.read.Load(), cm.bytes.written.Load()
+	cm.infos.Range(func(_, v any) bool {
+		info := v.(*streamInfo)
+		read += info.bytes.read.Load()
+		written += info.bytes.written.Load()
+		return true
+	})
+	return read, written
+}
+
+func (cm *clientMux) hasService(name string) bool {
+	return slices.Contains(cm.services, name)
+}
+
+// matchService 匹配使用 kid 对应的 token，并且注册了指定服务的连接
+func matchService(name string, kid [keyIDSize]byte) func(cm *clientMux) bool {
+	return func(cm *clientMux) bool {
+		return cm.keyID == kid && cm.hasService(name)
+	}
+}
+
+func newClientMux(id int64, rw io.ReadWriteCloser) *clientMux {
+	rm := &readMonitor{ReadWriteCloser: rw}
+	nc := &notifyCloser{
+		ReadWriteCloser: rm,
+		done:            make(chan struct{}),
+	}
+	return &clientMux{
+		id:       id,
+		mux:      xio.NewMux(false, nc),
+		remote:   rwInfo(rw),
+		createAt: time.Now(),
+		done:     nc.done,
+		reads:    rm,
+
+		statusTimeout: streamStatusTimeout(0),
+	}
+}
+
+// notifyCloser 在 Close 后关闭 done，用于感知 Mux 已关闭
+type notifyCloser struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (n *notifyCloser) Close() error {
+	n.once.Do(func() {
+		close(n.done)
+	})
+	return n.ReadWriteCloser.Close()
+}
+
+// muxPool 所有可用的 tunnel client 连接
+type muxPool struct {
+	mu      sync.Mutex
+	items   []*clientMux
+	next    int
+	changed chan struct{} // 有新连接加入时会被关闭并替换
+}
+
+func (p *muxPool) add(cm *clientMux) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.items = append(p.items, cm)
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+func (p *muxPool) remove(cm *clientMux) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, item := range p.items {
+		if item == cm {
+			p.items = append(p.items[:i], p.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// added 返回一个 channel，在有新连接加入时会被关闭
+func (p *muxPool) added() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return p.changed
+}
+
+// closeAll 关闭所有的连接
+func (p *muxPool) closeAll() {
+	p.mu.Lock()
+	items := slices.Clone(p.items)
+	p.mu.Unlock()
+	for _, item := range items {
+		_ = item.mux.Close()
+	}
+}
+
+// all 返回所有的连接
+func (p *muxPool) all() []*clientMux {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.items)
+}
+
+// get 返回指定 id 的连接，不存在时返回 nil
+func (p *muxPool) get(id int64) *clientMux {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, item := range p.items {
+		if item.id == id {
+			return item
+		}
+	}
+	return nil
+}
+
+// closeIdle 关闭所有没有活跃 stream 的连接
+func (p *muxPool) closeIdle() {
+	for _, item := range p.all() {
+		if muxIdle(item.mux) {
+			_ = item.mux.Close()
+		}
+	}
+}
+
+// muxIdle 判断 Mux 上是否没有活跃的 stream
+func muxIdle(m *xio.Mux) bool {
+	idle := true
+	m.Range(func(*xio.MuxStream) bool {
+		idle = false
+		return false
+	})
+	return idle
+}
+
+func (p *muxPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.items)
+}
+
+// pick 按照策略选择一个满足 match 的连接，若没有可用连接则返回 nil
+func (p *muxPool) pick(balance string, match func(cm *clientMux) bool) *clientMux {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.items) == 0 {
+		return nil
+	}
+	p.next++
+	// 从轮询的位置开始找，使得 stream 数相同时也能均匀分配
+	var best *clientMux
+	for i := range p.items {
+		item := p.items[(p.next+i)%len(p.items)]
+		if !match(item) {
+			continue
+		}
+		if balance != BalanceLeastStreams {
+			return item
+		}
+		if best == nil || item.streams.Load() < best.streams.Load() {
+			best = item
+		}
+	}
+	return best
+}
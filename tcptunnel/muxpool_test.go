@@ -0,0 +1,76 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"net"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func newTestClientMux(t *testing.T, id int64) *clientMux {
+	c1, c2 := net.Pipe()
+	cm := newClientMux(id, c1)
+	cm.services = []string{defaultService}
+	t.Cleanup(func() {
+		_ = cm.mux.Close()
+		_ = c2.Close()
+	})
+	return cm
+}
+
+func Test_muxPool(t *testing.T) {
+	t.Run("round robin", func(t *testing.T) {
+		var p muxPool
+		xt.Nil(t, p.pick(BalanceRoundRobin, matchService(defaultService, [keyIDSize]byte{})))
+		m1 := newTestClientMux(t, 1)
+		m2 := newTestClientMux(t, 2)
+		p.add(m1)
+		p.add(m2)
+		xt.Equal(t, 2, p.len())
+		got := map[int64]int{}
+		for i := 0; i < 10; i++ {
+			got[p.pick(BalanceRoundRobin, matchService(defaultService, [keyIDSize]byte{})).id]++
+		}
+		xt.Equal(t, map[int64]int{1: 5, 2: 5}, got)
+
+		xt.True(t, p.remove(m1))
+		xt.False(t, p.remove(m1))
+		xt.Equal(t, int64(2), p.pick(BalanceRoundRobin, matchService(defaultService, [keyIDSize]byte{})).id)
+	})
+
+	t.Run("least streams", func(t *testing.T) {
+		var p muxPool
+		m1 := newTestClientMux(t, 1)
+		m2 := newTestClientMux(t, 2)
+		p.add(m1)
+		p.add(m2)
+		m1.streams.Add(3)
+		for i := 0; i < 3; i++ {
+			xt.Equal(t, int64(2), p.pick(BalanceLeastStreams, matchService(defaultService, [keyIDSize]byte{})).id)
+		}
+		m2.streams.Add(5)
+		xt.Equal(t, int64(1), p.pick(BalanceLeastStreams, matchService(defaultService, [keyIDSize]byte{})).id)
+	})
+
+	t.Run("added", func(t *testing.T) {
+		var p muxPool
+		ch := p.added()
+		select {
+		case <-ch:
+			t.Fatal("should not closed")
+		default:
+		}
+		p.add(newTestClientMux(t, 1))
+		<-ch
+	})
+
+	t.Run("done", func(t *testing.T) {
+		m1 := newTestClientMux(t, 1)
+		_ = m1.mux.Close()
+		<-m1.done
+	})
+}
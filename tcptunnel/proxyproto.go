@@ -0,0 +1,49 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/fsgo/networks/internal/proxyproto"
+)
+
+// trustedProxy 判断连接是否来自 TrustedProxies，不是时记录指标和日志
+func (s *Server) trustedProxy(addr net.Addr) bool {
+	ip, err := addrIP(addr)
+	if err == nil && matchPrefixes(s.trustedProxies, ip) {
+		return true
+	}
+	s.getMetrics().aclRejects.With(listenerOut).Inc()
+	s.aclLog.log(s.logger(), "connection rejected, not from trusted proxies", logKeyRemote, addr.String())
+	return false
+}
+
+// readProxyHeader 读取负载均衡在连接上发送的 PROXY header，返回的连接的 RemoteAddr 为外部用户的地址
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	pc, err := proxyproto.NewConn(conn)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return pc, nil
+}
+
+// writeProxyHeader 在到本地服务的连接上发送 PROXY header，使本地服务可以获取外部用户的地址
+// 旧版本的 server 不会发送外部用户的地址，此时发送的 header 中没有地址
+func writeProxyHeader(w io.Writer, version int, meta *StreamMeta) error {
+	src, _ := netip.ParseAddrPort(meta.Peer)
+	dst, _ := netip.ParseAddrPort(meta.Dst)
+	bf, err := proxyproto.Header(version, src, dst)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(bf)
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+
+	"github.com/fsgo/networks/internal/proxyproto"
+)
+
+// startProxyProtoServer 启动一个需要 PROXY header 的服务，回复 header 中的客户端地址
+func startProxyProtoServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				pc, err := proxyproto.NewConn(conn)
+				if err != nil {
+					return
+				}
+				_, _ = io.WriteString(pc, pc.RemoteAddr().String()+"\n")
+				// 由对端先关闭，避免回复的数据还没有被读取 stream 就被关闭
+				_, _ = io.Copy(io.Discard, pc)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	readPeer := func(t *testing.T, conn net.Conn) string {
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		xt.NoError(t, err)
+		return strings.TrimSpace(line)
+	}
+
+	for _, version := range []string{"v1", "v2"} {
+		t.Run(version, func(t *testing.T) {
+			s := &Server{}
+			c := &Client{LocalAddr: startProxyProtoServer(t), ProxyProtocol: version}
+			startTestTunnel(t, s, c)
+			waitFor(t, func() bool {
+				return s.clients.len() == 1
+			})
+			conn, err := net.Dial("tcp", s.ListenOut)
+			xt.NoError(t, err)
+			defer conn.Close()
+			xt.Equal(t, conn.LocalAddr().String(), readPeer(t, conn))
+		})
+	}
+
+	t.Run("accept", func(t *testing.T) {
+		s := &Server{AcceptProxyProtocol: true, TrustedProxies: "127.0.0.1"}
+		c := &Client{LocalAddr: startProxyProtoServer(t), ProxyProtocol: "v2"}
+		startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		conn, err := net.Dial("tcp", s.ListenOut)
+		xt.NoError(t, err)
+		defer conn.Close()
+		// server 部署在负载均衡之后，本地服务获取到的是负载均衡发送的用户地址
+		header, err := proxyproto.Header(proxyproto.V1, netip.MustParseAddrPort("203.0.113.7:4242"), netip.MustParseAddrPort("198.51.100.1:443"))
+		xt.NoError(t, err)
+		_, err = conn.Write(header)
+		xt.NoError(t, err)
+		xt.Equal(t, "203.0.113.7:4242", readPeer(t, conn))
+
+		// 没有 header 的连接会被关闭
+		conn2, err := net.Dial("tcp", s.ListenOut)
+		xt.NoError(t, err)
+		defer conn2.Close()
+		_ = conn2.SetDeadline(time.Now().Add(3 * time.Second))
+		_, err = conn2.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+		xt.NoError(t, err)
+		_, err = conn2.Read(make([]byte, 1))
+		xt.Error(t, err)
+	})
+
+	t.Run("acl", func(t *testing.T) {
+		s := &Server{AcceptProxyProtocol: true, TrustedProxies: "127.0.0.1", OutDeny: "203.0.113.0/24", MaxStreams: 1}
+		c := &Client{LocalAddr: startProxyProtoServer(t), ProxyProtocol: "v2"}
+		startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		dial := func(peer string) net.Conn {
+			conn, err := net.Dial("tcp", s.ListenOut)
+			xt.NoError(t, err)
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+			_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+			header, err := proxyproto.Header(proxyproto.V1, netip.MustParseAddrPort(peer), netip.MustParseAddrPort("198.51.100.1:443"))
+			xt.NoError(t, err)
+			_, err = conn.Write(header)
+			xt.NoError(t, err)
+			return conn
+		}
+		// 占用唯一的连接数限额
+		conn := dial("198.51.100.7:4242")
+		xt.Equal(t, "198.51.100.7:4242", readPeer(t, conn))
+
+		// header 中的地址被拒绝，在检查连接数限额之前就被关闭
+		_, err := dial("203.0.113.9:4242").Read(make([]byte, 1))
+		xt.Error(t, err)
+		xt.Equal(t, uint64(1), s.getMetrics().aclRejects.With(listenerOut).Load())
+		xt.Equal(t, uint64(0), s.getMetrics().limitRejects.With(limitReasonMaxStreams).Load())
+
+		// 负载均衡的地址被拒绝时，不会读取 header
+		xt.NoError(t, s.hotUpdate(&Server{OutDeny: "127.0.0.1"}))
+		_, err = dial("198.51.100.8:4242").Read(make([]byte, 1))
+		xt.Error(t, err)
+		xt.Equal(t, uint64(2), s.getMetrics().aclRejects.With(listenerOut).Load())
+		xt.Equal(t, uint64(0), s.getMetrics().limitRejects.With(limitReasonMaxStreams).Load())
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		s := &Server{AcceptProxyProtocol: true, TrustedProxies: "10.0.0.0/8"}
+		c := &Client{LocalAddr: startProxyProtoServer(t), ProxyProtocol: "v2"}
+		startTestTunnel(t, s, c)
+		waitFor(t, func() bool {
+			return s.clients.len() == 1
+		})
+		// 不是来自可信的负载均衡，即使有 header 也会被关闭
+		conn, err := net.Dial("tcp", s.ListenOut)
+		xt.NoError(t, err)
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		header, err := proxyproto.Header(proxyproto.V1, netip.MustParseAddrPort("10.1.2.3:4242"), netip.MustParseAddrPort("198.51.100.1:443"))
+		xt.NoError(t, err)
+		_, err = conn.Write(header)
+		xt.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1))
+		xt.Error(t, err)
+		xt.Equal(t, uint64(1), s.getMetrics().aclRejects.With(listenerOut).Load())
+	})
+}
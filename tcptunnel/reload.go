@@ -0,0 +1,324 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ConfigGroup 运行配置中的 server 和 client，支持热更新
+//
+//	热更新时，配置没有变化的 tunnel 及其连接不受影响；
+//	被移除或者有变化的 tunnel 会立即停止监听，并在处理中的连接结束后（最多等待 DrainTimeout）停止，
+//	新增或者有变化的 tunnel 会使用新的配置启动。
+//	只有部分配置（如 server 的 ACL）变化时，tunnel 不会重启，直接在运行中应用新的配置。
+//	没有名称的 tunnel 以其完整的配置作为标识
+type ConfigGroup struct {
+	// Load 读取配置，必填，启动和热更新时都会调用
+	Load func() (*Config, error)
+
+	// Servers 是否运行配置中的 server
+	Servers bool
+
+	// Clients 是否运行配置中的 client
+	Clients bool
+
+	// DrainTimeout 热更新时等待被停止的 tunnel 处理中的连接结束的最长时间，可选，默认 10 秒
+	DrainTimeout time.Duration
+
+	// Logger 日志，可选，默认为 slog.Default()
+	Logger *slog.Logger
+
+	mu      sync.Mutex // 同时也保证热更新串行执行
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closing bool
+	items   map[string]*configItem
+	wg      sync.WaitGroup // 所有运行中的 tunnel，包括等待停止的
+}
+
+// configItem 一个运行中的 tunnel
+type configItem struct {
+	key         string
+	fingerprint string // 需要重启才能生效的配置的摘要
+	hot         string // 可以在运行中更新的配置的摘要
+	runner      Runner
+}
+
+// hotUpdater 可以在运行中应用 next 的部分配置，而不需要重启
+type hotUpdater interface {
+	hotUpdate(next Runner) error
+}
+
+// listenCloser 可以单独停止监听，以便于新的 tunnel 可以使用相同的地址
+type listenCloser interface {
+	closeListeners()
+}
+
+var errGroupClosed = errors.New("config group is closed")
+
+func (g *ConfigGroup) logger() *slog.Logger {
+	return getLogger(g.Logger)
+}
+
+func (g *ConfigGroup) getDrainTimeout() time.Duration {
+	if g.DrainTimeout > 0 {
+		return g.DrainTimeout
+	}
+	return 10 * time.Second
+}
+
+// Start 启动所有的 tunnel，会一直运行直到 ctx 被取消、调用了 Shutdown 或者启动时任意一个 tunnel 出错
+// 热更新后启动的 tunnel 出错时只会记录日志
+func (g *ConfigGroup) Start(ctx context.Context) error {
+	cfg, err := g.Load()
+	if err != nil {
+		return err
+	}
+	items, err := g.newItems(cfg)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return errors.New("no tunnel to run")
+	}
+
+	g.mu.Lock()
+	if g.ctx != nil {
+		g.mu.Unlock()
+		return errStarted
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	ctx = g.ctx
+	g.items = make(map[string]*configItem, len(items))
+	errs := make(chan error, len(items))
+	for _, item := range items {
+		g.items[item.key] = item
+		g.run(item, errs)
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	g.cancel()
+	g.wg.Wait()
+	return err
+}
+
+// run 在后台运行 tunnel，若 errs 不为 nil，出错时会将错误发送给 errs
+func (g *ConfigGroup) run(item *configItem, errs chan<- error) {
+	g.wg.Go(func() {
+		err := item.runner.Start(g.ctx)
+		if err == nil {
+			return
+		}
+		g.mu.Lock()
+		if g.items[item.key] == item {
+			delete(g.items, item.key)
+		}
+		g.mu.Unlock()
+		if errs != nil {
+			errs <- fmt.Errorf("%s: %w", item.key, err)
+			return
+		}
+		g.logger().Error("tunnel exit", "tunnel", item.key, errAttr(err))
+	})
+}
+
+// Shutdown 优雅关闭所有的 tunnel
+func (g *ConfigGroup) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	if g.ctx == nil || g.closing {
+		g.mu.Unlock()
+		return nil
+	}
+	g.closing = true
+	runners := make([]Runner, 0, len(g.items))
+	for _, item := range g.items {
+		runners = append(runners, item.runner)
+	}
+	g.mu.Unlock()
+
+	err := NewGroup(runners...).Shutdown(ctx)
+	g.cancel()
+	g.wg.Wait()
+	return err
+}
+
+// ReloadResult 热更新的结果，值为 tunnel 的标识
+type ReloadResult struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Updated   []string `json:"updated"` // 没有重启，在运行中应用了新的配置
+	Unchanged []string `json:"unchanged"`
+}
+
+// Reload 重新读取配置并应用，配置有误时不会有任何变化
+func (g *ConfigGroup) Reload() (*ReloadResult, error) {
+	cfg, err := g.Load()
+	if err != nil {
+		return nil, err
+	}
+	items, err := g.newItems(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ctx == nil || g.closing || g.ctx.Err() != nil {
+		return nil, errGroupClosed
+	}
+	result := &ReloadResult{}
+	var stopping []Runner
+	for key, old := range g.items {
+		item, ok := items[key]
+		switch {
+		case !ok:
+			result.Removed = append(result.Removed, key)
+		case item.fingerprint != old.fingerprint || (item.hot != old.hot && !g.hotUpdate(old, item)):
+			result.Changed = append(result.Changed, key)
+		case item.hot != old.hot:
+			old.hot = item.hot
+			result.Updated = append(result.Updated, key)
+			delete(items, key)
+			continue
+		default:
+			result.Unchanged = append(result.Unchanged, key)
+			delete(items, key)
+			continue
+		}
+		// 先停止监听，使得新的 tunnel 可以使用相同的地址
+		if lc, ok := old.runner.(listenCloser); ok {
+			lc.closeListeners()
+		}
+		stopping = append(stopping, old.runner)
+		delete(g.items, key)
+	}
+	for key, item := range items {
+		if !slices.Contains(result.Changed, key) {
+			result.Added = append(result.Added, key)
+		}
+		g.items[key] = item
+		g.run(item, nil)
+	}
+	if len(stopping) > 0 {
+		g.wg.Go(func() {
+			ctx, cancel := context.WithTimeout(g.ctx, g.getDrainTimeout())
+			defer cancel()
+			if err := NewGroup(stopping...).Shutdown(ctx); err != nil {
+				g.logger().Warn("drain stopped tunnels", errAttr(err))
+			}
+		})
+	}
+	for _, keys := range [][]string{result.Added, result.Removed, result.Changed, result.Updated, result.Unchanged} {
+		slices.Sort(keys)
+	}
+	g.logger().Info("config reloaded", "added", result.Added, "removed", result.Removed,
+		"changed", result.Changed, "updated", result.Updated, "unchanged", len(result.Unchanged))
+	return result, nil
+}
+
+// hotUpdate 在运行中的 old 上应用 item 的配置，失败时返回 false，需要重启
+func (g *ConfigGroup) hotUpdate(old *configItem, item *configItem) bool {
+	hu, ok := old.runner.(hotUpdater)
+	if !ok {
+		return false
+	}
+	if err := hu.hotUpdate(item.runner); err != nil {
+		g.logger().Warn("hot update failed, restart", "tunnel", old.key, errAttr(err))
+		return false
+	}
+	return true
+}
+
+// newItems 使用配置创建所有需要运行的 tunnel，key 为 tunnel 的标识
+func (g *ConfigGroup) newItems(cfg *Config) (map[string]*configItem, error) {
+	items := make(map[string]*configItem)
+	add := func(kind string, name string, sub any, hot any, files []string, runner Runner) error {
+		fp, err := fingerprint(sub, files)
+		if err != nil {
+			return err
+		}
+		hfp, err := fingerprint(hot, nil)
+		if err != nil {
+			return err
+		}
+		key := kind + "/" + name
+		if name == "" {
+			key = kind + "#" + fp[:12]
+		}
+		if _, has := items[key]; has {
+			return fmt.Errorf("duplicate %s", key)
+		}
+		items[key] = &configItem{key: key, fingerprint: fp, hot: hfp, runner: runner}
+		return nil
+	}
+	if g.Servers {
+		servers, err := cfg.NewServers(g.Logger)
+		if err != nil {
+			return nil, err
+		}
+		for i, sc := range cfg.Servers {
+			s := servers[i]
+			s.OnReload = g.Reload
+			files := []string{sc.TLSCertFile, sc.TLSKeyFile, sc.TLSClientCAFile}
+			// ACL 可以在运行中更新
+			cold := *sc
+			cold.OutAllow, cold.OutDeny, cold.ClientAllow, cold.ClientDeny = "", "", "", ""
+			hot := []string{sc.OutAllow, sc.OutDeny, sc.ClientAllow, sc.ClientDeny}
+			if err = add("server", sc.Name, &cold, hot, files, s); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if g.Clients {
+		clients, err := cfg.NewClients(g.Logger)
+		if err != nil {
+			return nil, err
+		}
+		for i, cc := range cfg.Clients {
+			files := []string{cc.TLSCAFile, cc.TLSCertFile, cc.TLSKeyFile}
+			if err = add("client", cc.Name, cc, nil, files, clients[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return items, nil
+}
+
+// fingerprint 配置及其引用的文件内容的摘要，用于判断配置是否有变化
+func fingerprint(v any, files []string) (string, error) {
+	h := sha256.New()
+	bf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	h.Write(bf)
+	for _, name := range files {
+		if name == "" {
+			continue
+		}
+		content, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		h.Write(content)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
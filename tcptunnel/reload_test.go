@@ -0,0 +1,156 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func TestConfigGroupReload(t *testing.T) {
+	type tunnel struct {
+		name, in, out, local, token string
+	}
+	newTunnel := func(name string) tunnel {
+		return tunnel{name: name, in: freeAddr(t), out: freeAddr(t), local: startEchoServer(t), token: "token-" + name}
+	}
+	fp := filepath.Join(t.TempDir(), "tunnels.json")
+	adminAddr := freeAddr(t)
+	writeConfig := func(tunnels ...tunnel) {
+		var servers, clients []string
+		for _, tn := range tunnels {
+			server := fmt.Sprintf(`{"name": %q, "in": %q, "out": %q, "token": %q`, tn.name, tn.in, tn.out, tn.token)
+			if tn.name == "a" {
+				server += fmt.Sprintf(`, "admin": %q, "admin-token": "admin-secret"`, adminAddr)
+			}
+			servers = append(servers, server+"}")
+			clients = append(clients, fmt.Sprintf(`{"name": %q, "remote": %q, "local": %q, "token": %q}`, tn.name, tn.in, tn.local, tn.token))
+		}
+		content := `{"servers": [` + strings.Join(servers, ",") + `], "clients": [` + strings.Join(clients, ",") + `]}`
+		xt.NoError(t, os.WriteFile(fp, []byte(content), 0600))
+	}
+	a, b, d := newTunnel("a"), newTunnel("b"), newTunnel("d")
+	writeConfig(a, b, d)
+
+	g := &ConfigGroup{
+		Load: func() (*Config, error) {
+			return LoadConfig(fp)
+		},
+		Servers:      true,
+		Clients:      true,
+		DrainTimeout: time.Second,
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Start(t.Context())
+	}()
+	server := func(name string) *Server {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if item := g.items["server/"+name]; item != nil {
+			return item.runner.(*Server)
+		}
+		return nil
+	}
+	waitReady := func(name string) {
+		waitFor(t, func() bool {
+			s := server(name)
+			return s != nil && s.clients.len() == 1
+		})
+	}
+	for _, name := range []string{"a", "b", "d"} {
+		waitReady(name)
+	}
+	sa, sb := server("a"), server("b")
+	conn := dialEcho(t, a.out)
+	defer conn.Close()
+
+	b.token = "token-b2"
+	c := newTunnel("c")
+	writeConfig(a, b, c)
+	req, err := http.NewRequest(http.MethodPost, "http://"+adminAddr+"/reload", nil)
+	xt.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer admin-secret")
+	resp, err := http.DefaultClient.Do(req)
+	xt.NoError(t, err)
+	defer resp.Body.Close()
+	xt.Equal(t, http.StatusOK, resp.StatusCode)
+	result := &ReloadResult{}
+	xt.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	xt.Equal(t, []string{"client/c", "server/c"}, result.Added)
+	xt.Equal(t, []string{"client/d", "server/d"}, result.Removed)
+	xt.Equal(t, []string{"client/b", "server/b"}, result.Changed)
+	xt.Equal(t, []string{"client/a", "server/a"}, result.Unchanged)
+
+	// 没有变化的 tunnel 及其连接不受影响
+	xt.True(t, sa == server("a"))
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Write([]byte("again"))
+	xt.NoError(t, err)
+	bf := make([]byte, 5)
+	_, err = conn.Read(bf)
+	xt.NoError(t, err)
+	xt.Equal(t, "again", string(bf))
+
+	// 被移除的 tunnel 停止监听
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", d.out)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err != nil
+	})
+
+	// 有变化的和新增的 tunnel 使用新的配置
+	xt.True(t, sb != server("b"))
+	xt.Equal(t, "token-b2", server("b").Token)
+	for _, tn := range []tunnel{b, c} {
+		waitReady(tn.name)
+		xt.NoError(t, echoOnce(tn.out, "hello"))
+	}
+
+	t.Run("invalid config", func(t *testing.T) {
+		xt.NoError(t, os.WriteFile(fp, []byte(`{"servers": [{"name": "a"}]}`), 0600))
+		_, err := g.Reload()
+		xt.ErrorContains(t, err, "no service to export")
+		xt.True(t, sa == server("a"))
+		xt.NotNil(t, server("c"))
+	})
+
+	_ = conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	xt.NoError(t, g.Shutdown(ctx))
+	select {
+	case err = <-done:
+		xt.NoError(t, err)
+	case <-time.After(3 * time.Second):
+		t.Fatal("config group not stopped")
+	}
+	writeConfig(a, b, c)
+	_, err = g.Reload()
+	xt.ErrorIs(t, err, errGroupClosed)
+}
+
+func TestServerAdminReload(t *testing.T) {
+	s := &Server{AdminAddr: freeAddr(t), AdminToken: "admin-secret"}
+	startTestTunnel(t, s, &Client{})
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	waitFor(t, func() bool {
+		return adminDo(t, s, http.MethodPost, "/reload", s.AdminToken, nil) == http.StatusNotImplemented
+	})
+}
@@ -0,0 +1,263 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// RemotePortAny 表示由 server 在允许的端口范围内任选一个可用端口
+const RemotePortAny = -1
+
+// portRanges 端口范围，如 20000-20100,30000
+type portRanges [][2]int
+
+func parsePortRanges(str string) (portRanges, error) {
+	var result portRanges
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		a, b, found := strings.Cut(item, "-")
+		if !found {
+			b = a
+		}
+		start, err1 := strconv.Atoi(strings.TrimSpace(a))
+		end, err2 := strconv.Atoi(strings.TrimSpace(b))
+		if err1 != nil || err2 != nil || start < 1 || end > 65535 || start > end {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+		result = append(result, [2]int{start, end})
+	}
+	return result, nil
+}
+
+func (pr portRanges) contains(port int) bool {
+	for _, r := range pr {
+		if port >= r[0] && port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+func (pr portRanges) size() int {
+	var n int
+	for _, r := range pr {
+		n += r[1] - r[0] + 1
+	}
+	return n
+}
+
+// nth 返回所有端口中的第 n 个（从 0 开始）
+func (pr portRanges) nth(n int) int {
+	for _, r := range pr {
+		if n <= r[1]-r[0] {
+			return r[0] + n
+		}
+		n -= r[1] - r[0] + 1
+	}
+	return 0
+}
+
+// maxPortTries 请求任意端口时，最多尝试监听的次数
+const maxPortTries = 100
+
+var errPortNotAllowed = errors.New("port not allowed")
+
+// listen 在 host 上监听 port，port 为 0 时在 pr 范围内任选一个可用端口
+func (pr portRanges) listen(host string, port int) (net.Listener, error) {
+	if port != 0 {
+		if !pr.contains(port) {
+			return nil, fmt.Errorf("%w: %d", errPortNotAllowed, port)
+		}
+		return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	total := pr.size()
+	if total == 0 {
+		return nil, fmt.Errorf("%w: no port range", errPortNotAllowed)
+	}
+	offset := rand.IntN(total)
+	var err error
+	for i := 0; i < min(total, maxPortTries); i++ {
+		p := pr.nth((offset + i) % total)
+		var l net.Listener
+		l, err = net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(p)))
+		if err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in range: %w", err)
+}
+
+var _ flag.Value = (*TokenPorts)(nil)
+
+// TokenPorts 多个 token 及其允许 client 请求监听的端口范围，key 为 token
+// 可以作为 flag 使用，格式如 token1:20000-20100;token2:30000,30001
+type TokenPorts map[string]string
+
+func (tp *TokenPorts) Set(str string) error {
+	if *tp == nil {
+		*tp = make(TokenPorts)
+	}
+	for _, item := range strings.Split(str, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		token, ports, ok := strings.Cut(item, ":")
+		if !ok || token == "" {
+			return fmt.Errorf("invalid token ports %q, expect token:ports", item)
+		}
+		if _, err := parsePortRanges(ports); err != nil {
+			return err
+		}
+		(*tp)[token] = ports
+	}
+	return nil
+}
+
+func (tp *TokenPorts) String() string {
+	if tp == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*tp))
+	for token, ports := range *tp {
+		// 避免在帮助信息等地方泄露 token
+		items = append(items, strings.Repeat("*", len(token))+":"+ports)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ";")
+}
+
+// remoteListener client 请求 server 监听的端口
+type remoteListener struct {
+	ln   net.Listener
+	refs int // 使用此监听的 client 连接数
+}
+
+// remoteListeners 所有 client 请求 server 监听的端口，key 为 token 标识、clientID 和服务名称
+// 同一个 client 的多个连接共用一个监听，在所有连接都断开后关闭
+type remoteListeners struct {
+	mu     sync.Mutex
+	items  map[string]*remoteListener
+	closed bool
+}
+
+var errRemoteClosed = errors.New("remote listeners closed")
+
+// Close 关闭所有的监听，之后不能再创建新的监听
+func (rs *remoteListeners) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.closed = true
+	for key, item := range rs.items {
+		_ = item.ln.Close()
+		delete(rs.items, key)
+	}
+	return nil
+}
+
+func remoteKey(kid [keyIDSize]byte, clientID string, service string) string {
+	return fmt.Sprintf("%x/%s/%s", kid, clientID, service)
+}
+
+// acquire 获取 key 对应的监听，若不存在则使用 listen 创建，created 表示是否新创建
+func (rs *remoteListeners) acquire(key string, listen func() (net.Listener, error)) (ln net.Listener, created bool, err error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.closed {
+		return nil, false, errRemoteClosed
+	}
+	if item, ok := rs.items[key]; ok {
+		item.refs++
+		return item.ln, false, nil
+	}
+	ln, err = listen()
+	if err != nil {
+		return nil, false, err
+	}
+	if rs.items == nil {
+		rs.items = make(map[string]*remoteListener)
+	}
+	rs.items[key] = &remoteListener{ln: ln, refs: 1}
+	return ln, true, nil
+}
+
+// release 释放 key 对应的监听，在没有连接使用后关闭
+func (rs *remoteListeners) release(key string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	item, ok := rs.items[key]
+	if !ok {
+		return
+	}
+	item.refs--
+	if item.refs > 0 {
+		return
+	}
+	delete(rs.items, key)
+	_ = item.ln.Close()
+}
+
+func (rs *remoteListeners) len() int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return len(rs.items)
+}
+
+var errClientIDTaken = errors.New("client id is used by another token")
+
+// clientBindings clientID 和 token 标识的绑定，在使用此 clientID 的连接都断开后解除
+// 同一个 clientID 只能使用一个 token，避免使用其他 token 的 client 冒用 clientID，接管其监听的端口和 stream
+type clientBindings struct {
+	mu    sync.Mutex
+	items map[string]*clientBinding
+}
+
+type clientBinding struct {
+	kid  [keyIDSize]byte
+	refs int // 使用此 clientID 的连接数
+}
+
+// bind 绑定 clientID 和 kid，若 clientID 已经绑定了其他的 token 则返回 errClientIDTaken
+func (cb *clientBindings) bind(clientID string, kid [keyIDSize]byte) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if item, ok := cb.items[clientID]; ok {
+		if item.kid != kid {
+			return fmt.Errorf("%w: %q", errClientIDTaken, clientID)
+		}
+		item.refs++
+		return nil
+	}
+	if cb.items == nil {
+		cb.items = make(map[string]*clientBinding)
+	}
+	cb.items[clientID] = &clientBinding{kid: kid, refs: 1}
+	return nil
+}
+
+func (cb *clientBindings) unbind(clientID string) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	item, ok := cb.items[clientID]
+	if !ok {
+		return
+	}
+	item.refs--
+	if item.refs <= 0 {
+		delete(cb.items, clientID)
+	}
+}
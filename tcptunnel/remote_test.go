@@ -0,0 +1,109 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+func Test_portRanges(t *testing.T) {
+	pr, err := parsePortRanges("20000-20002, 30000")
+	xt.NoError(t, err)
+	xt.Equal(t, portRanges{{20000, 20002}, {30000, 30000}}, pr)
+	xt.Equal(t, 4, pr.size())
+	xt.Equal(t, 20001, pr.nth(1))
+	xt.Equal(t, 30000, pr.nth(3))
+	xt.True(t, pr.contains(20002))
+	xt.False(t, pr.contains(20003))
+
+	for _, str := range []string{"abc", "0", "20-10", "1-70000"} {
+		_, err = parsePortRanges(str)
+		xt.Error(t, err)
+	}
+
+	pr, err = parsePortRanges("")
+	xt.NoError(t, err)
+	_, err = pr.listen("127.0.0.1", 0)
+	xt.ErrorIs(t, err, errPortNotAllowed)
+}
+
+func Test_portRangesListen(t *testing.T) {
+	_, ps, _ := net.SplitHostPort(freeAddr(t))
+	port, _ := strconv.Atoi(ps)
+	pr := portRanges{{port, port}}
+
+	l, err := pr.listen("127.0.0.1", 0)
+	xt.NoError(t, err)
+	xt.Equal(t, net.JoinHostPort("127.0.0.1", ps), l.Addr().String())
+
+	// 端口已被占用
+	_, err = pr.listen("127.0.0.1", port)
+	xt.Error(t, err)
+	_ = l.Close()
+
+	_, err = pr.listen("127.0.0.1", port+1)
+	xt.ErrorIs(t, err, errPortNotAllowed)
+}
+
+func TestTokenPorts(t *testing.T) {
+	var tp TokenPorts
+	xt.NoError(t, tp.Set("abc:20000-20100;de:30000,30001"))
+	xt.Equal(t, TokenPorts{"abc": "20000-20100", "de": "30000,30001"}, tp)
+	xt.Equal(t, "***:20000-20100;**:30000,30001", tp.String())
+	xt.Error(t, tp.Set("abc"))
+	xt.Error(t, tp.Set("abc:x"))
+
+	s := &Server{Token: "abc", Tokens: TokenPorts{"abc": "20000"}}
+	xt.Error(t, s.initTokens())
+	s.Tokens = tp
+	s.Token = "xyz"
+	xt.NoError(t, s.initTokens())
+	token, ok := s.lookupToken(keyID("de"))
+	xt.True(t, ok)
+	xt.Equal(t, "de", token)
+	_, ok = s.lookupToken(keyID("other"))
+	xt.False(t, ok)
+}
+
+func Test_remoteListeners(t *testing.T) {
+	var rs remoteListeners
+	var opened int
+	listen := func() (net.Listener, error) {
+		opened++
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+	l1, created, err := rs.acquire(remoteKey(keyID("t1"), "c1", "web"), listen)
+	xt.NoError(t, err)
+	xt.True(t, created)
+	l2, created, err := rs.acquire(remoteKey(keyID("t1"), "c1", "web"), listen)
+	xt.NoError(t, err)
+	xt.False(t, created)
+	xt.Equal(t, l1.Addr().String(), l2.Addr().String())
+	xt.Equal(t, 1, opened)
+
+	rs.release(remoteKey(keyID("t1"), "c1", "web"))
+	xt.Equal(t, 1, rs.len())
+	rs.release(remoteKey(keyID("t1"), "c1", "web"))
+	xt.Equal(t, 0, rs.len())
+	_, err = l1.Accept()
+	xt.Error(t, err)
+	rs.release(remoteKey(keyID("t1"), "c1", "web"))
+}
+
+func Test_clientBindings(t *testing.T) {
+	var cb clientBindings
+	xt.NoError(t, cb.bind("c1", keyID("t1")))
+	xt.NoError(t, cb.bind("c1", keyID("t1")))
+	xt.ErrorIs(t, cb.bind("c1", keyID("t2")), errClientIDTaken)
+	cb.unbind("c1")
+	xt.ErrorIs(t, cb.bind("c1", keyID("t2")), errClientIDTaken)
+	cb.unbind("c1")
+	// 所有连接都断开后，可以被其他 token 使用
+	xt.NoError(t, cb.bind("c1", keyID("t2")))
+}
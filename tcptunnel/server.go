@@ -5,20 +5,21 @@
 package tcptunnel
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
 	"sync/atomic"
 	"time"
 
 	"github.com/xanygo/anygo/cli/xflag"
-	"github.com/xanygo/anygo/ds/xsync"
 	"github.com/xanygo/anygo/xio"
+	"github.com/xanygo/anygo/xio/xfs"
 	"github.com/xanygo/anygo/xnet/xrps"
 
 	"github.com/fsgo/networks/internal"
@@ -30,18 +31,158 @@ func NewServer() *Server {
 
 // Server 用于提供外网服务
 type Server struct {
-	// ListenOut 对外转发的监听地址，必填
+	// Name 名称，可选，记录在访问日志的 tunnel 字段中
+	Name string
+
+	// ListenOut 对外转发的监听地址，即默认服务的监听地址，可选
+	// 和 Services、AllowPorts 至少配置一个
 	ListenOut string
 
+	// Services 对外发布的多个服务，可选
+	// 每个服务有独立的监听地址，转发给注册了同名服务的 Client
+	Services ServerServices
+
+	outs []*ServerService // 所有需要监听的服务，包括默认服务
+
 	// ListenClient 为 Client 准备的监听地址，必填
 	ListenClient string
 
 	// Token 加密密码，可选
 	Token string
 
-	clientMux  xsync.Value[*xio.Mux]
-	needConnCh chan struct{} // 需要一个新连接的信号
-	newConnCh  chan struct{} // 有一个新连接的信号
+	// AllowPorts 使用 Token 的 client 可以请求 server 监听的端口范围，如 20000-20100,30000，可选
+	// 为空时不允许 client 请求监听端口
+	AllowPorts string
+
+	// Tokens 额外的 token 及其允许 client 请求监听的端口范围，可选
+	// 使用这些 token 的 client 只能接收为其监听的端口上的连接，不能接收 ListenOut 和 Services 的连接
+	Tokens TokenPorts
+
+	// RemoteHost 为 client 监听端口时使用的 host，可选，默认监听所有地址
+	RemoteHost string
+
+	tokens   map[[keyIDSize]byte]string // token 标识 -> token
+	mainKID  [keyIDSize]byte            // Token 的标识，只有使用 Token 的 client 可以接收 ListenOut 和 Services 的连接
+	ports    map[string]portRanges      // token -> 允许监听的端口范围
+	remotes  remoteListeners            // 为 client 监听的端口
+	bindings clientBindings             // clientID 和 token 的绑定
+
+	// Cipher 加密算法，可选，默认为 aes-ctr，和 client 的必须一致
+	Cipher string
+
+	cipherID byte
+
+	// TLSCertFile 和 TLSKeyFile 为 ListenClient 的 TLS 证书，配置后 Client 需要使用 TLS 连接，可选
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientCAFile 校验 client 证书的 CA 文件，配置后启用 mTLS，可选
+	TLSClientCAFile string
+
+	// TLSConfig 完整的 TLS 配置，可选，若有值，则会忽略上述 TLS 开头的其他配置
+	TLSConfig *tls.Config
+
+	tlsConfig *tls.Config
+
+	// AllowTargets 正向隧道允许 client 访问的目标地址，可选，为空时不允许
+	// 格式如 10.0.0.0/8:3306,db.internal:*,127.0.0.1:8000-8100，host 为 * 表示任意 host，CIDR 只匹配 IP 格式的地址
+	AllowTargets string
+
+	targets targetRules
+
+	// UDPIdleTimeout udp 服务的会话空闲超时时间，可选，默认为 1 分钟
+	UDPIdleTimeout time.Duration
+
+	// IdleTimeout tcp 的连接两个方向都超过此时间没有数据时关闭，可选，默认不超时，
+	// 但一个方向半关闭后，另一个方向超过 2 分钟没有数据时也会关闭
+	IdleTimeout time.Duration
+
+	// AcceptProxyProtocol ListenOut、Services 和为 client 监听的端口上的连接是否以 PROXY protocol header（v1 或 v2）开始，可选
+	// 用于 server 部署在负载均衡之后，开启后没有 header 的连接会被关闭，需要同时设置 TrustedProxies
+	AcceptProxyProtocol bool
+
+	// TrustedProxies 可信的负载均衡的地址，格式同 OutAllow，开启 AcceptProxyProtocol 时必填
+	// 只信任来自这些地址的 PROXY header，其他来源的连接会被直接关闭，避免外部用户伪造来源地址绕过 OutAllow 和 OutDeny
+	TrustedProxies string
+
+	trustedProxies []netip.Prefix
+
+	// OutAllow 和 OutDeny ListenOut、Services 和为 client 监听的端口允许和拒绝的来源 IP，可选
+	// 格式如 10.0.0.0/8,192.168.1.10，先匹配 OutDeny，OutAllow 不为空时只允许其中的 IP
+	// 开启 AcceptProxyProtocol 时，连接的地址（负载均衡）和 PROXY header 中的地址都需要被允许，
+	// 即 OutAllow 不为空时需要包含负载均衡的地址
+	OutAllow string
+	OutDeny  string
+
+	// ClientAllow 和 ClientDeny ListenClient 允许和拒绝的来源 IP，可选，格式同 OutAllow
+	ClientAllow string
+	ClientDeny  string
+
+	acl    atomic.Pointer[serverACL]
+	aclLog logLimiter
+
+	// Bandwidth 所有外部 tcp 连接的带宽限制，单位为字节每秒，上行和下行分别计算，可选，默认不限制
+	// 带宽限制不作用于 udp 服务
+	Bandwidth int
+
+	// ServiceBandwidth 每个服务（ListenOut、Services 和为 client 监听的端口）的带宽限制，单位同 Bandwidth，可选
+	ServiceBandwidth int
+
+	// IPBandwidth 每个外部用户 IP 的带宽限制，单位同 Bandwidth，可选
+	IPBandwidth int
+
+	// MaxStreams 最多同时处理的外部 tcp 连接和 udp 会话数，可选，默认不限制
+	MaxStreams int
+
+	// StreamRate 每秒最多接受的新外部 tcp 连接和 udp 会话数，可选，默认不限制
+	// 允许的突发数量为 StreamRate 向上取整，如 2.5 时最多连续接受 3 个
+	StreamRate float64
+
+	// LimitWait 超过 MaxStreams 或者 StreamRate 时，新连接最多排队等待的时间，可选，默认为 0，即直接拒绝
+	// 新的 udp 会话不排队，总是直接丢弃数据包
+	LimitWait time.Duration
+
+	limits   atomic.Pointer[serverLimits]
+	limitLog logLimiter
+
+	// AccessLog 访问日志的文件路径，每个外部 tcp 连接结束时记录一行，可选，为空时不记录
+	AccessLog string
+
+	// AccessLogFormat 访问日志的格式，可选值：json（默认）、combined
+	AccessLogFormat string
+
+	// AccessLogRotate 访问日志的切割周期，如 1hour（默认）、1day、no，可选值见 xfs.ExtRules
+	AccessLogRotate string
+
+	// AccessLogMaxFiles 访问日志最多保留的文件数，可选，默认为 24，-1 表示不清理
+	AccessLogMaxFiles int
+
+	accessLog *accessLogger
+
+	// Balance 有多个 tunnel client 连接时，选择连接的策略，可选
+	// 可选值：round_robin（默认）、least_streams
+	Balance string
+
+	// MetricsAddr 以 Prometheus 文本格式输出指标的 http 监听地址，路径为 /metrics，可选
+	MetricsAddr string
+
+	metrics metricsOnce[serverMetrics]
+
+	// AdminAddr 管理接口的 http 监听地址，可选，配置后 AdminToken 必填
+	AdminAddr string
+
+	// AdminToken 管理接口的 token，和 Token 相互独立
+	AdminToken string
+
+	// OnReload 管理接口 POST /reload 时调用，用于热更新配置，可选
+	OnReload func() (*ReloadResult, error)
+
+	// Logger 日志，可选，默认为 slog.Default()
+	Logger *slog.Logger
+
+	nonces *nonceCache // 已使用过的 client nonce，用于防止重放
+
+	clients muxPool // 所有 tunnel client 的连接
 
 	cntStreamTotal    atomic.Int64 // 累计创建的 stream 总数
 	cntStreamErrTotal atomic.Int64 // stream 读写后 err!=nil 的总数
@@ -51,44 +192,341 @@ type Server struct {
 
 	cntClientNow   atomic.Int64 // 连接中的 client
 	cntClientTotal atomic.Int64 // client 累计连接数
+
+	cntForwardNow   atomic.Int64 // 处理中的正向隧道 stream
+	cntForwardTotal atomic.Int64
+
+	cntUDPSessionNow   atomic.Int64 // 活跃的 udp 会话
+	cntUDPSessionTotal atomic.Int64
+
+	lc lifecycle
 }
 
 func (s *Server) BindFlags() {
 	xflag.EnvStringVar(&s.ListenOut, "out", "TT_S_out", "127.0.0.1:8100", "addr export")
 	xflag.EnvStringVar(&s.ListenClient, "in", "TT_S_in", ":8090", "addr for tunnel client")
 	xflag.EnvStringVar(&s.Token, "token", "TT_S_token", defaultToken, "token")
+	xflag.EnvStringVar(&s.AllowPorts, "allow-ports", "TT_S_allow_ports", "", "ports clients with token can ask server to listen, e.g. 20000-20100,30000")
+	xflag.EnvStringVar(&s.RemoteHost, "remote-host", "TT_S_remote_host", "", "host to listen for ports asked by clients")
+	xflag.EnvStringVar(&s.AllowTargets, "allow-targets", "TT_S_allow_targets", "", "targets clients can forward to, e.g. 10.0.0.0/8:3306,db.internal:*")
+	envVar(&s.Tokens, "tokens", "TT_S_tokens", "extra tokens and their allowed ports, e.g. token1:20000-20100;token2:30000")
+	xflag.EnvStringVar(&s.Cipher, "cipher", "TT_S_cipher", "aes-ctr", cipherUsage)
+	xflag.EnvStringVar(&s.TLSCertFile, "tls-cert", "TT_S_tls_cert", "", "tls certificate file for tunnel client")
+	xflag.EnvStringVar(&s.TLSKeyFile, "tls-key", "TT_S_tls_key", "", "tls key file for tunnel client")
+	xflag.EnvStringVar(&s.TLSClientCAFile, "tls-client-ca", "TT_S_tls_client_ca", "", "tls ca file to verify client certificate (mTLS)")
+	xflag.EnvStringVar(&s.Balance, "balance", "TT_S_balance", BalanceRoundRobin, "balance between tunnel clients: round_robin, least_streams")
+	envVar(&s.Services, "services", "TT_S_services", "named services to export, e.g. web=:8100,ssh=:8022,dns=udp://:8053")
+	xflag.EnvBoolVar(&s.AcceptProxyProtocol, "accept-proxy-protocol", "TT_S_accept_proxy_protocol", false, "read PROXY protocol header on exported ports, when server is behind a load balancer")
+	xflag.EnvStringVar(&s.TrustedProxies, "trusted-proxies", "TT_S_trusted_proxies", "", "load balancer ips trusted to send PROXY protocol header, e.g. 10.0.0.0/8, required with accept-proxy-protocol")
+	xflag.EnvStringVar(&s.OutAllow, "out-allow", "TT_S_out_allow", "", "source ips allowed to connect exported ports, e.g. 10.0.0.0/8,192.168.1.10")
+	xflag.EnvStringVar(&s.OutDeny, "out-deny", "TT_S_out_deny", "", "source ips denied to connect exported ports")
+	xflag.EnvStringVar(&s.ClientAllow, "client-allow", "TT_S_client_allow", "", "source ips allowed to connect the addr for tunnel client")
+	xflag.EnvStringVar(&s.ClientDeny, "client-deny", "TT_S_client_deny", "", "source ips denied to connect the addr for tunnel client")
+	xflag.EnvIntVar(&s.Bandwidth, "bandwidth", "TT_S_bandwidth", 0, "bandwidth limit of all outer connections in bytes per second for each direction, 0 for unlimited")
+	xflag.EnvIntVar(&s.ServiceBandwidth, "service-bandwidth", "TT_S_service_bandwidth", 0, "bandwidth limit of each service in bytes per second for each direction")
+	xflag.EnvIntVar(&s.IPBandwidth, "ip-bandwidth", "TT_S_ip_bandwidth", 0, "bandwidth limit of each outer ip in bytes per second for each direction")
+	xflag.EnvIntVar(&s.MaxStreams, "max-streams", "TT_S_max_streams", 0, "max concurrent outer connections and udp sessions, 0 for unlimited")
+	xflag.EnvFloat64Var(&s.StreamRate, "stream-rate", "TT_S_stream_rate", 0, "max new outer connections and udp sessions per second, 0 for unlimited")
+	xflag.EnvDurationVar(&s.LimitWait, "limit-wait", "TT_S_limit_wait", 0, "max time new outer connections wait in queue when over limits, 0 to reject at once")
+	xflag.EnvStringVar(&s.AccessLog, "access-log", "TT_S_access_log", "", "access log file of outer tcp connections, e.g. ./log/access.log")
+	xflag.EnvStringVar(&s.AccessLogFormat, "access-log-format", "TT_S_access_log_format", AccessLogJSON, "access log format: json, combined")
+	xflag.EnvStringVar(&s.AccessLogRotate, "access-log-rotate", "TT_S_access_log_rotate", "1hour", "access log rotate rule, e.g. 1hour, 1day, no")
+	xflag.EnvIntVar(&s.AccessLogMaxFiles, "access-log-max-files", "TT_S_access_log_max_files", 24, "max access log files to keep, -1 to keep all")
+	xflag.EnvDurationVar(&s.UDPIdleTimeout, "udp-idle", "TT_S_udp_idle", defaultUDPIdleTimeout, "idle timeout of udp sessions")
+	xflag.EnvDurationVar(&s.IdleTimeout, "idle-timeout", "TT_S_idle_timeout", 0, "close tcp connections idle for this long in both directions, 0 to disable")
+	xflag.EnvStringVar(&s.MetricsAddr, "metrics", "TT_S_metrics", "", "addr to serve prometheus metrics at /metrics, e.g. 127.0.0.1:9100")
+	xflag.EnvStringVar(&s.AdminAddr, "admin", "TT_S_admin", "", "addr to serve admin api, e.g. 127.0.0.1:9200")
+	xflag.EnvStringVar(&s.AdminToken, "admin-token", "TT_S_admin_token", "", "token of admin api, required when admin is set")
+}
+
+func (s *Server) logger() *slog.Logger {
+	return getLogger(s.Logger)
+}
+
+func (s *Server) initServices() error {
+	s.outs = nil
+	names := make(map[string]bool, len(s.Services)+1)
+	if s.ListenOut != "" {
+		s.outs = append(s.outs, &ServerService{Name: defaultService, Listen: s.ListenOut})
+		names[defaultService] = true
+	}
+	for _, svc := range s.Services {
+		if svc.Name == defaultService || svc.Listen == "" {
+			return fmt.Errorf("invalid service %q=%q", svc.Name, svc.Listen)
+		}
+		if svc.Network != "" && svc.Network != networkTCP && svc.Network != networkUDP {
+			return fmt.Errorf("invalid network %q of service %q", svc.Network, svc.Name)
+		}
+		if names[svc.Name] {
+			return fmt.Errorf("duplicate service %q", svc.Name)
+		}
+		names[svc.Name] = true
+		s.outs = append(s.outs, svc)
+	}
+	if len(s.outs) == 0 && s.AllowPorts == "" && len(s.Tokens) == 0 && s.AllowTargets == "" {
+		return errors.New("no service to export, ListenOut, Services, AllowPorts and AllowTargets are all empty")
+	}
+	return nil
+}
+
+func (s *Server) initTokens() error {
+	s.tokens = make(map[[keyIDSize]byte]string, len(s.Tokens)+1)
+	s.ports = make(map[string]portRanges, len(s.Tokens)+1)
+	add := func(token string, ports string) error {
+		pr, err := parsePortRanges(ports)
+		if err != nil {
+			return err
+		}
+		id := keyID(token)
+		if _, has := s.tokens[id]; has {
+			return errors.New("duplicate token")
+		}
+		s.tokens[id] = token
+		s.ports[token] = pr
+		return nil
+	}
+	if err := add(s.Token, s.AllowPorts); err != nil {
+		return err
+	}
+	s.mainKID = keyID(s.Token)
+	for token, ports := range s.Tokens {
+		if err := add(token, ports); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) lookupToken(kid [keyIDSize]byte) (string, bool) {
+	token, ok := s.tokens[kid]
+	return token, ok
+}
+
+func (s *Server) hasService(name string) bool {
+	for _, svc := range s.outs {
+		if svc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// init 校验配置并初始化
+func (s *Server) init() error {
+	id, err := parseCipher(s.Cipher)
+	if err != nil {
+		return err
+	}
+	s.cipherID = id
+	s.tlsConfig, err = s.getTLSConfig()
+	if err != nil {
+		return err
+	}
+	if err = checkBalance(s.Balance); err != nil {
+		return err
+	}
+	if err = s.initServices(); err != nil {
+		return err
+	}
+	if err = s.initTokens(); err != nil {
+		return err
+	}
+	if s.targets, err = parseTargetRules(s.AllowTargets); err != nil {
+		return err
+	}
+	acl, err := s.newACL()
+	if err != nil {
+		return err
+	}
+	s.acl.Store(acl)
+	if s.trustedProxies, err = parsePrefixes(s.TrustedProxies); err != nil {
+		return fmt.Errorf("invalid TrustedProxies: %w", err)
+	}
+	if s.AcceptProxyProtocol && len(s.trustedProxies) == 0 {
+		return errors.New("TrustedProxies is required when AcceptProxyProtocol is set")
+	}
+	if s.Bandwidth < 0 || s.ServiceBandwidth < 0 || s.IPBandwidth < 0 || s.MaxStreams < 0 || s.StreamRate < 0 || s.LimitWait < 0 {
+		return errors.New("bandwidth and connection limits must not be negative")
+	}
+	s.limits.Store(newServerLimits(s))
+	if err = checkAccessLogFormat(s.AccessLogFormat); err != nil {
+		return err
+	}
+	if _, has := xfs.ExtRules[s.AccessLogRotate]; s.AccessLogRotate != "" && !has {
+		return fmt.Errorf("unsupported access log rotate rule %q", s.AccessLogRotate)
+	}
+	if s.AdminAddr != "" && s.AdminToken == "" {
+		return errors.New("AdminToken is required when AdminAddr is set")
+	}
+	if s.ListenClient == "" {
+		return errors.New("ListenClient is required")
+	}
+	s.nonces = newNonceCache(2 * maxClockSkew)
+	return nil
 }
 
-func (s *Server) Start() error {
-	s.needConnCh = make(chan struct{}, 1)
-	s.newConnCh = make(chan struct{})
+// Start 启动服务，会一直运行直到 ctx 被取消、调用了 Shutdown 或者出现错误
+// 通过 ctx 或者 Shutdown 停止时返回 nil
+func (s *Server) Start(ctx context.Context) error {
+	ctx, err := s.lc.start(ctx, func() error {
+		if err := s.init(); err != nil {
+			return err
+		}
+		al, err := newAccessLogger(s.AccessLog, s.AccessLogFormat, s.AccessLogRotate, s.AccessLogMaxFiles)
+		if err != nil {
+			return err
+		}
+		s.accessLog = al
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer s.closeAccessLog()
+	s.lc.addCloser(&s.remotes)
+	var fns []func() error
+	for _, svc := range s.outs {
+		fns = append(fns, func() error {
+			if svc.network() == networkUDP {
+				return s.startListenUDP(svc)
+			}
+			return s.startListenOut(svc)
+		})
+	}
+	fns = append(fns, s.startListenClient, func() error {
+		s.startTrace(ctx)
+		return nil
+	})
+	if s.MetricsAddr != "" {
+		fns = append(fns, func() error {
+			return serveMetrics(&s.lc, s.logger(), s.MetricsAddr, s.MetricsHandler())
+		})
+	}
+	if s.AdminAddr != "" {
+		fns = append(fns, func() error {
+			return serveHTTP(&s.lc, s.logger(), "admin", s.AdminAddr, s.AdminHandler())
+		})
+	}
+	return s.lc.run(fns, s.clients.closeAll)
+}
+
+// closeAccessLog 停止后 client 的连接都已关闭，等待处理中的 OutHandler 写完访问日志后再关闭，最多等待 5 秒
+func (s *Server) closeAccessLog() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_ = waitIdle(ctx, func() bool {
+		return s.cntOuterNow.Load() > 0
+	})
+	_ = s.accessLog.Close()
+}
+
+// Shutdown 优雅关闭：先停止所有的监听，等待处理中的连接结束，若 ctx 超时则强制关闭
+// udp 会话在停止监听后会立即关闭
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.lc.shutdown(ctx, func() bool {
+		// 没有活跃 stream 的 client 连接可以先断开，使 client 尽快连接到新的 server
+		s.clients.closeIdle()
+		return s.cntOuterNow.Load() > 0 || s.cntForwardNow.Load() > 0
+	})
+}
 
-	eg := &xsync.WaitFirst{}
-	eg.GoErr(s.startListenOut)
-	eg.GoErr(s.startListenClient)
-	eg.GoErr(s.startTrace)
-	return eg.Wait()
+// closeListeners 停止所有的监听，不再接受新的连接
+func (s *Server) closeListeners() {
+	s.lc.closeListeners()
 }
 
-func (s *Server) startListenOut() error {
+func (s *Server) startListenOut(svc *ServerService) error {
 	// 对外暴露的端口，最终用户通过访问此端口来访问到内网的端口
-	log.Println("Listen tunnelOutServer at:", s.ListenOut)
-	l, err := net.Listen("tcp", s.ListenOut)
+	s.logger().Info("listen tunnelOutServer", "addr", svc.Listen, logKeyService, svc.Name)
+	l, err := net.Listen("tcp", svc.Listen)
 	if err != nil {
 		return err
 	}
-	var connID atomic.Int64
+	if !s.lc.addCloser(l) {
+		return nil
+	}
+	return s.serveOut(l, svc.Name, matchService(svc.Name, s.mainKID))
+}
 
+// serveOut 接受 l 上的连接，并转发给满足 match 的 client
+func (s *Server) serveOut(l net.Listener, service string, match func(cm *clientMux) bool) error {
+	var connID atomic.Int64
 	fs := &xrps.AnyServer{
 		Handler: xrps.HandleFunc(func(ctx context.Context, conn net.Conn) {
 			id := connID.Add(1)
-			s.outHandler(ctx, conn, id)
+			conn, ok := s.checkOuter(conn, id, service)
+			if !ok {
+				_ = conn.Close()
+				return
+			}
+			release, err := s.limits.Load().admit(ctx)
+			if err != nil {
+				_ = conn.Close()
+				s.limitRejected(service, conn.RemoteAddr(), err)
+				return
+			}
+			defer release()
+			s.outHandler(ctx, conn, id, service, match)
 		}),
 	}
 	return fs.Serve(l)
 }
 
-func (s *Server) outHandler(ctx context.Context, localConn net.Conn, id int64) {
+// checkOuter 在占用连接数和带宽的限额之前检查外部连接：先对连接的地址检查 ACL，
+// 开启 AcceptProxyProtocol 时，再读取可信的负载均衡发送的 PROXY header，并对其中的地址检查 ACL
+// 返回的连接的 RemoteAddr 为外部用户的地址
+func (s *Server) checkOuter(conn net.Conn, id int64, service string) (net.Conn, bool) {
+	if !s.allowed(listenerOut, conn.RemoteAddr()) {
+		return conn, false
+	}
+	if !s.AcceptProxyProtocol {
+		return conn, true
+	}
+	if !s.trustedProxy(conn.RemoteAddr()) {
+		return conn, false
+	}
+	pc, err := readProxyHeader(conn)
+	if err != nil {
+		s.logger().Warn("read PROXY header failed", slog.String(logKeyService, service), slog.Int64(logKeyConnID, id),
+			remoteAttr(conn), errAttr(err))
+		return conn, false
+	}
+	return pc, s.allowed(listenerOut, pc.RemoteAddr())
+}
+
+// listenRemote 为 client 的服务监听端口，同一个 client 的多个连接共用一个监听
+func (s *Server) listenRemote(clientID string, token string, service string, port int) (string, error) {
+	kid := keyID(token)
+	ln, created, err := s.remotes.acquire(remoteKey(kid, clientID, service), func() (net.Listener, error) {
+		return s.ports[token].listen(s.RemoteHost, port)
+	})
+	if err != nil {
+		return "", err
+	}
+	if created {
+		s.logger().Info("listen remote port", "addr", ln.Addr().String(), "client_id", clientID, logKeyService, service)
+		go func() {
+			match := func(cm *clientMux) bool {
+				return cm.keyID == kid && cm.clientID == clientID && cm.hasService(service)
+			}
+			err := s.serveOut(ln, service, match)
+			s.logger().Info("remote port closed", "addr", ln.Addr().String(), "client_id", clientID, logKeyService, service, errAttr(err))
+		}()
+	}
+	return ln.Addr().String(), nil
+}
+
+// unregister 释放 register 时为 client 监听的端口和 clientID 的绑定
+func (s *Server) unregister(req *registerRequest, kid [keyIDSize]byte) {
+	for name := range req.Ports {
+		s.remotes.release(remoteKey(kid, req.ClientID, name))
+	}
+	if req.ClientID != "" {
+		s.bindings.unbind(req.ClientID)
+	}
+}
+
+func (s *Server) outHandler(ctx context.Context, localConn net.Conn, id int64, service string, match func(cm *clientMux) bool) {
 	s.cntOuterNow.Add(1)
 	s.cntOuterTotal.Add(1)
 	defer func() {
@@ -96,33 +534,41 @@ func (s *Server) outHandler(ctx context.Context, localConn net.Conn, id int64) {
 		localConn.Close()
 	}()
 
-	msg := fmt.Sprintf("[server conn] [%d] ", id) + rwInfo(localConn)
-
-	log.Println(msg)
+	logger := s.logger().With(slog.String("kind", "outer"), slog.String(logKeyService, service),
+		slog.Int64(logKeyConnID, id), remoteAttr(localConn))
+	logger.Debug("conn accepted")
 	start := time.Now()
+	rec := &accessRecord{Start: start, Tunnel: s.Name, Peer: localConn.RemoteAddr().String(), Service: service, Reason: reasonNoClient}
+	defer func() {
+		rec.End = time.Now()
+		s.accessLog.log(rec)
+	}()
 
 	var stream *xio.MuxStream
+	var cm *clientMux
 	var err error
+	meta := (&StreamMeta{Service: service, Peer: localConn.RemoteAddr().String(), Dst: localConn.LocalAddr().String()}).encode()
 
 	for i := 0; i < 10; i++ {
-		mx := s.clientMux.Load()
-		if mx == nil {
-			err = errors.New("clientMux is nil, pls check tunnel-client")
-			log.Println("clientMux is nil, try=", i)
-			s.summoning()
+		cm = s.clients.pick(s.Balance, match)
+		if cm == nil {
+			err = errors.New("no tunnel client connected, pls check tunnel-client")
+			logger.Warn("no tunnel client", "try", i)
 			select {
 			case <-ctx.Done():
+			case <-s.lc.context().Done():
 			case <-time.After(50 * time.Millisecond):
-			case <-s.newConnCh:
-				// 已经创建好新的连接，立即重试
+			case <-s.clients.added():
+				// 已经有新的连接，立即重试
 			}
 			continue
 		}
-		stream, err = mx.Open()
+		stream, err = cm.mux.OpenWithPayload(meta)
 		if err != nil {
-			log.Println("clientMux open failed:", err)
-			mx.Close()
-			s.summoning()
+			// 连接已经不可用，从连接池中移除
+			logger.Warn("clientMux open failed", errAttr(err), slog.Int64(logKeyClient, cm.id))
+			s.clients.remove(cm)
+			cm.mux.Close()
 			continue
 		}
 		s.cntStreamTotal.Add(1)
@@ -130,34 +576,67 @@ func (s *Server) outHandler(ctx context.Context, localConn net.Conn, id int64) {
 	}
 
 	if stream != nil {
-		log.Println(msg, "start RWCopy, sid=", stream.ID())
-		err = internal.RWCopy(stream, localConn)
-		if err != nil {
+		// client 连接本地服务失败时，会回复失败的原因，此时直接关闭外部的连接
+		if err = waitStreamStatus(stream, cm.statusTimeout); err != nil {
 			s.cntStreamErrTotal.Add(1)
+			s.getMetrics().streamRejects.Inc()
+			logger.Warn("stream rejected", sidAttr(stream.ID()), slog.Int64(logKeyClient, cm.id), errAttr(err))
+			rec.ClientID, rec.Client, rec.SID, rec.Reason = cm.clientID, cm.id, stream.ID(), reasonRejected
+			_ = stream.Close()
+			stream = nil
 		}
 	}
-	cost := time.Since(start)
-	log.Println(msg, "closed, err=", err, ",cost=", cost.String(), ",cntOuter=", s.cntOuterNow.Load())
-}
 
-func (s *Server) summoning() {
-	select {
-	case <-s.needConnCh:
-	default:
+	if stream != nil {
+		cm.streams.Add(1)
+		logger = logger.With(sidAttr(stream.ID()), slog.Int64(logKeyClient, cm.id))
+		logger.Debug("start RWCopy")
+		cc := &countRW{ReadWriteCloser: localConn}
+		streamStart := time.Now()
+		cm.addStream(stream, &streamInfo{
+			meta:  &StreamMeta{Service: service},
+			peer:  localConn.RemoteAddr().String(),
+			since: streamStart,
+			bytes: &cc.byteCounter,
+		})
+		rw, release := s.limits.Load().wrap(cc, service, localConn.RemoteAddr())
+		res := internal.RWCopy(newHalfStream(stream), rw, s.IdleTimeout)
+		release()
+		if err = res.Err(); err != nil {
+			s.cntStreamErrTotal.Add(1)
+		}
+		rec.ClientID, rec.Client, rec.SID = cm.clientID, cm.id, stream.ID()
+		rec.BytesUp, rec.BytesDown = cc.read.Load(), cc.written.Load()
+		rec.Reason = closeReason(res, s.lc.isClosing())
+		cm.removeStream(stream)
+		s.getMetrics().stream.observe(streamStart, &cc.byteCounter)
+		cm.streams.Add(-1)
 	}
+	rec.Err = errString(err)
+	logger.Debug("conn closed", errAttr(err), costAttr(start), "outer_conns", s.cntOuterNow.Load())
 }
 
 func (s *Server) startListenClient() error {
-	log.Println("Listen tunnelInServer at:", s.ListenClient)
+	s.logger().Info("listen tunnelInServer", "addr", s.ListenClient, "tls", s.tlsConfig != nil)
 	l, err := net.Listen("tcp", s.ListenClient)
 	if err != nil {
 		return err
 	}
+	if !s.lc.addCloser(l) {
+		return nil
+	}
+	if s.tlsConfig != nil {
+		l = tls.NewListener(l, s.tlsConfig)
+	}
 
 	var connID atomic.Int64
 	fs := &xrps.AnyServer{
 		Handler: xrps.HandleFunc(func(ctx context.Context, conn net.Conn) {
 			id := connID.Add(1)
+			if !s.allowed(listenerClient, conn.RemoteAddr()) {
+				_ = conn.Close()
+				return
+			}
 			s.clientHandler(ctx, conn, id)
 		}),
 	}
@@ -165,86 +644,135 @@ func (s *Server) startListenClient() error {
 }
 
 // clientHandler 处理 tcp-tunnel-client 发起的连接
+// 连接校验通过后会加入连接池，直到连接断开
 func (s *Server) clientHandler(ctx context.Context, conn net.Conn, id int64) {
 	s.cntClientNow.Add(1)
 	defer s.cntClientNow.Add(-1)
 	s.cntClientTotal.Add(1)
 
 	start := time.Now()
-	msg := fmt.Sprintf("[tunnel client conn] [%d] ", id) + rwInfo(conn)
-	log.Println(msg, "ClientConnecting=", s.cntClientNow.Load())
-
-	rw := rwWithToken(conn, s.Token)
-
-	// 校验是否由客户端发送请求
-	if err1 := s.checkClientConn(conn, rw); err1 != nil {
-		_ = rw.Close()
-		log.Println(msg, "invalid client, err=", err1)
+	logger := s.logger().With(slog.String("kind", "tunnel_client"), slog.Int64(logKeyConnID, id), remoteAttr(conn))
+	logger.Debug("conn accepted", "client_conns", s.cntClientNow.Load())
+
+	// 握手并校验是否由客户端发送请求
+	rw, req, kid, err1 := s.checkClientConn(conn)
+	if err1 != nil {
+		_ = conn.Close()
+		s.getMetrics().handshakes.With(handshakeFailReason(err1)).Inc()
+		logger.Warn("invalid client", errAttr(err1))
 		return
 	}
 
-	tk := time.NewTicker(time.Second)
-	defer tk.Stop()
-
-	for idx := 0; ; idx++ {
-		select {
-		case s.needConnCh <- struct{}{}:
-			waitTime := time.Since(start)
-			if err := isBadConn(conn); err != nil {
-				conn.Close()
-				log.Println(msg, "loop=", idx, ",isBadConn:", err, "wait=", waitTime.String())
-				return
-			}
-			muc := xio.NewMux(false, rw)
-			old := s.clientMux.Swap(muc)
-			log.Println(msg, "replace as NewMux, loop=", idx, "wait=", waitTime.String())
-			s.cntClientNow.Add(1)
-			if old != nil {
-				_ = old.Close()
-				s.cntClientNow.Add(-1)
-			}
-
-			select {
-			case s.newConnCh <- struct{}{}:
-				// outHandler 里会接收此信号，以立即使用该连接
-			default:
-			}
-
-			return
-		case <-tk.C:
-			// 每秒检查一下当前连接是否完好，若连接已经断开则释放掉
-			waitTime := time.Since(start)
-			if err := isBadConn(conn); err != nil {
-				conn.Close()
-				log.Println(msg, "loop=", idx, ",isBadConn:", err, "wait=", waitTime.String())
-				return
-			}
-		}
+	defer s.unregister(req, kid)
+
+	cm := newClientMux(id, rw)
+	cm.remote = conn.RemoteAddr().String()
+	cm.services = req.Services
+	cm.clientID = req.ClientID
+	cm.keyID = kid
+	cm.statusTimeout = streamStatusTimeout(req.DialTimeout)
+	s.clients.add(cm)
+	logger.Info("added to pool", "client_id", req.ClientID, "clients", s.clients.len(), "services", req.Services)
+	go s.acceptStreams(cm)
+
+	var dead <-chan struct{} // client 不发送心跳时为 nil
+	if req.Heartbeat > 0 {
+		dead = watchHeartbeat(cm, req.Heartbeat)
+	}
+	select {
+	case <-cm.done:
+	case <-ctx.Done():
+	case <-s.lc.context().Done():
+	case <-dead:
+		s.getMetrics().heartbeatTimeouts.Inc()
+		logger.Warn("heartbeat timeout", "client_id", req.ClientID, "timeout", req.Heartbeat)
 	}
+	_ = cm.mux.Close()
+	s.clients.remove(cm)
+	logger.Info("removed from pool", "client_id", req.ClientID, "clients", s.clients.len(), costAttr(start))
 }
 
-func (s *Server) checkClientConn(conn net.Conn, rw io.ReadWriteCloser) error {
+func (s *Server) checkClientConn(conn net.Conn) (io.ReadWriteCloser, *registerRequest, [keyIDSize]byte, error) {
+	var kid [keyIDSize]byte
 	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
-	bf := make([]byte, len(helloMsgReq))
-	if _, err1 := io.ReadFull(rw, bf); err1 != nil {
-		return fmt.Errorf("read helloMsgReq failed: %w", err1)
+	if tc, ok := conn.(*tls.Conn); ok {
+		// 先完成 TLS 握手，以便区分失败的原因
+		if err := tc.Handshake(); err != nil {
+			return nil, nil, kid, fmt.Errorf("%w: %w", errTLS, err)
+		}
+	}
+	rw, token, err := serverHandshake(conn, s.lookupToken, s.cipherID, s.nonces)
+	if err != nil {
+		return nil, nil, kid, err
 	}
-	if !bytes.Equal(bf, helloMsgReq) {
-		return fmt.Errorf("invalid helloMsgReq: %q", bf)
+	kid = keyID(token)
+	req := &registerRequest{}
+	if err = readMsg(rw, req); err != nil {
+		return nil, nil, kid, fmt.Errorf("read register request failed: %w", err)
 	}
-	if _, err2 := rw.Write(helloMsgResp); err2 != nil {
-		return fmt.Errorf("write helloMsgResp failed: %w", err2)
+	resp := &registerResponse{}
+	if err = s.register(req, token, resp); err != nil {
+		resp = &registerResponse{Error: err.Error()}
+	}
+	if err1 := writeMsg(rw, resp); err1 != nil && err == nil {
+		s.unregister(req, kid)
+		err = err1
+	}
+	if err != nil {
+		return nil, nil, kid, fmt.Errorf("%w: %w", errRegister, err)
 	}
 	_ = conn.SetDeadline(time.Time{})
+	return rw, req, kid, nil
+}
+
+// register 处理 client 的注册请求，若失败，已经监听的端口会被释放
+// 使用 Token 之外的 token 时，只能接收为其监听的端口上的连接
+func (s *Server) register(req *registerRequest, token string, resp *registerResponse) error {
+	if len(req.Ports) > 0 && req.ClientID == "" {
+		return errors.New("client id is required to listen ports")
+	}
+	kid := keyID(token)
+	for _, name := range req.Services {
+		_, remote := req.Ports[name]
+		if remote || (kid == s.mainKID && s.hasService(name)) {
+			resp.Services = append(resp.Services, name)
+		}
+	}
+	for name := range req.Ports {
+		if !slices.Contains(req.Services, name) {
+			return fmt.Errorf("service %q is not registered", name)
+		}
+	}
+	if req.ClientID != "" {
+		if err := s.bindings.bind(req.ClientID, kid); err != nil {
+			return err
+		}
+	}
+	resp.Addrs = make(map[string]string, len(req.Ports))
+	for name, port := range req.Ports {
+		addr, err := s.listenRemote(req.ClientID, token, name, port)
+		if err != nil {
+			for done := range resp.Addrs {
+				s.remotes.release(remoteKey(kid, req.ClientID, done))
+			}
+			s.bindings.unbind(req.ClientID)
+			return fmt.Errorf("listen port for service %q: %w", name, err)
+		}
+		resp.Addrs[name] = addr
+	}
 	return nil
 }
 
-func (s *Server) startTrace() error {
+func (s *Server) startTrace(ctx context.Context) {
 	tm := time.NewTicker(5 * time.Second)
 	defer tm.Stop()
 
 	for {
-		<-tm.C
+		select {
+		case <-ctx.Done():
+			return
+		case <-tm.C:
+		}
 		info := map[string]any{
 			"StreamCreated": s.cntStreamTotal.Load(),
 			"StreamErrs":    s.cntStreamErrTotal.Load(),
@@ -253,9 +781,15 @@ func (s *Server) startTrace() error {
 			"OuterConnected":  s.cntOuterTotal.Load(),
 
 			"ClientConnecting": s.cntClientNow.Load(),
+			"ClientMuxes":      s.clients.len(),
 			"ClientConnected":  s.cntClientTotal.Load(),
+
+			"ForwardWorking": s.cntForwardNow.Load(),
+			"ForwardTotal":   s.cntForwardTotal.Load(),
+
+			"UDPSessionWorking": s.cntUDPSessionNow.Load(),
+			"UDPSessionTotal":   s.cntUDPSessionTotal.Load(),
 		}
-		bf, _ := json.Marshal(info)
-		log.Println("[server.trace]", string(bf))
+		s.logger().Debug("server trace", "stats", info)
 	}
 }
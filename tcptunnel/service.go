@@ -0,0 +1,422 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultService 默认服务的名称，即 Client.LocalAddr 和 Server.ListenOut 对应的服务
+const defaultService = ""
+
+// 服务的网络类型
+const (
+	networkTCP = "tcp"
+	networkUDP = "udp"
+)
+
+// splitNetwork 解析 udp://127.0.0.1:53 格式的地址，没有前缀时为 tcp
+func splitNetwork(addr string) (network string, address string) {
+	if after, ok := strings.CutPrefix(addr, networkUDP+"://"); ok {
+		return networkUDP, after
+	}
+	if after, ok := strings.CutPrefix(addr, networkTCP+"://"); ok {
+		return networkTCP, after
+	}
+	return networkTCP, addr
+}
+
+// joinNetwork 和 splitNetwork 相反，tcp 时不添加前缀
+func joinNetwork(network string, addr string) string {
+	if network == networkUDP {
+		return networkUDP + "://" + addr
+	}
+	return addr
+}
+
+// ClientService Client 发布的一个内网服务
+type ClientService struct {
+	// Name 服务名称，必填，和 Server 的 ServerService.Name 对应
+	Name string
+
+	// LocalAddr 内网服务的地址，必填，如 127.0.0.1:8080
+	LocalAddr string
+
+	// Network 网络类型，可选，tcp（默认）或者 udp，需要和 server 上同名服务的一致
+	Network string
+
+	// RemotePort 请求 server 为此服务监听的端口，可选
+	// 0 表示不请求，使用 server 上配置的同名服务；RemotePortAny 表示由 server 在允许的范围内任选
+	RemotePort int
+}
+
+func (s *ClientService) network() string {
+	if s.Network == "" {
+		return networkTCP
+	}
+	return s.Network
+}
+
+var _ flag.Value = (*ClientServices)(nil)
+
+// ClientServices 多个内网服务，可以作为 flag 使用，格式如 web=127.0.0.1:8080,ssh=127.0.0.1:22
+// 地址后可以使用 @port 或者 @any 请求 server 监听端口，如 web=127.0.0.1:8080@20001,ssh=127.0.0.1:22@any
+// udp 服务的地址需要有 udp:// 前缀，如 dns=udp://127.0.0.1:53
+type ClientServices []*ClientService
+
+func (cs *ClientServices) Set(str string) error {
+	items, err := parseNameAddrs(str)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		svc := &ClientService{Name: item[0]}
+		svc.Network, svc.LocalAddr = splitNetwork(item[1])
+		if addr, port, ok := strings.Cut(svc.LocalAddr, "@"); ok {
+			svc.LocalAddr = addr
+			if svc.RemotePort, err = parseRemotePort(port); err != nil {
+				return err
+			}
+		}
+		*cs = append(*cs, svc)
+	}
+	return nil
+}
+
+func parseRemotePort(str string) (int, error) {
+	if str == "any" {
+		return RemotePortAny, nil
+	}
+	port, err := strconv.Atoi(str)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid remote port %q", str)
+	}
+	return port, nil
+}
+
+func (cs *ClientServices) String() string {
+	if cs == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*cs))
+	for _, s := range *cs {
+		item := s.Name + "=" + joinNetwork(s.Network, s.LocalAddr)
+		switch {
+		case s.RemotePort == RemotePortAny:
+			item += "@any"
+		case s.RemotePort > 0:
+			item += "@" + strconv.Itoa(s.RemotePort)
+		}
+		items = append(items, item)
+	}
+	return strings.Join(items, ",")
+}
+
+// ServerService Server 对外发布的一个服务
+type ServerService struct {
+	// Name 服务名称，必填，和 Client 的 ClientService.Name 对应
+	Name string
+
+	// Listen 对外的监听地址，必填，如 :8100
+	Listen string
+
+	// Network 网络类型，可选，tcp（默认）或者 udp
+	Network string
+}
+
+func (s *ServerService) network() string {
+	if s.Network == "" {
+		return networkTCP
+	}
+	return s.Network
+}
+
+var _ flag.Value = (*ServerServices)(nil)
+
+// ServerServices 多个对外服务，可以作为 flag 使用，格式如 web=:8100,ssh=:8022
+// udp 服务的地址需要有 udp:// 前缀，如 dns=udp://:8053
+type ServerServices []*ServerService
+
+func (ss *ServerServices) Set(str string) error {
+	items, err := parseNameAddrs(str)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		svc := &ServerService{Name: item[0]}
+		svc.Network, svc.Listen = splitNetwork(item[1])
+		*ss = append(*ss, svc)
+	}
+	return nil
+}
+
+func (ss *ServerServices) String() string {
+	if ss == nil {
+		return ""
+	}
+	items := make([]string, 0, len(*ss))
+	for _, s := range *ss {
+		items = append(items, s.Name+"="+joinNetwork(s.Network, s.Listen))
+	}
+	return strings.Join(items, ",")
+}
+
+// parseNameAddrs 解析 name=addr,name=addr 格式的配置
+func parseNameAddrs(str string) ([][2]string, error) {
+	var result [][2]string
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(item, "=")
+		name = strings.TrimSpace(name)
+		addr = strings.TrimSpace(addr)
+		if !ok || name == "" || addr == "" {
+			return nil, fmt.Errorf("invalid service %q, expect name=addr", item)
+		}
+		result = append(result, [2]string{name, addr})
+	}
+	return result, nil
+}
+
+// envVar 和 xflag.EnvStringVar 类似，优先使用环境变量作为默认值
+func envVar(v flag.Value, name string, envKey string, usage string) {
+	ev := os.Getenv(envKey)
+	if ev != "" {
+		if err := v.Set(ev); err != nil {
+			log.Fatalf("parser flag %q from env.%q=%q failed: %v\n", name, envKey, ev, err)
+		}
+	}
+	usage += fmt.Sprintf(" [env %q = %q]", envKey, ev)
+	flag.Var(v, name, usage)
+}
+
+// StreamMeta 创建 stream 时，发起方发送给对方的元信息
+type StreamMeta struct {
+	// Service 服务名称，为空时为默认服务
+	Service string
+
+	// Target 正向隧道的目标地址，只在 client 创建的 stream 中有值
+	Target string
+
+	// Network 服务的网络类型，为空时为 tcp
+	Network string
+
+	// Ping 是否为心跳 stream，只在 client 创建的 stream 中有值
+	Ping bool
+
+	// Peer 外部用户的地址，只在 server 创建的 stream 中有值
+	Peer string
+
+	// Dst 外部用户连接的地址，即 server 的监听地址，只在 server 创建的 stream 中有值
+	Dst string
+}
+
+func (m *StreamMeta) network() string {
+	if m.Network == "" {
+		return networkTCP
+	}
+	return m.Network
+}
+
+// stream 元信息的字段类型，编码格式为：1 字节类型 | 2 字节长度（大端序）| 值
+// 不认识的字段会被忽略，以便于后续扩展
+const (
+	metaService byte = 1
+	metaTarget  byte = 2
+	metaNetwork byte = 3
+	metaPing    byte = 4
+	metaPeer    byte = 5
+	metaDst     byte = 6
+)
+
+func (m *StreamMeta) encode() []byte {
+	var bf []byte
+	add := func(tp byte, value string) {
+		if value == "" {
+			return
+		}
+		bf = append(bf, tp)
+		bf = binary.BigEndian.AppendUint16(bf, uint16(len(value)))
+		bf = append(bf, value...)
+	}
+	add(metaService, m.Service)
+	add(metaTarget, m.Target)
+	if m.Network != networkTCP {
+		add(metaNetwork, m.Network)
+	}
+	if m.Ping {
+		add(metaPing, "1")
+	}
+	add(metaPeer, m.Peer)
+	add(metaDst, m.Dst)
+	return bf
+}
+
+var errInvalidMeta = errors.New("invalid stream meta")
+
+func decodeStreamMeta(bf []byte) (*StreamMeta, error) {
+	m := &StreamMeta{}
+	for len(bf) > 0 {
+		if len(bf) < 3 {
+			return nil, errInvalidMeta
+		}
+		tp := bf[0]
+		size := int(binary.BigEndian.Uint16(bf[1:3]))
+		if len(bf) < 3+size {
+			return nil, errInvalidMeta
+		}
+		value := string(bf[3 : 3+size])
+		bf = bf[3+size:]
+		switch tp {
+		case metaService:
+			m.Service = value
+		case metaTarget:
+			m.Target = value
+		case metaNetwork:
+			m.Network = value
+		case metaPing:
+			m.Ping = true
+		case metaPeer:
+			m.Peer = value
+		case metaDst:
+			m.Dst = value
+		}
+	}
+	return m, nil
+}
+
+var (
+	errStreamRejected      = errors.New("stream rejected by tunnel client")
+	errStreamStatusTimeout = errors.New("wait stream status timeout")
+)
+
+// maxReasonSize stream 失败原因的最大长度
+const maxReasonSize = 1024
+
+// writeStreamStatus 在 stream 上回复连接本地服务的结果，reason 为空表示成功
+// client 在 server 创建的每个 stream 上都会先回复此结果，之后才是实际的数据
+// 格式为：1 字节状态（0：成功，1：失败）| 2 字节长度（大端序）| 失败原因
+func writeStreamStatus(w io.Writer, reason string) error {
+	if len(reason) > maxReasonSize {
+		reason = reason[:maxReasonSize]
+	}
+	bf := make([]byte, 1, 3+len(reason))
+	if reason != "" {
+		bf[0] = 1
+	}
+	bf = binary.BigEndian.AppendUint16(bf, uint16(len(reason)))
+	_, err := w.Write(append(bf, reason...))
+	return err
+}
+
+// readStreamStatus 读取 client 回复的连接本地服务的结果，失败时返回的 error 包含失败原因
+func readStreamStatus(r io.Reader) error {
+	var header [3]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return fmt.Errorf("read stream status failed: %w", err)
+	}
+	reason := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return fmt.Errorf("read stream status failed: %w", err)
+	}
+	if header[0] == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", errStreamRejected, reason)
+}
+
+// streamStatusTimeout 等待 client 回复 stream 状态的超时时间，dialTimeout 为 0 时使用默认值
+func streamStatusTimeout(dialTimeout time.Duration) time.Duration {
+	if dialTimeout <= 0 {
+		return time.Minute
+	}
+	return dialTimeout + 5*time.Second
+}
+
+// waitStreamStatus 和 readStreamStatus 相同，但是超过 timeout 没有读取到时返回错误
+// MuxStream 不支持设置读超时，超时后会关闭 stream，使读取立即返回
+func waitStreamStatus(stream io.ReadCloser, timeout time.Duration) error {
+	if timeout <= 0 {
+		return readStreamStatus(stream)
+	}
+	tm := time.AfterFunc(timeout, func() {
+		_ = stream.Close()
+	})
+	err := readStreamStatus(stream)
+	if !tm.Stop() {
+		return fmt.Errorf("%w: %s", errStreamStatusTimeout, timeout)
+	}
+	return err
+}
+
+// registerRequest 握手完成后，client 向 server 注册的信息
+type registerRequest struct {
+	ClientID string   // client 的标识，同一个 client 的多个连接相同
+	Services []string // client 发布的服务名称
+
+	// Ports 需要 server 监听的服务名称 -> 端口，端口为 0 表示由 server 任选
+	Ports map[string]int `json:",omitempty"`
+
+	// Heartbeat server 超过此时间没有收到心跳时断开连接，为 0 表示 client 不发送心跳
+	Heartbeat time.Duration `json:",omitempty"`
+
+	// DialTimeout client 为每个 stream 连接本地服务最多需要的时间，server 据此计算等待 stream 状态的超时时间
+	DialTimeout time.Duration `json:",omitempty"`
+}
+
+// registerResponse server 对 registerRequest 的回复
+type registerResponse struct {
+	Services []string // server 上有对应监听的服务名称
+
+	// Addrs 为 registerRequest.Ports 实际监听的地址
+	Addrs map[string]string `json:",omitempty"`
+
+	Error string
+}
+
+// maxMsgSize 控制消息的最大长度
+const maxMsgSize = 64 * 1024
+
+// writeMsg 写入控制消息，格式为：4 字节长度（大端序）| JSON
+func writeMsg(w io.Writer, msg any) error {
+	bf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(bf) > maxMsgSize {
+		return fmt.Errorf("message too large (%d)", len(bf))
+	}
+	data := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(bf)), uint32(len(bf)))
+	_, err = w.Write(append(data, bf...))
+	return err
+}
+
+func readMsg(r io.Reader, msg any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxMsgSize {
+		return fmt.Errorf("message too large (%d)", size)
+	}
+	bf := make([]byte, size)
+	if _, err := io.ReadFull(r, bf); err != nil {
+		return err
+	}
+	return json.Unmarshal(bf, msg)
+}
@@ -0,0 +1,152 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// getTLSConfig 和 Client 之间连接的 TLS 配置，若未配置证书则返回 nil
+func (s *Server) getTLSConfig() (*tls.Config, error) {
+	if s.TLSConfig != nil {
+		return s.TLSConfig, nil
+	}
+	if s.TLSCertFile == "" && s.TLSKeyFile == "" {
+		if s.TLSClientCAFile != "" {
+			return nil, errors.New("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.TLSCertFile, s.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls cert failed: %w", err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.TLSClientCAFile != "" {
+		pool, err := loadCertPool(s.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// getTLSConfig 连接 server 的 TLS 配置，若未启用 TLS 则返回 nil
+func (c *Client) getTLSConfig() (*tls.Config, error) {
+	if c.TLSConfig != nil {
+		return c.TLSConfig, nil
+	}
+	if !c.TLS {
+		return nil, nil
+	}
+	cfg := &tls.Config{
+		ServerName: c.TLSServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if cfg.ServerName == "" {
+		host, _, err := net.SplitHostPort(c.ServerAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerAddr %q: %w", c.ServerAddr, err)
+		}
+		cfg.ServerName = host
+	}
+	if c.TLSCAFile != "" {
+		pool, err := loadCertPool(c.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client cert failed: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if c.TLSPinSHA256 != "" {
+		pins, err := parsePins(c.TLSPinSHA256)
+		if err != nil {
+			return nil, err
+		}
+		// 只配置了证书指纹，没有配置 CA 的时候，只校验指纹，以支持自签名证书
+		cfg.InsecureSkipVerify = c.TLSCAFile == ""
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+	return cfg, nil
+}
+
+func loadCertPool(fp string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(fp)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no valid certificate found in %q", fp)
+	}
+	return pool, nil
+}
+
+// parsePins 解析证书公钥（SPKI）的 sha256 指纹，多个使用逗号分隔，
+// 支持 hex 和 base64 两种格式
+func parsePins(str string) ([][]byte, error) {
+	var pins [][]byte
+	for _, item := range strings.Split(str, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pin, err := hex.DecodeString(item)
+		if err != nil {
+			pin, err = base64.StdEncoding.DecodeString(item)
+		}
+		if err != nil || len(pin) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 pin %q", item)
+		}
+		pins = append(pins, pin)
+	}
+	if len(pins) == 0 {
+		return nil, fmt.Errorf("invalid sha256 pins %q", str)
+	}
+	return pins, nil
+}
+
+var errTLSPin = errors.New("tls certificate pin mismatch")
+
+func verifyPins(cs tls.ConnectionState, pins [][]byte) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errTLSPin
+	}
+	sum := spkiSHA256(cs.PeerCertificates[0])
+	for _, pin := range pins {
+		if bytes.Equal(pin, sum) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: got %s", errTLSPin, hex.EncodeToString(sum))
+}
+
+func spkiSHA256(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
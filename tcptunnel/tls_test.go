@@ -0,0 +1,188 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	CertFile string
+	KeyFile  string
+}
+
+// newTestCert 生成测试用的证书，parent 为 nil 时生成自签名的 CA 证书
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	xt.NoError(t, err)
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := tpl, key
+	if parent == nil {
+		tpl.IsCA = true
+		tpl.BasicConstraintsValid = true
+		tpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, signer, &key.PublicKey, signerKey)
+	xt.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	xt.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	xt.NoError(t, err)
+	dir := t.TempDir()
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+	}
+	xt.NoError(t, os.WriteFile(tc.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	xt.NoError(t, os.WriteFile(tc.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return tc
+}
+
+func tlsHandshake(t *testing.T, s *Server, c *Client) (serr, cerr error) {
+	t.Helper()
+	scfg, err := s.getTLSConfig()
+	xt.NoError(t, err)
+	ccfg, err := c.getTLSConfig()
+	xt.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			serr = err
+			return
+		}
+		defer conn.Close()
+		tc := tls.Server(conn, scfg)
+		if serr = tc.Handshake(); serr == nil {
+			// 读取以完成 TLS 1.3 下 client 证书的校验
+			_, _ = tc.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	xt.NoError(t, err)
+	tc := tls.Client(conn, ccfg)
+	if cerr = tc.Handshake(); cerr == nil {
+		_, cerr = tc.Write([]byte("1"))
+	}
+	_ = conn.Close()
+	<-done
+	return serr, cerr
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	srv := newTestCert(t, "tunnel.example", ca)
+	cli := newTestCert(t, "client.example", ca)
+	other := newTestCert(t, "other-ca", nil)
+
+	t.Run("server only", func(t *testing.T) {
+		s := &Server{TLSCertFile: srv.CertFile, TLSKeyFile: srv.KeyFile}
+		c := &Client{TLS: true, ServerAddr: "tunnel.example:8090", TLSCAFile: ca.CertFile}
+		serr, cerr := tlsHandshake(t, s, c)
+		xt.NoError(t, serr)
+		xt.NoError(t, cerr)
+	})
+
+	t.Run("server name", func(t *testing.T) {
+		s := &Server{TLSCertFile: srv.CertFile, TLSKeyFile: srv.KeyFile}
+		c := &Client{TLS: true, ServerAddr: "10.0.0.1:8090", TLSCAFile: ca.CertFile}
+		_, cerr := tlsHandshake(t, s, c)
+		xt.Error(t, cerr)
+
+		c.TLSServerName = "tunnel.example"
+		_, cerr = tlsHandshake(t, s, c)
+		xt.NoError(t, cerr)
+	})
+
+	t.Run("unknown ca", func(t *testing.T) {
+		s := &Server{TLSCertFile: srv.CertFile, TLSKeyFile: srv.KeyFile}
+		c := &Client{TLS: true, ServerAddr: "tunnel.example:8090", TLSCAFile: other.CertFile}
+		_, cerr := tlsHandshake(t, s, c)
+		xt.Error(t, cerr)
+	})
+
+	t.Run("mtls", func(t *testing.T) {
+		s := &Server{TLSCertFile: srv.CertFile, TLSKeyFile: srv.KeyFile, TLSClientCAFile: ca.CertFile}
+		c := &Client{TLS: true, ServerAddr: "tunnel.example:8090", TLSCAFile: ca.CertFile}
+		serr, _ := tlsHandshake(t, s, c)
+		xt.Error(t, serr)
+
+		c.TLSCertFile = cli.CertFile
+		c.TLSKeyFile = cli.KeyFile
+		serr, cerr := tlsHandshake(t, s, c)
+		xt.NoError(t, serr)
+		xt.NoError(t, cerr)
+
+		c.TLSCertFile = other.CertFile
+		c.TLSKeyFile = other.KeyFile
+		serr, _ = tlsHandshake(t, s, c)
+		xt.Error(t, serr)
+	})
+
+	t.Run("pin", func(t *testing.T) {
+		s := &Server{TLSCertFile: srv.CertFile, TLSKeyFile: srv.KeyFile}
+		c := &Client{TLS: true, ServerAddr: "127.0.0.1:8090", TLSPinSHA256: hex.EncodeToString(spkiSHA256(srv.cert))}
+		_, cerr := tlsHandshake(t, s, c)
+		xt.NoError(t, cerr)
+
+		c.TLSPinSHA256 = hex.EncodeToString(spkiSHA256(cli.cert))
+		_, cerr = tlsHandshake(t, s, c)
+		xt.ErrorIs(t, cerr, errTLSPin)
+
+		// 同时配置 CA 和指纹，两者都需要校验通过
+		c.TLSCAFile = other.CertFile
+		c.TLSPinSHA256 = hex.EncodeToString(spkiSHA256(srv.cert))
+		_, cerr = tlsHandshake(t, s, c)
+		xt.Error(t, cerr)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		cfg, err := (&Server{}).getTLSConfig()
+		xt.NoError(t, err)
+		xt.Nil(t, cfg)
+		cfg, err = (&Client{}).getTLSConfig()
+		xt.NoError(t, err)
+		xt.Nil(t, cfg)
+		_, err = (&Client{TLS: true, ServerAddr: "127.0.0.1:8090", TLSPinSHA256: "abc"}).getTLSConfig()
+		xt.Error(t, err)
+	})
+}
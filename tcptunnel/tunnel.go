@@ -5,11 +5,13 @@
 package tcptunnel
 
 import (
-	"encoding/json"
-	"fmt"
+	"context"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
+	"slices"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,19 +28,136 @@ type Tunneler struct {
 	// RemoteRW 和远端 Tunneler client 或者 server 的连接
 	RemoteRW func() io.ReadWriteCloser
 
-	// LocalRW 和本地其他 server（待穿透的实际服务），如 nginx 等的连接
+	// LocalDial 连接本地其他 server（待穿透的实际服务），如 nginx 等
+	// meta 为 server 创建 stream 时发送的元信息，返回的错误会回复给 server
+	LocalDial func(meta *StreamMeta) (io.ReadWriteCloser, error)
+
+	// LocalRW 和本地其他 server 的连接，返回 nil 表示连接失败
+	//
+	// Deprecated: 仅为兼容保留，使用 LocalDial。LocalDial 有值时不使用 LocalRW
 	LocalRW func() io.ReadWriteCloser
 
 	Worker int
 
 	Token string
 
-	stopped atomic.Bool
+	// HeartbeatInterval 心跳间隔，可选，小于等于 0 时不发送心跳
+	HeartbeatInterval time.Duration
+
+	// HeartbeatMisses 连续多少次心跳失败后断开连接并重连，可选，默认 3
+	HeartbeatMisses int
+
+	// IdleTimeout stream 和本地连接两个方向都超过此时间没有数据时关闭，可选，默认不超时，
+	// 但一个方向半关闭后，另一个方向超过 2 分钟没有数据时也会关闭
+	IdleTimeout time.Duration
+
+	// Logger 日志，可选，默认为 slog.Default()
+	Logger *slog.Logger
+
+	lc lifecycle
+
+	metrics *streamMetrics // 可以为 nil
+
+	heartbeatMetrics *heartbeatMetrics // 可以为 nil
 
 	cntStreamNow   atomic.Int64
 	cntStreamTotal atomic.Int64
 
 	cntRemoteTotal atomic.Int64 // 连接到远程 server 的总数
+
+	mu    sync.Mutex
+	muxes []*xio.Mux // 和远端的所有连接，用于主动创建 stream
+	next  int
+}
+
+var (
+	errNoRemote = errors.New("no remote connected")
+	errNoLocal  = errors.New("local service unavailable")
+)
+
+// localRW 创建到本地服务的连接
+func (c *Tunneler) localRW(meta *StreamMeta) (io.ReadWriteCloser, error) {
+	if c.LocalDial != nil {
+		return c.LocalDial(meta)
+	}
+	if c.LocalRW != nil {
+		if conn := c.LocalRW(); conn != nil {
+			return conn, nil
+		}
+	}
+	return nil, errNoLocal
+}
+
+// rejectStream 回复 server 连接本地服务失败的原因，并等待 server 关闭 stream，避免 server 还没有读取到原因 stream 就被关闭
+func rejectStream(stream *xio.MuxStream, err error) {
+	if writeStreamStatus(stream, err.Error()) != nil {
+		return
+	}
+	tm := time.NewTimer(5 * time.Second)
+	defer tm.Stop()
+	select {
+	case <-stream.Done():
+	case <-tm.C:
+	}
+}
+
+// Open 在和远端的连接上创建一个 stream，有多个连接时轮询选择
+// tcp 的 stream 需要使用 halfStream 读写，和 server 一致
+func (c *Tunneler) Open(payload []byte) (*xio.MuxStream, error) {
+	c.mu.Lock()
+	if len(c.muxes) == 0 {
+		c.mu.Unlock()
+		return nil, errNoRemote
+	}
+	c.next++
+	muc := c.muxes[c.next%len(c.muxes)]
+	c.mu.Unlock()
+	return muc.OpenWithPayload(payload)
+}
+
+// addMux 添加一个连接，若已经在停止中，返回 false
+func (c *Tunneler) addMux(muc *xio.Mux) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lc.isClosing() {
+		return false
+	}
+	c.muxes = append(c.muxes, muc)
+	return true
+}
+
+// closeAll 关闭所有和远端的连接
+func (c *Tunneler) closeAll() {
+	c.mu.Lock()
+	muxes := slices.Clone(c.muxes)
+	c.mu.Unlock()
+	for _, muc := range muxes {
+		_ = muc.Close()
+	}
+}
+
+// closeIdle 关闭所有没有活跃 stream 的连接
+func (c *Tunneler) closeIdle() {
+	c.mu.Lock()
+	muxes := slices.Clone(c.muxes)
+	c.mu.Unlock()
+	for _, muc := range muxes {
+		if muxIdle(muc) {
+			_ = muc.Close()
+		}
+	}
+}
+
+func (c *Tunneler) removeMux(muc *xio.Mux) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.muxes = slices.DeleteFunc(c.muxes, func(m *xio.Mux) bool {
+		return m == muc
+	})
+}
+
+func (c *Tunneler) logger() *slog.Logger {
+	return getLogger(c.Logger)
 }
 
 func (c *Tunneler) getWorker() int {
@@ -48,78 +167,126 @@ func (c *Tunneler) getWorker() int {
 	return 1
 }
 
-func (c *Tunneler) Start() error {
-	var eg xsync.WaitFirst
-	eg.GoErr(c.connectToLocal)
-	eg.Go(c.startTrace)
-	return eg.Wait()
-}
-
-func (c *Tunneler) connectToLocal() error {
-	ec := make(chan error, c.getWorker())
+// Start 启动，会一直运行直到 ctx 被取消或者调用了 Shutdown，停止时返回 nil
+func (c *Tunneler) Start(ctx context.Context) error {
+	ctx, err := c.lc.start(ctx, nil)
+	if err != nil {
+		return err
+	}
+	fns := make([]func() error, 0, c.getWorker()+1)
 	for i := 0; i < c.getWorker(); i++ {
-		go c.localWorker(i, ec)
+		fns = append(fns, func() error {
+			c.localWorker(ctx, i)
+			return nil
+		})
 	}
-	return <-ec
+	fns = append(fns, func() error {
+		c.startTrace(ctx)
+		return nil
+	})
+	return c.lc.run(fns, c.closeAll)
 }
 
-func (c *Tunneler) localWorker(id int, ec chan<- error) {
-	defer func() {
-		ec <- fmt.Errorf("worker %d exit", id)
-	}()
+// Shutdown 优雅关闭：不再接受新的 stream，等待处理中的 stream 结束，若 ctx 超时则强制关闭
+func (c *Tunneler) Shutdown(ctx context.Context) error {
+	return c.lc.shutdown(ctx, func() bool {
+		c.closeIdle()
+		return c.cntStreamNow.Load() > 0
+	})
+}
+
+func (c *Tunneler) localWorker(ctx context.Context, id int) {
+	logger := c.logger().With(slog.Int("worker", id))
+	defer logger.Info("Tunneler worker exit")
 
 	onRemote := func(conn io.ReadWriteCloser) {
 		defer conn.Close()
 
-		muc := xio.NewMux(true, conn)
+		rm := &readMonitor{ReadWriteCloser: conn}
+		muc := xio.NewMux(true, rm)
 		defer muc.Close()
+		if !c.addMux(muc) {
+			return
+		}
+		defer c.removeMux(muc)
 
+		done := make(chan struct{})
+		defer close(done)
 		go func() {
 			tm := time.NewTicker(5 * time.Second)
-			for range tm.C {
+			defer tm.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-tm.C:
+				}
 				var ids []int
 				muc.Range(func(s *xio.MuxStream) bool {
 					ids = append(ids, int(s.ID()))
 					return true
 				})
 				sort.Ints(ids)
-				log.Println("Tunneler MuxStream.IDS=", ids)
+				logger.Debug("Tunneler MuxStream ids", "ids", ids)
 			}
 		}()
 
+		if c.HeartbeatInterval > 0 {
+			go c.heartbeat(muc, rm, done, logger)
+		}
+
 		var wg xsync.WaitGroup
 		for {
 			stream, err := muc.Accept() // 接受到一个 server 传过来的连接
 			if err != nil {
-				log.Println("mux.Accept err:", err)
+				logger.Info("mux.Accept failed", errAttr(err))
 				break
 			}
+			if c.lc.isClosing() {
+				// 停止中，不再接受新的 stream
+				_ = stream.Close()
+				continue
+			}
 			c.cntStreamTotal.Add(1)
 			num := c.cntStreamNow.Add(1)
-			log.Printf("mux.Accept stream sid=%d, cntStream=%d", stream.ID(), num)
+			logger.Debug("mux.Accept stream", sidAttr(stream.ID()), "streams", num)
 			wg.Go(func() {
 				defer func() {
 					stream.Close()
 					c.cntStreamNow.Add(-1)
 				}()
 
+				meta, err2 := decodeStreamMeta(stream.Hello())
+				if err2 != nil {
+					logger.Warn("decode stream meta failed", sidAttr(stream.ID()), errAttr(err2))
+					return
+				}
+
 				// 创建到本地端口的连接
-				localConn := c.LocalRW()
-				if localConn == nil {
+				localConn, err2 := c.localRW(meta)
+				if err2 != nil {
+					logger.Warn("connect local failed", sidAttr(stream.ID()), logKeyService, meta.Service, errAttr(err2))
+					rejectStream(stream, err2)
+					return
+				}
+				if err2 = writeStreamStatus(stream, ""); err2 != nil {
+					_ = localConn.Close()
 					return
 				}
 				start := time.Now()
-				log.Printf("start copy remote (sid=%d) to local", stream.ID())
-				err1 := internal.RWCopy(stream, localConn)
-				cost := time.Since(start)
-				log.Printf("copied remote (sid=%d) to local, cost=%s, err=%v", stream.ID(), cost.String(), err1)
+				logger.Debug("start copy remote to local", sidAttr(stream.ID()), logKeyService, meta.Service)
+				cc := &countRW{ReadWriteCloser: localConn}
+				res := internal.RWCopy(wrapStream(stream, meta.Network != networkUDP), cc, c.IdleTimeout)
+				c.metrics.observe(start, &cc.byteCounter)
+				logger.Debug("copied remote to local", sidAttr(stream.ID()), logKeyService, meta.Service,
+					costAttr(start), errAttr(res.Err()))
 			})
 		}
 		muc.Close()
 		wg.Wait()
 	}
 
-	for !c.stopped.Load() {
+	for ctx.Err() == nil && !c.lc.isClosing() {
 		remoteConn := c.RemoteRW()
 		if remoteConn == nil {
 			continue
@@ -127,7 +294,7 @@ func (c *Tunneler) localWorker(id int, ec chan<- error) {
 		c.cntRemoteTotal.Add(1)
 		if err := isBadConn(remoteConn); err != nil {
 			_ = remoteConn.Close()
-			log.Println("remote conn is bad, err=", err)
+			logger.Warn("remote conn is bad", errAttr(err))
 			continue
 		}
 		safely.RunVoid(func() {
@@ -136,23 +303,31 @@ func (c *Tunneler) localWorker(id int, ec chan<- error) {
 	}
 }
 
+// Stop 立即停止，不等待处理中的 stream 结束
+//
+// Deprecated: 使用 Shutdown
 func (c *Tunneler) Stop() {
-	c.stopped.Store(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = c.Shutdown(ctx)
 }
 
-func (c *Tunneler) startTrace() {
+func (c *Tunneler) startTrace(ctx context.Context) {
 	tm := time.NewTicker(5 * time.Second)
 	defer tm.Stop()
 
-	for !c.stopped.Load() {
-		<-tm.C
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tm.C:
+		}
 		info := map[string]any{
 			"StreamWorking": c.cntStreamNow.Load(),
 			"StreamTotal":   c.cntStreamTotal.Load(),
 
 			"RemoteConnected": c.cntRemoteTotal.Load(),
 		}
-		bf, _ := json.Marshal(info)
-		log.Println("[Tunneler.trace]", string(bf))
+		c.logger().Debug("Tunneler trace", "stats", info)
 	}
 }
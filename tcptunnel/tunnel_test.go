@@ -0,0 +1,352 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// freeAddr 返回一个当前可用的本地监听地址
+func freeAddr(t testing.TB) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startEchoServer 启动一个 echo server，作为被穿透的内网服务
+func startEchoServer(t testing.TB) string {
+	t.Helper()
+	return startNamedServer(t, "")
+}
+
+// startNamedServer 启动一个 echo server，在连接建立后会先发送 name
+func startNamedServer(t testing.TB, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := conn.Write([]byte(name)); err != nil {
+					return
+				}
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func waitFor(t testing.TB, fn func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if fn() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("wait timeout")
+}
+
+// echoOnce 通过 addr 发送一条消息，并校验收到相同的回复
+func echoOnce(addr string, msg string) error {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err = conn.Write([]byte(msg)); err != nil {
+		return err
+	}
+	bf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, bf); err != nil {
+		return err
+	}
+	if string(bf) != msg {
+		return fmt.Errorf("got %q, want %q", bf, msg)
+	}
+	return nil
+}
+
+// startTestTunnel 启动 s 和 c，测试结束时停止，返回的 chan 会收到 Start 的结果
+// 没有配置对外服务时，会使用默认服务，c 没有配置本地服务时，使用 echo server
+func startTestTunnel(t testing.TB, s *Server, c *Client) (serr <-chan error, cerr <-chan error) {
+	t.Helper()
+	if s.ListenOut == "" && len(s.Services) == 0 && s.AllowPorts == "" {
+		s.ListenOut = freeAddr(t)
+	}
+	s.ListenClient = freeAddr(t)
+	c.ServerAddr = s.ListenClient
+	if c.LocalAddr == "" && len(c.Services) == 0 {
+		c.LocalAddr = startEchoServer(t)
+	}
+	se := make(chan error, 1)
+	ce := make(chan error, 1)
+	go func() {
+		se <- s.Start(t.Context())
+	}()
+	waitFor(t, func() bool {
+		conn, err := net.Dial("tcp", s.ListenClient)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	})
+	go func() {
+		ce <- c.Start(t.Context())
+	}()
+	return se, ce
+}
+
+func Test_tunnel(t *testing.T) {
+	for _, cipher := range []string{"aes-ctr", "aes-gcm", "chacha20-poly1305"} {
+		t.Run(cipher, func(t *testing.T) {
+			s := &Server{Token: "hello", Cipher: cipher}
+			c := &Client{Token: "hello", Cipher: cipher, Worker: 2}
+			startTestTunnel(t, s, c)
+			waitFor(t, func() bool {
+				return s.clients.len() == 2
+			})
+
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Go(func() {
+					xt.NoError(t, echoOnce(s.ListenOut, fmt.Sprintf("hello-%d", i)))
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func Test_tunnelServices(t *testing.T) {
+	s := &Server{
+		Services: ServerServices{
+			{Name: "web", Listen: freeAddr(t)},
+			{Name: "ssh", Listen: freeAddr(t)},
+			{Name: "db", Listen: freeAddr(t)},
+		},
+	}
+	c := &Client{
+		Services: ClientServices{
+			{Name: "web", LocalAddr: startNamedServer(t, "web")},
+			{Name: "ssh", LocalAddr: startNamedServer(t, "ssh")},
+		},
+	}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	for _, name := range []string{"web", "ssh"} {
+		conn, err := net.Dial("tcp", s.Services[slices.IndexFunc(s.Services, func(svc *ServerService) bool {
+			return svc.Name == name
+		})].Listen)
+		xt.NoError(t, err)
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		bf := make([]byte, len(name))
+		_, err = io.ReadFull(conn, bf)
+		xt.NoError(t, err)
+		xt.Equal(t, name, string(bf))
+		_ = conn.Close()
+	}
+
+	// 没有 client 注册 db 服务，连接会被关闭
+	conn, err := net.Dial("tcp", s.Services[2].Listen)
+	xt.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	xt.ErrorIs(t, err, io.EOF)
+}
+
+func Test_tunnelRemotePort(t *testing.T) {
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	s := &Server{
+		Token:      "hello",
+		AllowPorts: port,
+		RemoteHost: "127.0.0.1",
+		Tokens:     TokenPorts{"guest": ""},
+	}
+	c := &Client{Token: "hello", Worker: 2, RemotePort: RemotePortAny}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 2
+	})
+	addr := c.RemoteAddr(defaultService)
+	xt.True(t, strings.HasSuffix(addr, ":"+port))
+	xt.Equal(t, 1, s.remotes.len())
+	xt.NoError(t, echoOnce(addr, "hello"))
+
+	// guest 不允许请求监听端口
+	c2 := &Client{Token: "guest", ServerAddr: s.ListenClient, LocalAddr: startEchoServer(t), RemotePort: RemotePortAny}
+	xt.NoError(t, c2.initServices())
+	c2.ClientID = "guest"
+	c2.cipherID = cipherAESCTR
+	conn, err := net.Dial("tcp", s.ListenClient)
+	xt.NoError(t, err)
+	defer conn.Close()
+	_, err = c2.handshake(conn)
+	xt.Error(t, err)
+	xt.True(t, strings.Contains(err.Error(), errPortNotAllowed.Error()))
+}
+
+// Test_tunnelTokenIsolation 使用其他 token 的 client 不能冒用 clientID 接管端口，也不能接收公开服务的连接
+func Test_tunnelTokenIsolation(t *testing.T) {
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	_, guestPort, _ := net.SplitHostPort(freeAddr(t))
+	s := &Server{
+		ListenOut:  freeAddr(t),
+		Token:      "hello",
+		AllowPorts: port,
+		RemoteHost: "127.0.0.1",
+		Tokens:     TokenPorts{"guest": guestPort},
+	}
+	c := &Client{Token: "hello", ClientID: "c1", LocalAddr: startNamedServer(t, "c1"), RemotePort: RemotePortAny}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1 && c.RemoteAddr(defaultService) != ""
+	})
+
+	// guest 使用相同的 clientID 注册失败
+	c2 := &Client{Token: "guest", ServerAddr: s.ListenClient, LocalAddr: startEchoServer(t), RemotePort: RemotePortAny}
+	xt.NoError(t, c2.initServices())
+	c2.ClientID = "c1"
+	c2.cipherID = cipherAESCTR
+	conn, err := net.Dial("tcp", s.ListenClient)
+	xt.NoError(t, err)
+	defer conn.Close()
+	_, err = c2.handshake(conn)
+	xt.ErrorContains(t, err, errClientIDTaken.Error())
+	xt.Equal(t, 1, s.remotes.len())
+
+	// guest 注册同名的默认服务，也不会接收 ListenOut 的连接
+	c3 := &Client{Token: "guest", ClientID: "c3", ServerAddr: s.ListenClient, LocalAddr: startNamedServer(t, "c3")}
+	go c3.Start(t.Context())
+	waitFor(t, func() bool {
+		return s.clients.len() == 2
+	})
+	for range 4 {
+		conn := dialTCP(t, s.ListenOut)
+		bf := make([]byte, 2)
+		_, err = io.ReadFull(conn, bf)
+		xt.NoError(t, err)
+		xt.Equal(t, "c1", string(bf))
+		_ = conn.Close()
+	}
+	conn = dialTCP(t, c.RemoteAddr(defaultService))
+	bf := make([]byte, 2)
+	_, err = io.ReadFull(conn, bf)
+	xt.NoError(t, err)
+	xt.Equal(t, "c1", string(bf))
+	_ = conn.Close()
+	waitStreamsDone(t, c)
+}
+
+func Test_tunnelStreamRejected(t *testing.T) {
+	bf := &syncBuffer{}
+	s := &Server{Logger: slog.New(slog.NewTextHandler(bf, nil))}
+	c := &Client{
+		LocalAddr:         freeAddr(t), // 本地服务不可用
+		LocalDialAttempts: 1,
+	}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+	conn, err := net.Dial("tcp", s.ListenOut)
+	xt.NoError(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	xt.ErrorIs(t, err, io.EOF)
+	xt.Equal(t, uint64(1), s.getMetrics().streamRejects.Load())
+	xt.True(t, strings.Contains(bf.String(), "stream rejected"))
+	xt.True(t, strings.Contains(bf.String(), "connection refused"))
+	xt.Equal(t, 1, c.localRetry(c.LocalAddr).getFailures())
+}
+
+// BenchmarkTunnelThroughput 通过隧道向本地服务发送数据的吞吐量
+// 和 io.Copy 的对比见 internal 中的 BenchmarkCopy
+func BenchmarkTunnelThroughput(b *testing.B) {
+	const size = 32 * 1024
+	var received atomic.Int64
+	local := startHandlerServer(b, func(conn *net.TCPConn) {
+		n, _ := io.Copy(io.Discard, conn)
+		received.Add(n)
+	})
+	s := &Server{}
+	startTestTunnel(b, s, &Client{LocalAddr: local})
+	waitFor(b, func() bool {
+		return s.clients.len() == 1
+	})
+	conn, err := net.Dial("tcp", s.ListenOut)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	chunk := make([]byte, size)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err = conn.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	deadline := time.Now().Add(30 * time.Second)
+	for received.Load() < int64(b.N)*size {
+		if time.Now().After(deadline) {
+			b.Fatalf("received %d bytes, want %d", received.Load(), int64(b.N)*size)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTunneler_localRW(t *testing.T) {
+	meta := &StreamMeta{Service: "web"}
+	_, err := (&Tunneler{}).localRW(meta)
+	xt.ErrorIs(t, err, errNoLocal)
+
+	c1, _ := net.Pipe()
+	tl := &Tunneler{
+		LocalRW: func() io.ReadWriteCloser {
+			return c1
+		},
+	}
+	conn, err := tl.localRW(meta)
+	xt.NoError(t, err)
+	xt.Equal(t, io.ReadWriteCloser(c1), conn)
+
+	// LocalDial 优先
+	tl.LocalDial = func(m *StreamMeta) (io.ReadWriteCloser, error) {
+		return nil, errors.New("dial " + m.Service)
+	}
+	_, err = tl.localRW(meta)
+	xt.ErrorContains(t, err, "dial web")
+}
@@ -0,0 +1,336 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xanygo/anygo/xio"
+)
+
+// defaultUDPIdleTimeout udp 会话默认的空闲超时时间
+const defaultUDPIdleTimeout = time.Minute
+
+// maxDatagramSize udp 数据包的最大长度
+const maxDatagramSize = 65535
+
+// udp 数据包在 stream 中的格式为：2 字节长度（大端序）| 数据
+
+func writeDatagram(w io.Writer, p []byte) error {
+	if len(p) > maxDatagramSize {
+		return fmt.Errorf("datagram too large (%d)", len(p))
+	}
+	bf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(p)), uint16(len(p)))
+	_, err := w.Write(append(bf, p...))
+	return err
+}
+
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, fmt.Errorf("datagram too large (%d)", size)
+	}
+	return io.ReadFull(r, buf[:size])
+}
+
+// datagramConn 将已连接的 udp 连接转换为 stream 中的数据包格式，
+// 以便于直接使用 RWCopy 和 stream 互相复制数据
+type datagramConn struct {
+	net.Conn
+	idle time.Duration
+	rbuf []byte // 已读取但还未被消费的数据包
+	wbuf []byte // 还不完整的数据包
+	buf  []byte
+}
+
+func newDatagramConn(conn net.Conn, idle time.Duration) *datagramConn {
+	return &datagramConn{
+		Conn: conn,
+		idle: idle,
+		buf:  make([]byte, 2+maxDatagramSize),
+	}
+}
+
+func (d *datagramConn) Read(p []byte) (int, error) {
+	if len(d.rbuf) == 0 {
+		if d.idle > 0 {
+			_ = d.Conn.SetReadDeadline(time.Now().Add(d.idle))
+		}
+		n, err := d.Conn.Read(d.buf[2:])
+		if err != nil {
+			return 0, err
+		}
+		binary.BigEndian.PutUint16(d.buf, uint16(n))
+		d.rbuf = d.buf[:2+n]
+	}
+	n := copy(p, d.rbuf)
+	d.rbuf = d.rbuf[n:]
+	return n, nil
+}
+
+func (d *datagramConn) Write(p []byte) (int, error) {
+	d.wbuf = append(d.wbuf, p...)
+	var offset int
+	for len(d.wbuf)-offset >= 2 {
+		size := int(binary.BigEndian.Uint16(d.wbuf[offset:]))
+		if len(d.wbuf)-offset < 2+size {
+			break
+		}
+		if _, err := d.Conn.Write(d.wbuf[offset+2 : offset+2+size]); err != nil {
+			return 0, err
+		}
+		offset += 2 + size
+	}
+	d.wbuf = append(d.wbuf[:0], d.wbuf[offset:]...)
+	return len(p), nil
+}
+
+// udpSession 一个 udp 对端地址对应的会话，使用一个 stream 传输
+type udpSession struct {
+	peer   net.Addr
+	stream *xio.MuxStream
+	cm     *clientMux
+	active atomic.Int64 // 最后活跃时间，UnixNano
+	bytes  byteCounter  // read：从对端收到的字节数，written：发送给对端的字节数
+
+	release func() // 释放占用的 MaxStreams 限额
+}
+
+func (us *udpSession) touch() {
+	us.active.Store(time.Now().UnixNano())
+}
+
+// udpServer 对外的 udp 服务
+type udpServer struct {
+	s        *Server
+	pc       net.PacketConn
+	service  string
+	match    func(cm *clientMux) bool
+	idle     time.Duration
+	logger   *slog.Logger
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+
+	noClientLog logLimiter // 没有可用的 client 时，每个数据包都会触发
+}
+
+func (s *Server) getUDPIdleTimeout() time.Duration {
+	if s.UDPIdleTimeout > 0 {
+		return s.UDPIdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+func (c *Client) getUDPIdleTimeout() time.Duration {
+	if c.UDPIdleTimeout > 0 {
+		return c.UDPIdleTimeout
+	}
+	return defaultUDPIdleTimeout
+}
+
+func (s *Server) startListenUDP(svc *ServerService) error {
+	s.logger().Info("listen tunnelOutServer", "addr", "udp://"+svc.Listen, logKeyService, svc.Name)
+	pc, err := net.ListenPacket(networkUDP, svc.Listen)
+	if err != nil {
+		return err
+	}
+	if !s.lc.addCloser(pc) {
+		return nil
+	}
+	us := &udpServer{
+		s:        s,
+		pc:       pc,
+		service:  svc.Name,
+		match:    matchService(svc.Name, s.mainKID),
+		idle:     s.getUDPIdleTimeout(),
+		logger:   s.logger().With(slog.String("kind", "udp"), slog.String(logKeyService, svc.Name)),
+		sessions: make(map[string]*udpSession),
+	}
+	return us.serve()
+}
+
+func (u *udpServer) serve() error {
+	defer u.pc.Close()
+	done := make(chan struct{})
+	defer close(done)
+	defer u.closeAll()
+	go u.cleanIdle(done)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, peer, err := u.pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			u.logger.Warn("read failed", errAttr(err))
+			continue
+		}
+		us := u.getSession(peer)
+		if us == nil {
+			continue
+		}
+		us.touch()
+		us.bytes.read.Add(int64(n))
+		if err = writeDatagram(us.stream, buf[:n]); err != nil {
+			u.closeSession(us, err)
+		}
+	}
+}
+
+// getSession 获取 peer 对应的会话，若不存在则创建，没有可用的 client 或者超过限制时返回 nil
+// 新的会话和外部 tcp 连接一样受 MaxStreams 和 StreamRate 的限制，但不会排队等待
+func (u *udpServer) getSession(peer net.Addr) *udpSession {
+	key := peer.String()
+	u.mu.Lock()
+	us := u.sessions[key]
+	u.mu.Unlock()
+	if us != nil {
+		return us
+	}
+	if !u.s.allowed(listenerOut, peer) {
+		return nil
+	}
+	release, err := u.s.limits.Load().tryAdmit()
+	if err != nil {
+		u.s.limitRejected(u.service, peer, err)
+		return nil
+	}
+	meta := (&StreamMeta{Service: u.service, Network: networkUDP, Peer: key}).encode()
+	for i := 0; i < 3; i++ {
+		cm := u.s.clients.pick(u.s.Balance, u.match)
+		if cm == nil {
+			u.noClientLog.log(u.logger, "no tunnel client, drop datagram", "peer", key)
+			break
+		}
+		stream, err := cm.mux.OpenWithPayload(meta)
+		if err != nil {
+			u.logger.Warn("clientMux open failed", errAttr(err), slog.Int64(logKeyClient, cm.id))
+			u.s.clients.remove(cm)
+			cm.mux.Close()
+			continue
+		}
+		us = &udpSession{
+			peer:    peer,
+			stream:  stream,
+			cm:      cm,
+			release: release,
+		}
+		us.touch()
+		cm.addStream(stream, &streamInfo{
+			meta:  &StreamMeta{Service: u.service, Network: networkUDP},
+			peer:  key,
+			since: time.Now(),
+			bytes: &us.bytes,
+		})
+		cm.streams.Add(1)
+		u.s.cntStreamTotal.Add(1)
+		u.s.cntUDPSessionNow.Add(1)
+		u.s.cntUDPSessionTotal.Add(1)
+
+		u.mu.Lock()
+		u.sessions[key] = us
+		u.mu.Unlock()
+		u.logger.Debug("session created", "peer", key, sidAttr(stream.ID()), slog.Int64(logKeyClient, cm.id))
+		go u.readSession(us)
+		return us
+	}
+	release()
+	return nil
+}
+
+// readSession 将 client 返回的数据包发送给对端
+func (u *udpServer) readSession(us *udpSession) {
+	if err := waitStreamStatus(us.stream, us.cm.statusTimeout); err != nil {
+		u.s.getMetrics().streamRejects.Inc()
+		u.closeSession(us, err)
+		return
+	}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := readDatagram(us.stream, buf)
+		if err != nil {
+			u.closeSession(us, err)
+			return
+		}
+		us.touch()
+		if _, err = u.pc.WriteTo(buf[:n], us.peer); err != nil {
+			u.closeSession(us, err)
+			return
+		}
+		us.bytes.written.Add(int64(n))
+	}
+}
+
+func (u *udpServer) closeSession(us *udpSession, err error) {
+	key := us.peer.String()
+	u.mu.Lock()
+	if u.sessions[key] != us {
+		u.mu.Unlock()
+		return
+	}
+	delete(u.sessions, key)
+	u.mu.Unlock()
+
+	_ = us.stream.Close()
+	us.release()
+	us.cm.removeStream(us.stream)
+	us.cm.streams.Add(-1)
+	u.s.cntUDPSessionNow.Add(-1)
+	u.logger.Debug("session closed", "peer", key, sidAttr(us.stream.ID()), errAttr(err))
+}
+
+// cleanIdle 定期关闭空闲的会话
+func (u *udpServer) cleanIdle(done <-chan struct{}) {
+	tk := time.NewTicker(max(u.idle/2, 10*time.Millisecond))
+	defer tk.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-tk.C:
+		}
+		deadline := time.Now().Add(-u.idle).UnixNano()
+		var idle []*udpSession
+		u.mu.Lock()
+		for _, us := range u.sessions {
+			if us.active.Load() < deadline {
+				idle = append(idle, us)
+			}
+		}
+		u.mu.Unlock()
+		for _, us := range idle {
+			u.closeSession(us, errUDPIdle)
+		}
+	}
+}
+
+var errUDPIdle = errors.New("udp session idle timeout")
+
+var errUDPClosed = errors.New("udp server closed")
+
+func (u *udpServer) closeAll() {
+	u.mu.Lock()
+	all := make([]*udpSession, 0, len(u.sessions))
+	for _, us := range u.sessions {
+		all = append(all, us)
+	}
+	u.mu.Unlock()
+	for _, us := range all {
+		u.closeSession(us, errUDPClosed)
+	}
+}
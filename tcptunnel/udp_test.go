@@ -0,0 +1,181 @@
+// Copyright(C) 2026 github.com/fsgo  All Rights Reserved.
+// Author: hidu <duv123@gmail.com>
+// Date: 2026/10/18
+
+package tcptunnel
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xanygo/anygo/xt"
+)
+
+// startUDPEchoServer 启动一个 udp echo server
+func startUDPEchoServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	t.Cleanup(func() {
+		_ = pc.Close()
+	})
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func Test_datagram(t *testing.T) {
+	var bf bytes.Buffer
+	xt.NoError(t, writeDatagram(&bf, []byte("hello")))
+	xt.NoError(t, writeDatagram(&bf, nil))
+	xt.Error(t, writeDatagram(&bf, make([]byte, maxDatagramSize+1)))
+
+	buf := make([]byte, 10)
+	n, err := readDatagram(&bf, buf)
+	xt.NoError(t, err)
+	xt.Equal(t, "hello", string(buf[:n]))
+	n, err = readDatagram(&bf, buf)
+	xt.NoError(t, err)
+	xt.Equal(t, 0, n)
+
+	xt.NoError(t, writeDatagram(&bf, []byte("hello world")))
+	_, err = readDatagram(&bf, buf)
+	xt.Error(t, err)
+}
+
+func Test_datagramConn(t *testing.T) {
+	addr := startUDPEchoServer(t)
+	conn, err := net.Dial("udp", addr)
+	xt.NoError(t, err)
+	dc := newDatagramConn(conn, time.Second)
+	defer dc.Close()
+
+	var frames bytes.Buffer
+	xt.NoError(t, writeDatagram(&frames, []byte("hello")))
+	xt.NoError(t, writeDatagram(&frames, []byte("world")))
+	data := frames.Bytes()
+	// 数据包被拆分为多次写入
+	for _, p := range [][]byte{data[:1], data[1:4], data[4:9], data[9:]} {
+		n, err := dc.Write(p)
+		xt.NoError(t, err)
+		xt.Equal(t, len(p), n)
+	}
+	xt.Equal(t, 0, len(dc.wbuf))
+
+	buf := make([]byte, 16)
+	for _, want := range []string{"hello", "world"} {
+		n, err := readDatagram(dc, buf)
+		xt.NoError(t, err)
+		xt.Equal(t, want, string(buf[:n]))
+	}
+}
+
+func Test_tunnelUDP(t *testing.T) {
+	s := &Server{
+		Services:       ServerServices{{Name: "dns", Listen: "127.0.0.1:0", Network: networkUDP}},
+		UDPIdleTimeout: 200 * time.Millisecond,
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	s.Services[0].Listen = pc.LocalAddr().String()
+	_ = pc.Close()
+
+	c := &Client{
+		Services: ClientServices{{Name: "dns", LocalAddr: startUDPEchoServer(t), Network: networkUDP}},
+	}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+
+	echo := func(conn net.Conn, msg string) error {
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return err
+		}
+		if string(buf[:n]) != msg {
+			return fmt.Errorf("got %q, want %q", buf[:n], msg)
+		}
+		return nil
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("udp", s.Services[0].Listen)
+		xt.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	for i := 0; i < 3; i++ {
+		for j, conn := range conns {
+			xt.NoError(t, echo(conn, fmt.Sprintf("hello-%d-%d", i, j)))
+		}
+	}
+	xt.Equal(t, int64(3), s.cntUDPSessionTotal.Load())
+
+	// 空闲超时后会话被关闭，再次发送会创建新的会话
+	waitFor(t, func() bool {
+		return s.cntUDPSessionNow.Load() == 0
+	})
+	xt.NoError(t, echo(conns[0], "again"))
+	xt.Equal(t, int64(4), s.cntUDPSessionTotal.Load())
+}
+
+func Test_tunnelUDPLimits(t *testing.T) {
+	s := &Server{
+		Services:   ServerServices{{Name: "dns", Listen: "127.0.0.1:0", Network: networkUDP}},
+		MaxStreams: 1,
+	}
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	xt.NoError(t, err)
+	s.Services[0].Listen = pc.LocalAddr().String()
+	_ = pc.Close()
+
+	c := &Client{
+		Services: ClientServices{{Name: "dns", LocalAddr: startUDPEchoServer(t), Network: networkUDP}},
+	}
+	startTestTunnel(t, s, c)
+	waitFor(t, func() bool {
+		return s.clients.len() == 1
+	})
+
+	echo := func(conn net.Conn, msg string) error {
+		_ = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		buf := make([]byte, 100)
+		_, err := conn.Read(buf)
+		return err
+	}
+	c1, err := net.Dial("udp", s.Services[0].Listen)
+	xt.NoError(t, err)
+	defer c1.Close()
+	c2, err := net.Dial("udp", s.Services[0].Listen)
+	xt.NoError(t, err)
+	defer c2.Close()
+
+	xt.NoError(t, echo(c1, "hello"))
+	// 已有一个会话，新的会话被拒绝，数据包被丢弃
+	xt.Error(t, echo(c2, "hello"))
+	xt.Equal(t, int64(1), s.cntUDPSessionTotal.Load())
+	xt.Equal(t, uint64(1), s.getMetrics().limitRejects.With(limitReasonMaxStreams).Load())
+	// 已有的会话不受影响
+	xt.NoError(t, echo(c1, "world"))
+}